@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+// bonsaiVersionAnnotation is the annotation sensuctl sets on assets installed
+// from Bonsai, recording the installed asset version.
+const bonsaiVersionAnnotation = "io.sensu.bonsai.version"
+
+// assetReference is a runtime asset attached to the runbook job, optionally
+// pinned to a specific version.
+type assetReference struct {
+	Name    string
+	Version string
+}
+
+// isAssetURL reports whether the asset reference is a full URL (e.g.
+// "https://assets.example.com/nginx-tools.tar.gz") rather than an asset name.
+func isAssetURL(ref string) bool {
+	return strings.Contains(ref, "://")
+}
+
+// parseAssetReference parses a name[:version] asset reference; full URL
+// references are never pinned to a version.
+func parseAssetReference(s string) (assetReference, error) {
+	if isAssetURL(s) {
+		return assetReference{Name: strings.TrimSpace(s)}, nil
+	}
+	parts := strings.SplitN(strings.TrimSpace(s), ":", 2)
+	ref := assetReference{Name: strings.TrimSpace(parts[0])}
+	if len(parts) > 1 {
+		ref.Version = strings.TrimPrefix(strings.TrimSpace(parts[1]), "v")
+		if len(ref.Version) == 0 {
+			return ref, fmt.Errorf("invalid asset reference \"%s\" (expected name[:version])", s)
+		}
+	}
+	if len(ref.Name) == 0 {
+		return ref, fmt.Errorf("invalid asset reference \"%s\" (expected name[:version])", s)
+	}
+	return ref, nil
+}
+
+// runtimeAssets returns the assets requested via --runtime-assets and --asset,
+// in that order, followed by the assets of the triggering check with
+// --inherit-event-assets (unless already requested). The hosts of full URL
+// references are rewritten according to --asset-url-rewrite.
+func runtimeAssets() ([]assetReference, error) {
+	rewrites, err := parseAssetURLRewrites(config.AssetURLRewrites)
+	if err != nil {
+		return nil, err
+	}
+	var refs []assetReference
+	if len(config.RuntimeAssets) > 0 {
+		for _, name := range strings.Split(config.RuntimeAssets, ",") {
+			refs = append(refs, assetReference{Name: name})
+		}
+	}
+	for _, asset := range config.Assets {
+		ref, err := parseAssetReference(asset)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	if config.InheritEventAssets && triggeringEvent != nil && triggeringEvent.Check != nil {
+		var requested = make(map[string]bool)
+		for _, ref := range refs {
+			requested[strings.TrimSpace(ref.Name)] = true
+		}
+		for _, name := range triggeringEvent.Check.RuntimeAssets {
+			if !requested[name] {
+				requested[name] = true
+				refs = append(refs, assetReference{Name: name})
+			}
+		}
+	}
+	for i := range refs {
+		if refs[i].Name, err = rewriteAssetURL(refs[i].Name, rewrites); err != nil {
+			return nil, err
+		}
+	}
+	return refs, nil
+}
+
+// parseAssetURLRewrites parses the --asset-url-rewrite old=new options into a
+// map of the hosts to rewrite.
+func parseAssetURLRewrites(specs []string) (map[string]string, error) {
+	var rewrites = make(map[string]string)
+	for _, spec := range specs {
+		i := strings.Index(spec, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid --asset-url-rewrite \"%s\" (must be old-host=new-host)", spec)
+		}
+		from, to := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+		if len(from) == 0 || len(to) == 0 || strings.ContainsAny(from+to, "/ ") {
+			return nil, fmt.Errorf("invalid --asset-url-rewrite \"%s\" (must be old-host=new-host)", spec)
+		}
+		rewrites[from] = to
+	}
+	return rewrites, nil
+}
+
+// rewriteAssetURL rewrites the host of a full URL asset reference; asset names
+// are returned unchanged.
+func rewriteAssetURL(ref string, rewrites map[string]string) (string, error) {
+	if !isAssetURL(ref) || len(rewrites) == 0 {
+		return ref, nil
+	}
+	u, err := url.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return "", fmt.Errorf("invalid asset reference \"%s\": %w", ref, err)
+	}
+	if host, ok := rewrites[u.Host]; ok {
+		u.Host = host
+	}
+	return u.String(), nil
+}
+
+func getAsset(ctx context.Context, httpClient *http.Client, namespace string, name string) (*v2.Asset, error) {
+	req, err := newAPIRequest(
+		ctx,
+		"GET",
+		apiPath("/namespaces/%s/assets/%s", namespace, name),
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := doWithRetry(httpClient, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, responseError(req, resp)
+	}
+	var asset v2.Asset
+	err = json.NewDecoder(resp.Body).Decode(&asset)
+	if err != nil {
+		return nil, err
+	}
+	return &asset, nil
+}
+
+// validateAssets verifies the requested assets exist in the given namespace,
+// reporting all of the missing ones at once. Assets pinned to a version are
+// always verified, and must carry a matching Bonsai version annotation; the
+// remaining assets are only verified when --validate-assets is set. Assets
+// without any builds (which the agents cannot install) are logged as a
+// warning.
+func validateAssets(ctx context.Context, httpClient *http.Client, namespace string) error {
+	refs, err := runtimeAssets()
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for _, ref := range refs {
+		if isAssetURL(ref.Name) || (len(ref.Version) == 0 && !config.ValidateAssets) {
+			// full URL references are not registered assets
+			continue
+		}
+		asset, err := getAsset(ctx, httpClient, namespace, ref.Name)
+		if errors.Is(err, ErrNotFound) {
+			missing = append(missing, fmt.Sprintf("\"%s\"", ref.Name))
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to get asset \"%s\" in namespace \"%s\": %w", ref.Name, namespace, err)
+		}
+		if len(asset.URL) == 0 && len(asset.Builds) == 0 {
+			logger.Warnf("asset \"%s\" in namespace \"%s\" has no builds, so the agents cannot install it\n", ref.Name, namespace)
+		}
+		if len(ref.Version) == 0 {
+			continue
+		}
+		version := strings.TrimPrefix(asset.Annotations[bonsaiVersionAnnotation], "v")
+		if version != ref.Version {
+			return fmt.Errorf("asset \"%s\" is version \"%s\", expected \"%s\"", ref.Name, version, ref.Version)
+		}
+	}
+	if len(missing) == 1 {
+		return fmt.Errorf("asset %s not found in namespace \"%s\"", missing[0], namespace)
+	} else if len(missing) > 1 {
+		return fmt.Errorf("assets %s not found in namespace \"%s\"", strings.Join(missing, ", "), namespace)
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+func TestGenerateCheckConfigAssets(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	config.RuntimeAssets = "sensu-ruby-runtime,sensu-plugins-disk-checks"
+	config.Assets = []string{"sensu-runbook-scripts:1.2.0", "jq"}
+
+	job, err := generateCheckConfig("default")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []string{"sensu-ruby-runtime", "sensu-plugins-disk-checks", "sensu-runbook-scripts", "jq"}
+	if !reflect.DeepEqual(job.RuntimeAssets, expected) {
+		t.Errorf("expected runtime assets %v, got %v", expected, job.RuntimeAssets)
+	}
+
+	config.Assets = []string{"jq:"}
+	if _, err := generateCheckConfig("default"); err == nil {
+		t.Error("expected error for an empty asset version")
+	}
+}
+
+func TestGenerateCheckConfigAssetDownloadGrace(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	config.Timeout = "10"
+	config.AssetDownloadGrace = 50
+
+	job, err := generateCheckConfig("default")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if job.Timeout != 10 {
+		t.Errorf("expected the grace to be ignored without runtime assets (timeout 10), got %d", job.Timeout)
+	}
+
+	config.RuntimeAssets = "sensu-ruby-runtime"
+	if job, err = generateCheckConfig("default"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if job.Timeout != 60 {
+		t.Errorf("expected the timeout to include the grace (60), got %d", job.Timeout)
+	}
+
+	config.AssetDownloadGrace = 0
+	if job, err = generateCheckConfig("default"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if job.Timeout != 10 {
+		t.Errorf("expected timeout 10 without a grace, got %d", job.Timeout)
+	}
+
+	config.Timeout = "4294967295"
+	config.AssetDownloadGrace = 1
+	if _, err := generateCheckConfig("default"); err == nil {
+		t.Error("expected error for a timeout exceeding the maximum")
+	}
+}
+
+func TestGenerateCheckConfigInheritEventAssets(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	stdin = strings.NewReader(`{
+  "entity": {"metadata": {"name": "web-1", "namespace": "default"}},
+  "check": {"metadata": {"name": "check-nginx", "namespace": "default"}, "runtime_assets": ["sensu-ruby-runtime", "nginx-tools", "jq"]}
+}`)
+	defer func() { stdin = os.Stdin }()
+	config.SensuAPIUrl = "http://127.0.0.1:8080"
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "nginx-tools reload"
+	config.Subscriptions = "web"
+	config.RuntimeAssets = "sensu-ruby-runtime"
+	config.Assets = []string{"jq:1.6"}
+	config.InheritEventAssets = true
+
+	if _, err := checkArgs(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	job, err := generateCheckConfig("default")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []string{"sensu-ruby-runtime", "jq", "nginx-tools"}
+	if !reflect.DeepEqual(job.RuntimeAssets, expected) {
+		t.Errorf("expected runtime assets %v, got %v", expected, job.RuntimeAssets)
+	}
+
+	config.InheritEventAssets = false
+	job, err = generateCheckConfig("default")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if expected := []string{"sensu-ruby-runtime", "jq"}; !reflect.DeepEqual(job.RuntimeAssets, expected) {
+		t.Errorf("expected only the requested runtime assets without --inherit-event-assets, got %v", job.RuntimeAssets)
+	}
+}
+
+func TestGenerateCheckConfigAssetURLRewrite(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	config.Assets = []string{
+		"https://assets.bonsai.sensu.io/sensu-ruby-runtime_0.1.0_linux_amd64.tar.gz",
+		"https://github.com/acme/tools/releases/download/v1.0.0/tools.tar.gz",
+		"jq:1.6",
+	}
+	config.AssetURLRewrites = []string{"assets.bonsai.sensu.io=mirror.internal:8443"}
+
+	job, err := generateCheckConfig("default")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	b, err := json.Marshal(job)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var marshaled struct {
+		RuntimeAssets []string `json:"runtime_assets"`
+	}
+	if err := json.Unmarshal(b, &marshaled); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []string{
+		"https://mirror.internal:8443/sensu-ruby-runtime_0.1.0_linux_amd64.tar.gz",
+		"https://github.com/acme/tools/releases/download/v1.0.0/tools.tar.gz",
+		"jq",
+	}
+	if !reflect.DeepEqual(marshaled.RuntimeAssets, expected) {
+		t.Errorf("expected runtime assets %v, got %v", expected, marshaled.RuntimeAssets)
+	}
+
+	for _, rewrite := range []string{"assets.bonsai.sensu.io", "=mirror.internal", "https://assets.bonsai.sensu.io=mirror.internal"} {
+		config.AssetURLRewrites = []string{rewrite}
+		if _, err := generateCheckConfig("default"); err == nil {
+			t.Errorf("expected error for --asset-url-rewrite %q", rewrite)
+		}
+	}
+}
+
+func TestValidateAssets(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/assets/sensu-runbook-scripts", http.StatusOK, v2.Asset{
+		ObjectMeta: v2.ObjectMeta{
+			Name:        "sensu-runbook-scripts",
+			Namespace:   "default",
+			Annotations: map[string]string{bonsaiVersionAnnotation: "1.2.0"},
+		},
+	})
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/assets/jq", http.StatusOK, v2.Asset{
+		ObjectMeta: v2.ObjectMeta{Name: "jq", Namespace: "default"},
+	})
+
+	config.Assets = []string{"sensu-runbook-scripts:1.2.0", "missing"}
+	if err := validateAssets(context.Background(), sensuAPI.Client(), "default"); err != nil {
+		t.Errorf("expected pinned version to match, got %s", err)
+	}
+	if n := len(sensuAPI.requestsTo("GET", "/api/core/v2/namespaces/default/assets/missing")); n != 0 {
+		t.Errorf("expected unpinned assets to be skipped without --validate-assets, got %d requests", n)
+	}
+
+	config.Assets = []string{"sensu-runbook-scripts:2.0.0"}
+	err := validateAssets(context.Background(), sensuAPI.Client(), "default")
+	if err == nil || !strings.Contains(err.Error(), "expected \"2.0.0\"") {
+		t.Errorf("expected version mismatch error, got %v", err)
+	}
+
+	config.Assets = []string{"jq", "missing"}
+	config.ValidateAssets = true
+	err = validateAssets(context.Background(), sensuAPI.Client(), "default")
+	if err == nil || !strings.Contains(err.Error(), "\"missing\" not found") {
+		t.Errorf("expected missing asset error, got %v", err)
+	}
+}
+
+func TestValidateAssetsReportsAll(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	var logs bytes.Buffer
+	logger.SetOutput(&logs)
+	defer logger.SetOutput(os.Stderr)
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/assets/jq", http.StatusOK, v2.Asset{
+		ObjectMeta: v2.ObjectMeta{Name: "jq", Namespace: "default"},
+		Builds:     []*v2.AssetBuild{{URL: "https://example.com/jq.tar.gz", Sha512: "abc"}},
+	})
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/assets/empty", http.StatusOK, v2.Asset{
+		ObjectMeta: v2.ObjectMeta{Name: "empty", Namespace: "default"},
+	})
+	config.ValidateAssets = true
+
+	config.Assets = []string{"jq", "empty"}
+	if err := validateAssets(context.Background(), sensuAPI.Client(), "default"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.Contains(logs.String(), "asset \"empty\" in namespace \"default\" has no builds") {
+		t.Errorf("expected a warning for the asset without builds, got %q", logs.String())
+	}
+	if strings.Contains(logs.String(), "\"jq\"") {
+		t.Errorf("expected no warning for the asset with builds, got %q", logs.String())
+	}
+
+	config.Assets = []string{"missing-1", "jq", "missing-2"}
+	err := validateAssets(context.Background(), sensuAPI.Client(), "default")
+	if err == nil || err.Error() != "assets \"missing-1\", \"missing-2\" not found in namespace \"default\"" {
+		t.Errorf("expected all the missing assets to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// backend is the --sensu-api-url backend the API requests are sent to. With
+// several (comma-separated) backends, requests fail over to the next one when
+// the current one cannot be connected to, and subsequent requests keep using
+// it.
+var backend struct {
+	sync.Mutex
+	// urls is the --sensu-api-url that index refers to
+	urls  string
+	index int
+}
+
+// sensuAPIUrls returns the --sensu-api-url backends, in order.
+func sensuAPIUrls() []string {
+	var urls []string
+	for _, u := range strings.Split(config.SensuAPIUrl, ",") {
+		if u = strings.TrimSpace(u); len(u) > 0 {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// validSensuAPIUrls reports whether every --sensu-api-url backend is an
+// absolute URL, returning the first one that isn't otherwise.
+func validSensuAPIUrls() (string, bool) {
+	urls := sensuAPIUrls()
+	if len(urls) == 0 {
+		return config.SensuAPIUrl, false
+	}
+	for _, sensuAPIUrl := range urls {
+		if u, err := url.Parse(sensuAPIUrl); err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+			return sensuAPIUrl, false
+		}
+	}
+	return "", true
+}
+
+// currentBackend returns the --sensu-api-url backend to send API requests to.
+func currentBackend() string {
+	backend.Lock()
+	defer backend.Unlock()
+	urls := sensuAPIUrls()
+	if backend.urls != config.SensuAPIUrl {
+		backend.urls, backend.index = config.SensuAPIUrl, 0
+	}
+	if backend.index >= len(urls) {
+		return ""
+	}
+	return urls[backend.index]
+}
+
+// failover switches from the given backend to the next one, returning the
+// backend to retry with: the next backend, or the current one if another
+// request already failed over. It returns false if there is no other backend
+// left to try.
+func failover(from string) (string, bool) {
+	backend.Lock()
+	defer backend.Unlock()
+	urls := sensuAPIUrls()
+	if backend.urls != config.SensuAPIUrl {
+		backend.urls, backend.index = config.SensuAPIUrl, 0
+	}
+	if backend.index >= len(urls) {
+		return "", false
+	}
+	if urls[backend.index] != from {
+		return urls[backend.index], true
+	} else if backend.index+1 >= len(urls) {
+		return "", false
+	}
+	backend.index++
+	return urls[backend.index], true
+}
+
+// backendOf returns the --sensu-api-url backend the request URL was built
+// for (the longest matching one, if backends share a host), or "" if there is
+// none.
+func backendOf(u *url.URL) string {
+	var match, matchBase string
+	for _, b := range sensuAPIUrls() {
+		base, err := apiURLOf(b, "")
+		if err == nil && strings.HasPrefix(u.String(), base) && len(base) > len(matchBase) {
+			match, matchBase = b, base
+		}
+	}
+	return match
+}
+
+// rebase points the request at the same API path under another backend.
+func rebase(req *http.Request, from string, to string) error {
+	base, err := apiURLOf(from, "")
+	if err != nil {
+		return err
+	}
+	u, err := apiURLOf(to, strings.TrimPrefix(req.URL.String(), base))
+	if err != nil {
+		return err
+	}
+	if req.URL, err = url.Parse(u); err != nil {
+		return err
+	}
+	req.Host = req.URL.Host
+	return nil
+}
+
+// connectFailed reports whether a request failed to connect to the backend
+// (e.g. the connection was refused, or its host could not be resolved), in
+// which case it was never received and can be sent to another backend.
+func connectFailed(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
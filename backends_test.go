@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// refusedURL returns the URL of a local address that refuses connections.
+func refusedURL(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return "http://" + addr
+}
+
+func TestExecutePlaybookBackendFailover(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	var logs, out bytes.Buffer
+	logger.SetOutput(&logs)
+	defer logger.SetOutput(os.Stderr)
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	down := refusedURL(t)
+	config.SensuAPIUrl = down + ", " + sensuAPI.URL
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "linux"
+	config.Output = outputJSON
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks")); n != 1 {
+		t.Errorf("expected the create request to fail over, got %d create requests", n)
+	}
+	if n := len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks/test-job/execute")); n != 1 {
+		t.Errorf("expected 1 execute request, got %d", n)
+	}
+	// the requests after the failover go to the second backend directly
+	if n := strings.Count(logs.String(), "failing over to "+sensuAPI.URL); n != 1 {
+		t.Errorf("expected 1 failover, got %d:\n%s", n, logs.String())
+	}
+	var results []RunResult
+	if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+		t.Fatalf("failed to decode output %q: %s", out.String(), err)
+	}
+	if len(results) != 1 || results[0].Backend != sensuAPI.URL {
+		t.Errorf("expected the result to record backend %s, got %+v", sensuAPI.URL, results)
+	}
+
+	// without another backend to fail over to, the request fails
+	config.SensuAPIUrl = down
+	status, err := executePlaybook(nil)
+	if status != sensu.CheckStateCritical || err == nil {
+		t.Errorf("expected critical without a reachable backend, got %d (%v)", status, err)
+	}
+}
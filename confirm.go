@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var (
+	// prompt is where the --confirm prompt is written.
+	prompt io.Writer = os.Stderr
+
+	// isTerminal reports whether stdin is an interactive terminal
+	// (overridable in tests).
+	isTerminal = func() bool {
+		fi, err := os.Stdin.Stat()
+		return err == nil && fi.Mode()&os.ModeCharDevice != 0
+	}
+)
+
+// needsConfirmation reports whether the command must be confirmed before it
+// is executed: always with --confirm, or when the command matches any of the
+// --dangerous-patterns.
+func needsConfirmation(command string) (bool, error) {
+	if config.Confirm {
+		return true, nil
+	}
+	for _, pattern := range splitLines(config.DangerousPatterns) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return false, fmt.Errorf("invalid --dangerous-patterns \"%s\": %w", pattern, err)
+		}
+		if re.MatchString(command) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// confirm prompts for confirmation of the runbook job execution until a yes
+// or no answer is given, defaulting to no.
+func confirm(r io.Reader, w io.Writer, command string, subscriptions []string) bool {
+	scanner := bufio.NewScanner(r)
+	for {
+		fmt.Fprintf(w, "Execute `%s` on subscriptions %s? [y/N] ", strings.TrimSpace(command), strings.Join(subscriptions, ","))
+		if !scanner.Scan() {
+			fmt.Fprintln(w)
+			return false
+		}
+		switch strings.ToLower(strings.TrimSpace(scanner.Text())) {
+		case "y", "yes":
+			return true
+		case "", "n", "no":
+			return false
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+func TestExecutePlaybookConfirm(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	defer func() { stdin = os.Stdin }()
+	var out bytes.Buffer
+	prompt = &out
+	defer func() { prompt = os.Stderr }()
+	terminal := true
+	defaultIsTerminal := isTerminal
+	isTerminal = func() bool { return terminal }
+	defer func() { isTerminal = defaultIsTerminal }()
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "rm -rf /var/cache/nginx"
+	config.Subscriptions = "web"
+	config.DangerousPatterns = "^shutdown\n^rm\\s+-rf\\b\n"
+
+	stdin = strings.NewReader("maybe\nn\n")
+	status, err := executePlaybook(nil)
+	if status != sensu.CheckStateWarning || err == nil {
+		t.Errorf("expected warning when the job is not confirmed, got %d (%v)", status, err)
+	}
+	expected := "Execute `rm -rf /var/cache/nginx` on subscriptions web? [y/N] "
+	if out.String() != expected+expected {
+		t.Errorf("expected the prompt to be repeated for an invalid answer, got %q", out.String())
+	}
+	if requests := sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks"); len(requests) != 0 {
+		t.Errorf("expected no create requests when the job is not confirmed, got %d", len(requests))
+	}
+
+	stdin = strings.NewReader("y\n")
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if requests := sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks/test-job/execute"); len(requests) != 1 {
+		t.Errorf("expected 1 execute request once confirmed, got %d", len(requests))
+	}
+
+	terminal = false
+	status, err = executePlaybook(nil)
+	if status != sensu.CheckStateWarning || err == nil || !strings.Contains(err.Error(), "--yes") {
+		t.Errorf("expected warning requiring --yes without a terminal, got %d (%v)", status, err)
+	}
+	config.Yes = true
+	if _, err := executePlaybook(nil); err != nil {
+		t.Errorf("expected --yes to skip the confirmation, got %s", err)
+	}
+
+	config.Yes = false
+	config.Command = "systemctl status nginx"
+	if _, err := executePlaybook(nil); err != nil {
+		t.Errorf("expected commands not matching --dangerous-patterns to run unconfirmed, got %s", err)
+	}
+}
+
+func TestDangerousPatternsParsing(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	patterns := "^shutdown\nrm .{0,3}-rf"
+	tests := []struct {
+		name string
+		env  []string
+		args []string
+	}{
+		{"flag", nil, []string{"--dangerous-patterns", patterns}},
+		{"env", []string{"SENSU_RUNBOOK_DANGEROUS_PATTERNS=" + patterns}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sensuAPI := newFakeSensu(t)
+			defer sensuAPI.Close()
+			args := append([]string{"--sensu-api-url", sensuAPI.URL, "--namespace", "default", "--id", "test-job", "--command", "rm  -rf /var/cache/nginx", "--subscriptions", "web"}, test.args...)
+			out, status := runMain(t, test.env, args...)
+			if status != sensu.CheckStateWarning || !strings.Contains(out, "must be confirmed") {
+				t.Errorf("expected the command matching \"rm .{0,3}-rf\" to require confirmation, got %d: %s", status, out)
+			}
+			if requests := sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks"); len(requests) != 0 {
+				t.Errorf("expected no create requests when the job is not confirmed, got %d", len(requests))
+			}
+		})
+	}
+}
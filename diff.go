@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// fieldDiff is a check field that differs between the existing and the
+// desired runbook job.
+type fieldDiff struct {
+	Field   string
+	Current string
+	Desired string
+}
+
+// diffFields returns the normalized check fields compared by --diff, in the
+// order they are printed.
+func diffFields(job *v2.CheckConfig) [][2]string {
+	var labels []string
+	for k, v := range job.Labels {
+		labels = append(labels, k+"="+v)
+	}
+	sort.Strings(labels)
+	return [][2]string{
+		{"command", job.Command},
+		{"subscriptions", strings.Join(job.Subscriptions, ",")},
+		{"runtime_assets", strings.Join(job.RuntimeAssets, ",")},
+		{"timeout", strconv.FormatUint(uint64(job.Timeout), 10)},
+		{"cron", job.Cron},
+		{"output_metric_format", job.OutputMetricFormat},
+		{"output_metric_handlers", strings.Join(job.OutputMetricHandlers, ",")},
+		{"labels", strings.Join(labels, ",")},
+	}
+}
+
+// diffJobs returns the fields that differ between the current and the desired
+// runbook job. A nil current job (i.e. one that does not exist yet) differs in
+// every non-empty field.
+func diffJobs(current *v2.CheckConfig, desired *v2.CheckConfig) []fieldDiff {
+	var currentFields = make([][2]string, len(diffFields(desired)))
+	if current != nil {
+		currentFields = diffFields(current)
+	}
+	var diffs []fieldDiff
+	for i, field := range diffFields(desired) {
+		if currentFields[i][1] != field[1] {
+			diffs = append(diffs, fieldDiff{Field: field[0], Current: currentFields[i][1], Desired: field[1]})
+		}
+	}
+	return diffs
+}
+
+// writeDiff prints the differences, with the current value of every field
+// prefixed by "-" and the desired value by "+"; empty values are printed as
+// "(none)".
+func writeDiff(w io.Writer, job *v2.CheckConfig, exists bool, diffs []fieldDiff) {
+	switch {
+	case !exists:
+		fmt.Fprintf(w, "runbook job %s/%s does not exist and would be registered:\n", job.Namespace, job.Name)
+	case len(diffs) == 0:
+		fmt.Fprintf(w, "runbook job %s/%s is unchanged\n", job.Namespace, job.Name)
+		return
+	default:
+		fmt.Fprintf(w, "runbook job %s/%s would change:\n", job.Namespace, job.Name)
+	}
+	for _, diff := range diffs {
+		fmt.Fprintf(w, "%s:\n", diff.Field)
+		if exists {
+			writeDiffValue(w, "-", diff.Current)
+		}
+		writeDiffValue(w, "+", diff.Desired)
+	}
+}
+
+// writeDiffValue prints every line of a (possibly multi-line) field value with
+// the given prefix.
+func writeDiffValue(w io.Writer, prefix string, value string) {
+	if len(value) == 0 {
+		value = "(none)"
+	}
+	for _, line := range strings.Split(strings.TrimRight(value, "\n"), "\n") {
+		fmt.Fprintf(w, "  %s %s\n", prefix, line)
+	}
+}
+
+// diffJob prints the differences between the existing runbook job check (if
+// any) and the desired one, without changing anything.
+func diffJob(ctx context.Context, httpClient *http.Client, job *v2.CheckConfig) (int, error) {
+	current, err := getJob(ctx, httpClient, job.Namespace, job.Name)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		current, err = nil, nil
+	}
+	if err != nil {
+		return sensu.CheckStateCritical, fmt.Errorf("ERROR: failed to get the existing runbook job: %w", unprefixed(err))
+	}
+	var w io.Writer = stdout
+	if config.Output != outputText {
+		var b strings.Builder
+		defer func() {
+			logger.Infof("%s", b.String())
+		}()
+		w = &b
+	}
+	writeDiff(w, job, current != nil, diffJobs(current, job))
+	return sensu.CheckStateOK, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+func TestDiffJobs(t *testing.T) {
+	current := &v2.CheckConfig{
+		ObjectMeta:    v2.ObjectMeta{Name: "test-job", Namespace: "default", Labels: map[string]string{"team": "ops"}},
+		Command:       "systemctl restart nginx",
+		Subscriptions: []string{"web"},
+		RuntimeAssets: []string{"nginx-tools"},
+		Timeout:       10,
+	}
+	desired := &v2.CheckConfig{
+		ObjectMeta:    v2.ObjectMeta{Name: "test-job", Namespace: "default", Labels: map[string]string{"team": "ops"}},
+		Command:       "systemctl reload nginx",
+		Subscriptions: []string{"web"},
+		Timeout:       30,
+	}
+	expected := []fieldDiff{
+		{Field: "command", Current: "systemctl restart nginx", Desired: "systemctl reload nginx"},
+		{Field: "runtime_assets", Current: "nginx-tools", Desired: ""},
+		{Field: "timeout", Current: "10", Desired: "30"},
+	}
+	if diffs := diffJobs(current, desired); !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("expected diffs %+v, got %+v", expected, diffs)
+	}
+	if diffs := diffJobs(desired, desired); len(diffs) != 0 {
+		t.Errorf("expected no diffs, got %+v", diffs)
+	}
+	if diffs := diffJobs(nil, desired); len(diffs) != 4 {
+		t.Errorf("expected every non-empty field to differ from a missing check, got %+v", diffs)
+	}
+}
+
+func TestExecutePlaybookDiff(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	var out bytes.Buffer
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/checks/test-job", http.StatusOK, v2.CheckConfig{
+		ObjectMeta:    v2.ObjectMeta{Name: "test-job", Namespace: "default"},
+		Command:       "systemctl restart nginx",
+		Subscriptions: []string{"none"},
+		Timeout:       10,
+	})
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "systemctl reload nginx"
+	config.Subscriptions = "web"
+	config.Labels = "team=ops"
+	config.Diff = true
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := "runbook job default/test-job would change:\n" +
+		"command:\n  - systemctl restart nginx\n  + systemctl reload nginx\n" +
+		"labels:\n  - (none)\n  + team=ops\n"
+	if !strings.HasPrefix(out.String(), expected) {
+		t.Errorf("expected output to start with %q, got %q", expected, out.String())
+	}
+	if n := len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks")); n != 0 {
+		t.Errorf("expected no create requests, got %d", n)
+	}
+	if n := len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks/test-job/execute")); n != 0 {
+		t.Errorf("expected no execute requests, got %d", n)
+	}
+
+	out.Reset()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/checks/test-job", http.StatusNotFound, map[string]string{"message": "not found"})
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.HasPrefix(out.String(), "runbook job default/test-job does not exist and would be registered:\n") {
+		t.Errorf("expected the check to be reported missing, got %q", out.String())
+	}
+}
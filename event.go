@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+// Annotations recording the context of the triggering event on the runbook
+// job check, so the results can be correlated with the triggering event.
+const (
+	eventNamespaceAnnotation = "sensu.io/plugins/sensu-runbook/event/namespace"
+	eventEntityAnnotation    = "sensu.io/plugins/sensu-runbook/event/entity"
+	eventCheckAnnotation     = "sensu.io/plugins/sensu-runbook/event/check"
+)
+
+var (
+	// stdin is where the triggering event is read from.
+	stdin io.Reader = os.Stdin
+
+	// triggeringEvent is the event that triggered the runbook automation,
+	// when sensu-runbook is used as a handler.
+	triggeringEvent *v2.Event
+)
+
+// readsEvent returns true if the configuration requires the triggering event.
+func readsEvent() bool {
+	return config.PropagateEventContext || config.TargetTriggeringEntity || config.TemplateCommand || config.InheritEventAssets || config.NamespaceFromEvent
+}
+
+// readEvent reads the triggering event from stdin. The event is only read
+// when required by the configuration, since sensu-runbook is more typically
+// run standalone (or as a sensuctl command) without an event.
+func readEvent(r io.Reader) (*v2.Event, error) {
+	var event v2.Event
+	if err := json.NewDecoder(r).Decode(&event); err != nil {
+		return nil, fmt.Errorf("failed to read the triggering event from stdin: %w", err)
+	}
+	if event.Entity == nil {
+		return nil, errors.New("the triggering event read from stdin has no entity")
+	}
+	return &event, nil
+}
+
+// eventNamespace returns the namespace of the entity of the given event, or
+// of its check if the entity has none.
+func eventNamespace(event *v2.Event) string {
+	if len(event.Entity.Namespace) > 0 {
+		return event.Entity.Namespace
+	} else if event.Check != nil {
+		return event.Check.Namespace
+	}
+	return ""
+}
+
+// eventAnnotations returns the annotations recording the context of the given
+// event.
+func eventAnnotations(event *v2.Event) map[string]string {
+	annotations := map[string]string{
+		eventNamespaceAnnotation: event.Entity.Namespace,
+		eventEntityAnnotation:    event.Entity.Name,
+	}
+	if event.Check != nil {
+		annotations[eventCheckAnnotation] = event.Check.Name
+	}
+	return annotations
+}
+
+// templateFuncs are the functions available to --template-command templates.
+var templateFuncs = template.FuncMap{
+	"shellescape": shellEscape,
+}
+
+// shellEscape quotes s as a single POSIX shell word.
+func shellEscape(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
+// renderCommand renders the command as a Go template, with the event as its
+// context. Referencing a field the event does not have is an error.
+//
+// Event fields are attacker-influenced (e.g. entity names and labels are set
+// by the agent), so values interpolated into a shell command should be piped
+// through shellescape.
+func renderCommand(command string, event *v2.Event) (string, error) {
+	tmpl, err := template.New("command").Funcs(templateFuncs).Option("missingkey=error").Parse(command)
+	if err != nil {
+		return "", fmt.Errorf("invalid --template-command template: %w", err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, event); err != nil {
+		return "", fmt.Errorf("failed to render --template-command template: %w", err)
+	}
+	return b.String(), nil
+}
+
+// renderCommands renders the command, or every --playbook step command, against
+// the event.
+func renderCommands(event *v2.Event) error {
+	var err error
+	if len(config.Command) > 0 {
+		if config.Command, err = renderCommand(config.Command, event); err != nil {
+			return err
+		}
+	}
+	if playbook != nil {
+		for i := range playbook.Steps {
+			if playbook.Steps[i].Command, err = renderCommand(playbook.Steps[i].Command, event); err != nil {
+				return fmt.Errorf("playbook step \"%s\": %w", playbook.Steps[i].Name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+const testEvent = `{
+  "entity": {"metadata": {"name": "web-1", "namespace": "default"}, "subscriptions": ["web", "entity:web-1"]},
+  "check": {"metadata": {"name": "check-nginx", "namespace": "default"}, "status": 2}
+}`
+
+func TestExecutePlaybookPropagateEventContext(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	stdin = strings.NewReader(testEvent)
+	defer func() { stdin = os.Stdin }()
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "systemctl restart nginx"
+	config.Subscriptions = "web"
+	config.PropagateEventContext = true
+
+	if _, err := checkArgs(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	requests := sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks")
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 create request, got %d", len(requests))
+	}
+	var job v2.CheckConfig
+	requests[0].decode(t, &job)
+	expected := map[string]string{
+		"request":                "sensu-runbook",
+		eventNamespaceAnnotation: "default",
+		eventEntityAnnotation:    "web-1",
+		eventCheckAnnotation:     "check-nginx",
+	}
+	for k, v := range expected {
+		if job.Annotations[k] != v {
+			t.Errorf("expected annotation %s=%q, got %q", k, v, job.Annotations[k])
+		}
+	}
+
+	stdin = strings.NewReader("not an event")
+	status, err := checkArgs(nil)
+	if status != sensu.CheckStateCritical || err == nil {
+		t.Errorf("expected critical status for an invalid event, got %d (%v)", status, err)
+	}
+}
+
+func TestExecutePlaybookTargetTriggeringEntity(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "web-1"}, Subscriptions: []string{"web"}},
+		{ObjectMeta: v2.ObjectMeta{Name: "web-2"}, Subscriptions: []string{"web"}},
+	})
+	stdin = strings.NewReader(testEvent)
+	defer func() { stdin = os.Stdin }()
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "systemctl restart nginx"
+	config.TargetTriggeringEntity = true
+
+	if _, err := checkArgs(nil); err != nil {
+		t.Fatalf("expected --subscriptions to be optional with --target-triggering-entity, got %s", err)
+	}
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	requests := sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks/test-job/execute")
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 execute request, got %d", len(requests))
+	}
+	var jobRequest JobRequest
+	requests[0].decode(t, &jobRequest)
+	expected := []string{"entity:web-1"}
+	if !reflect.DeepEqual(jobRequest.Subscriptions, expected) {
+		t.Errorf("expected execute subscriptions %v, got %v", expected, jobRequest.Subscriptions)
+	}
+
+	resetConfig()
+	config.SensuAPIUrl = sensuAPI.URL
+	config.Namespace = "default"
+	config.Command = "systemctl restart nginx"
+	config.Subscriptions = "web"
+	config.TargetTriggeringEntity = true
+	stdin = strings.NewReader(`{"check": {"metadata": {"name": "check-nginx"}}}`)
+	status, err := checkArgs(nil)
+	if status != sensu.CheckStateCritical || err == nil {
+		t.Errorf("expected critical status for an event without an entity, got %d (%v)", status, err)
+	}
+}
+
+func TestExecutePlaybookNamespaceFromEvent(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	stdin = strings.NewReader(`{
+  "entity": {"metadata": {"name": "web-1", "namespace": "ops"}},
+  "check": {"metadata": {"name": "check-nginx", "namespace": "ops"}}
+}`)
+	defer func() { stdin = os.Stdin }()
+	config.JobID = "test-job"
+	config.Command = "systemctl restart nginx"
+	config.Subscriptions = "web"
+	config.NamespaceFromEvent = true
+
+	if _, err := checkArgs(nil); err != nil {
+		t.Fatalf("expected --namespace to be optional with --namespace-from-event, got %s", err)
+	}
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/ops/checks")); n != 1 {
+		t.Errorf("expected 1 create request in the namespace of the event, got %d", n)
+	}
+	if n := len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/ops/checks/test-job/execute")); n != 1 {
+		t.Errorf("expected 1 execute request in the namespace of the event, got %d", n)
+	}
+
+	// the check namespace is used if the entity has none, and --namespace
+	// takes precedence over both
+	config.Namespace = ""
+	stdin = strings.NewReader(`{"entity": {"metadata": {"name": "web-1"}}, "check": {"metadata": {"name": "check-nginx", "namespace": "dev"}}}`)
+	if _, err := checkArgs(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if config.Namespace != "dev" {
+		t.Errorf("expected the namespace of the check, got %q", config.Namespace)
+	}
+	config.Namespace = "default"
+	stdin = strings.NewReader(`{"entity": {"metadata": {"name": "web-1", "namespace": "ops"}}}`)
+	if _, err := checkArgs(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if config.Namespace != "default" {
+		t.Errorf("expected --namespace to take precedence, got %q", config.Namespace)
+	}
+}
+
+func TestRenderCommand(t *testing.T) {
+	event, err := readEvent(strings.NewReader(testEvent))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	event.Entity.Labels = map[string]string{"service": "nginx; rm -rf /"}
+
+	testCases := []struct {
+		command  string
+		expected string
+	}{
+		{"systemctl restart {{ .Entity.Name }}", "systemctl restart web-1"},
+		{"echo {{ .Check.Name }} {{ .Check.Status }}", "echo check-nginx 2"},
+		{"systemctl restart {{ .Entity.Labels.service | shellescape }}", "systemctl restart 'nginx; rm -rf /'"},
+		{"echo {{ \"it's\" | shellescape }}", `echo 'it'"'"'s'`},
+	}
+	for _, tc := range testCases {
+		command, err := renderCommand(tc.command, event)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", tc.command, err)
+		} else if command != tc.expected {
+			t.Errorf("%q: expected %q, got %q", tc.command, tc.expected, command)
+		}
+	}
+
+	for _, command := range []string{"echo {{ .Entity.Nmae }}", "echo {{ .Entity.Labels.missing }}", "echo {{ .Entity.Name"} {
+		if _, err := renderCommand(command, event); err == nil {
+			t.Errorf("%q: expected error", command)
+		}
+	}
+}
+
+func TestCheckArgsTemplateCommand(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	defer func() { stdin = os.Stdin }()
+	config.SensuAPIUrl = "http://127.0.0.1:8080"
+	config.Namespace = "default"
+	config.Subscriptions = "web"
+	config.TemplateCommand = true
+
+	stdin = strings.NewReader(testEvent)
+	config.Command = "systemctl restart {{ .Entity.Name }}"
+	if _, err := checkArgs(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if expected := "systemctl restart web-1"; config.Command != expected {
+		t.Errorf("expected command %q, got %q", expected, config.Command)
+	}
+
+	stdin = strings.NewReader(testEvent)
+	config.Command = "systemctl restart {{ .Entity.Service }}"
+	status, err := checkArgs(nil)
+	if status != sensu.CheckStateWarning || err == nil || !strings.Contains(err.Error(), "Service") {
+		t.Errorf("expected warning naming the unknown field, got %d (%v)", status, err)
+	}
+}
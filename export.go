@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"gopkg.in/yaml.v3"
+)
+
+// resource is a runbook job check config as a sensuctl create resource,
+// wrapped with its type and API version, and with its metadata lifted out of
+// the spec.
+type resource struct {
+	Type       string                 `json:"type" yaml:"type"`
+	APIVersion string                 `json:"api_version" yaml:"api_version"`
+	Metadata   map[string]interface{} `json:"metadata" yaml:"metadata"`
+	Spec       map[string]interface{} `json:"spec" yaml:"spec"`
+}
+
+// wrapCheck returns the check config as a sensuctl create resource. The spec
+// uses the field names of the Sensu API (i.e. the JSON field names), also
+// when the resource is written as YAML.
+func wrapCheck(job *v2.CheckConfig) (resource, error) {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return resource{}, err
+	}
+	var spec map[string]interface{}
+	if err := json.Unmarshal(b, &spec); err != nil {
+		return resource{}, err
+	}
+	metadata, _ := spec["metadata"].(map[string]interface{})
+	delete(spec, "metadata")
+	return resource{
+		Type:       "CheckConfig",
+		APIVersion: "core/v2",
+		Metadata:   metadata,
+		Spec:       spec,
+	}, nil
+}
+
+// exportJobs writes the runbook job checks of the runs to the --export file,
+// as sensuctl create resources: JSON if the path ends in .json, and YAML
+// documents otherwise. No API requests are made.
+func exportJobs(path string, runs []jobRun) (int, error) {
+	jobID, command := config.JobID, config.Command
+	defer func() {
+		config.JobID, config.Command = jobID, command
+	}()
+	var resources []resource
+	for _, run := range runs {
+		config.JobID, config.Command = run.JobID, run.Command
+		job, err := generateCheckConfig(run.Namespace)
+		if err != nil {
+			return sensu.CheckStateWarning, fmt.Errorf("ERROR: %w", err)
+		}
+		r, err := wrapCheck(&job)
+		if err != nil {
+			return sensu.CheckStateCritical, fmt.Errorf("ERROR: failed to write --export: %w", err)
+		}
+		resources = append(resources, r)
+	}
+	var b bytes.Buffer
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		encoder := json.NewEncoder(&b)
+		encoder.SetIndent("", "  ")
+		for _, r := range resources {
+			if err := encoder.Encode(r); err != nil {
+				return sensu.CheckStateCritical, fmt.Errorf("ERROR: failed to write --export: %w", err)
+			}
+		}
+	} else {
+		encoder := yaml.NewEncoder(&b)
+		encoder.SetIndent(2)
+		for _, r := range resources {
+			if err := encoder.Encode(r); err != nil {
+				return sensu.CheckStateCritical, fmt.Errorf("ERROR: failed to write --export: %w", err)
+			}
+		}
+		if err := encoder.Close(); err != nil {
+			return sensu.CheckStateCritical, fmt.Errorf("ERROR: failed to write --export: %w", err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return sensu.CheckStateCritical, fmt.Errorf("ERROR: failed to write --export: %w", err)
+	}
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		return sensu.CheckStateCritical, fmt.Errorf("ERROR: failed to write --export: %w", err)
+	}
+	if config.Output == outputText {
+		fmt.Fprintf(stdout, "exported %d runbook job(s) to %s\n", len(resources), path)
+	} else {
+		logger.Infof("exported %d runbook job(s) to %s\n", len(resources), path)
+	}
+	return sensu.CheckStateOK, nil
+}
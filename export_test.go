@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestExecutePlaybookExport(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	dir, err := ioutil.TempDir("", "sensu-runbook-export")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "systemctl restart nginx"
+	config.Subscriptions = "web"
+	config.Export = filepath.Join(dir, "checks", "test-job.yaml")
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	sensuAPI.mu.Lock()
+	if len(sensuAPI.requests) != 0 {
+		t.Errorf("expected no API requests with --export, got %d", len(sensuAPI.requests))
+	}
+	sensuAPI.mu.Unlock()
+	b, err := ioutil.ReadFile(config.Export)
+	if err != nil {
+		t.Fatalf("expected the --export file to be written: %s", err)
+	}
+	var document struct {
+		Type       string                 `yaml:"type"`
+		APIVersion string                 `yaml:"api_version"`
+		Metadata   map[string]interface{} `yaml:"metadata"`
+		Spec       map[string]interface{} `yaml:"spec"`
+	}
+	if err := yaml.Unmarshal(b, &document); err != nil {
+		t.Fatalf("failed to decode the exported resource %q: %s", b, err)
+	}
+	if document.Type != "CheckConfig" || document.APIVersion != "core/v2" {
+		t.Errorf("expected a CheckConfig core/v2 resource, got type %q and api_version %q", document.Type, document.APIVersion)
+	}
+	if document.Metadata["name"] != "test-job" || document.Metadata["namespace"] != "default" {
+		t.Errorf("expected the metadata of the runbook job, got %v", document.Metadata)
+	}
+	if document.Spec["command"] != "systemctl restart nginx" {
+		t.Errorf("expected the command in the spec, got %v", document.Spec)
+	}
+	if _, ok := document.Spec["metadata"]; ok {
+		t.Errorf("expected the metadata to be lifted out of the spec, got %v", document.Spec)
+	}
+
+	// one JSON resource per namespace
+	config.Namespaces = "dev,prod"
+	config.Export = filepath.Join(dir, "test-job.json")
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	f, err := os.Open(config.Export)
+	if err != nil {
+		t.Fatalf("expected the --export file to be written: %s", err)
+	}
+	defer f.Close()
+	var namespaces []string
+	decoder := json.NewDecoder(f)
+	for {
+		var r resource
+		if err := decoder.Decode(&r); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("failed to decode the exported resources: %s", err)
+		}
+		if r.Type != "CheckConfig" || r.APIVersion != "core/v2" {
+			t.Errorf("expected a CheckConfig core/v2 resource, got type %q and api_version %q", r.Type, r.APIVersion)
+		}
+		namespaces = append(namespaces, r.Metadata["namespace"].(string))
+	}
+	if strings.Join(namespaces, ",") != "dev,prod" {
+		t.Errorf("expected resources in namespaces dev,prod, got %v", namespaces)
+	}
+}
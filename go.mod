@@ -3,7 +3,10 @@ module github.com/calebhailey/sensu-runbook
 go 1.13
 
 require (
-	github.com/google/uuid v1.1.1
-	github.com/sensu/sensu-plugin-sdk v0.14.1
+	github.com/modern-go/reflect2 v1.0.2 // indirect
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/sensu/sensu-go/api/core/v2 v2.3.0
+	github.com/sensu/sensu-plugin-sdk v0.14.1
+	golang.org/x/net v0.0.0-20190620200207-3b0461eec859
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// availableSubscriptions returns the (sorted) subscriptions of the entities in
+// the given namespace, without the implicit "entity:<name>" subscriptions.
+func availableSubscriptions(ctx context.Context, httpClient *http.Client, namespace string) ([]string, error) {
+	entities, err := listEntities(ctx, httpClient, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list entities: %w", err)
+	}
+	var seen = make(map[string]bool)
+	var subscriptions []string
+	for _, entity := range entities {
+		for _, subscription := range entity.Subscriptions {
+			if strings.HasPrefix(subscription, "entity:") || seen[subscription] {
+				continue
+			}
+			seen[subscription] = true
+			subscriptions = append(subscriptions, subscription)
+		}
+	}
+	sort.Strings(subscriptions)
+	return subscriptions, nil
+}
+
+// selectSubscriptions prompts for the --interactive selection of the
+// subscriptions to target, by their (1-based) numbers separated by commas or
+// spaces, until a valid selection is made.
+func selectSubscriptions(r io.Reader, w io.Writer, subscriptions []string) ([]string, error) {
+	for i, subscription := range subscriptions {
+		fmt.Fprintf(w, "%3d) %s\n", i+1, subscription)
+	}
+	scanner := bufio.NewScanner(r)
+	for {
+		fmt.Fprintf(w, "Select the subscriptions to target (e.g. 1,3): ")
+		if !scanner.Scan() {
+			fmt.Fprintln(w)
+			return nil, errors.New("no subscriptions were selected")
+		}
+		selected, err := parseSelection(scanner.Text(), subscriptions)
+		if err != nil {
+			fmt.Fprintf(w, "%s\n", err)
+			continue
+		}
+		return selected, nil
+	}
+}
+
+// parseSelection returns the subscriptions selected by their numbers, in the
+// order selected and without duplicates.
+func parseSelection(selection string, subscriptions []string) ([]string, error) {
+	var selected []string
+	var seen = make(map[int]bool)
+	for _, field := range strings.FieldsFunc(selection, func(r rune) bool { return r == ',' || r == ' ' }) {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 1 || n > len(subscriptions) {
+			return nil, fmt.Errorf("invalid selection \"%s\" (must be a number between 1 and %d)", field, len(subscriptions))
+		}
+		if !seen[n] {
+			seen[n] = true
+			selected = append(selected, subscriptions[n-1])
+		}
+	}
+	if len(selected) == 0 {
+		return nil, errors.New("select at least one subscription")
+	}
+	return selected, nil
+}
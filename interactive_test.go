@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+func TestExecutePlaybookInteractive(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	defer func() { stdin = os.Stdin }()
+	var out bytes.Buffer
+	prompt = &out
+	defer func() { prompt = os.Stderr }()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "web-1"}, Subscriptions: []string{"web", "linux", "entity:web-1"}},
+		{ObjectMeta: v2.ObjectMeta{Name: "db-1"}, Subscriptions: []string{"db", "linux", "entity:db-1"}},
+	})
+	config.Namespace = "default"
+	config.Command = "hostname"
+	config.Interactive = true
+
+	// an invalid selection is prompted for again
+	stdin = strings.NewReader("4\n1,3\n")
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := "  1) db\n  2) linux\n  3) web\n" +
+		"Select the subscriptions to target (e.g. 1,3): invalid selection \"4\" (must be a number between 1 and 3)\n" +
+		"Select the subscriptions to target (e.g. 1,3): "
+	if out.String() != expected {
+		t.Errorf("expected prompt %q, got %q", expected, out.String())
+	}
+	creates := sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks")
+	if len(creates) != 1 {
+		t.Fatalf("expected 1 create request, got %d", len(creates))
+	}
+	var job v2.CheckConfig
+	if err := json.Unmarshal(creates[0].Body, &job); err != nil {
+		t.Fatalf("failed to decode the runbook job: %s", err)
+	}
+	if !strings.HasPrefix(job.Name, "runbook-") {
+		t.Errorf("expected a job ID derived from the selection, got %q", job.Name)
+	}
+	executes := sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks/"+job.Name+"/execute")
+	if len(executes) != 1 {
+		t.Fatalf("expected 1 execute request, got %d", len(executes))
+	}
+	var request JobRequest
+	if err := json.Unmarshal(executes[0].Body, &request); err != nil {
+		t.Fatalf("failed to decode the execute request: %s", err)
+	}
+	if expected := []string{"db", "web"}; !reflect.DeepEqual(request.Subscriptions, expected) {
+		t.Errorf("expected execution on %v, got %v", expected, request.Subscriptions)
+	}
+	if len(config.Subscriptions) > 0 || len(config.JobID) > 0 {
+		t.Errorf("expected the selection to be forgotten, got --subscriptions %q and --id %q", config.Subscriptions, config.JobID)
+	}
+
+	stdin = strings.NewReader("")
+	status, err := executePlaybook(nil)
+	if status != sensu.CheckStateWarning || err == nil {
+		t.Errorf("expected warning without a selection, got %d (%v)", status, err)
+	}
+}
+
+func TestCheckArgsInteractive(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	terminal := true
+	defaultIsTerminal := isTerminal
+	isTerminal = func() bool { return terminal }
+	defer func() { isTerminal = defaultIsTerminal }()
+	config.SensuAPIUrl = "http://127.0.0.1:8080"
+	config.Namespace = "default"
+	config.Command = "hostname"
+	config.Interactive = true
+
+	if _, err := checkArgs(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(config.JobID) > 0 {
+		t.Errorf("expected the job ID to be derived after the selection, got %q", config.JobID)
+	}
+
+	terminal = false
+	status, err := checkArgs(nil)
+	if status != sensu.CheckStateWarning || err == nil || !strings.Contains(err.Error(), "--subscriptions") {
+		t.Errorf("expected warning directing to --subscriptions without a terminal, got %d (%v)", status, err)
+	}
+
+	terminal = true
+	config.Subscriptions = "web"
+	if status, _ := checkArgs(nil); status != sensu.CheckStateWarning {
+		t.Errorf("expected warning with --subscriptions, got %d", status)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+// exitInterrupted is the exit status when sensu-runbook is interrupted by
+// SIGINT or SIGTERM, following the shell convention (128 + SIGINT).
+const exitInterrupted = 130
+
+var (
+	// notifySignals and stopSignals are signal.Notify and signal.Stop, and
+	// can be replaced to simulate signals in tests.
+	notifySignals = signal.Notify
+	stopSignals   = signal.Stop
+)
+
+// withInterrupts returns a copy of the context that is canceled on SIGINT or
+// SIGTERM, and a function reporting whether it was. The returned cancel
+// function stops listening for the signals.
+func withInterrupts(ctx context.Context) (context.Context, func() bool, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	var interrupted int32
+	signals := make(chan os.Signal, 1)
+	notifySignals(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			logger.Warnf("received %s, stopping\n", sig)
+			atomic.StoreInt32(&interrupted, 1)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	isInterrupted := func() bool {
+		return atomic.LoadInt32(&interrupted) == 1
+	}
+	stop := func() {
+		stopSignals(signals)
+		cancel()
+	}
+	return ctx, isInterrupted, stop
+}
+
+// cleanupJob deletes the runbook job check, logging any failure. The check is
+// deleted even when the operation context is done (e.g. when interrupted), as
+// it would otherwise be orphaned.
+func cleanupJob(httpClient *http.Client, job *v2.CheckConfig) {
+	if err := deleteJob(context.Background(), httpClient, job); err != nil {
+		logger.Errorf("failed to delete runbook job \"%s\": %s\n", job.Name, err)
+	}
+}
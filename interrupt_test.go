@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"testing"
+
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+func TestExecutePlaybookInterruptCleanup(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	config.PollInterval = "10ms"
+	var signals chan<- os.Signal
+	notifySignals = func(c chan<- os.Signal, sig ...os.Signal) {
+		signals = c
+	}
+	defer func() { notifySignals = signal.Notify }()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "web-1"}, Subscriptions: []string{"web"}},
+	})
+	// the entity never reports, and the user interrupts the wait
+	sensuAPI.handle("GET", "/api/core/v2/namespaces/default/events", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case signals <- os.Interrupt:
+		default:
+		}
+		writeJSON(t, w, []v2.Event{})
+	})
+	sensuAPI.on("DELETE", "/api/core/v2/namespaces/default/checks/test-job", http.StatusNoContent, nil)
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "web"
+	config.Wait = true
+	config.Cleanup = true
+
+	status, err := executePlaybook(nil)
+	if status != exitInterrupted {
+		t.Errorf("expected exit status %d, got %d", exitInterrupted, status)
+	}
+	if err == nil || !strings.HasPrefix(err.Error(), "ERROR: interrupted: ") {
+		t.Errorf("expected interrupted error, got %v", err)
+	}
+	if n := len(sensuAPI.requestsTo("DELETE", "/api/core/v2/namespaces/default/checks/test-job")); n != 1 {
+		t.Errorf("expected the runbook job to be deleted once, got %d delete requests", n)
+	}
+}
+
+func TestExecutePlaybookCleanup(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	sensuAPI.on("DELETE", "/api/core/v2/namespaces/default/checks/test-job", http.StatusNoContent, nil)
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "web"
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := len(sensuAPI.requestsTo("DELETE", "/api/core/v2/namespaces/default/checks/test-job")); n != 0 {
+		t.Errorf("expected no delete requests without --cleanup, got %d", n)
+	}
+
+	config.Cleanup = true
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := len(sensuAPI.requestsTo("DELETE", "/api/core/v2/namespaces/default/checks/test-job")); n != 1 {
+		t.Errorf("expected the runbook job to be deleted after it ran, got %d delete requests", n)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log"
+	"os"
+)
+
+// leveledLogger writes informational, warning, and error messages to stderr,
+// leaving stdout for the runbook results. Informational messages are
+// suppressed by --quiet, and debug messages are only logged with --verbose.
+type leveledLogger struct {
+	*log.Logger
+}
+
+var logger = &leveledLogger{
+	Logger: log.New(os.Stderr, "", log.LstdFlags),
+}
+
+// Infof logs an informational message unless --quiet is set.
+func (l *leveledLogger) Infof(format string, v ...interface{}) {
+	if config.Quiet {
+		return
+	}
+	l.Printf(format, v...)
+}
+
+// Debugf logs a debug message if --verbose is set.
+func (l *leveledLogger) Debugf(format string, v ...interface{}) {
+	if !config.Verbose {
+		return
+	}
+	l.Printf("DEBUG: "+format, v...)
+}
+
+// Warnf logs a warning message.
+func (l *leveledLogger) Warnf(format string, v ...interface{}) {
+	l.Printf("WARNING: "+format, v...)
+}
+
+// Errorf logs an error message.
+func (l *leveledLogger) Errorf(format string, v ...interface{}) {
+	l.Printf(format, v...)
+}
@@ -2,36 +2,137 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"math"
 	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
 
-	"github.com/google/uuid"
-	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"github.com/robfig/cron/v3"
 	v2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
 )
 
 // Config represents the check plugin config.
 type Config struct {
 	sensu.PluginConfig
-	Namespace          string
-	JobID              string
-	Command            string
-	Subscriptions      string
-	Timeout            string
-	RuntimeAssets      string
-	SensuAPIUrl        string
-	SensuAccessToken   string
-	SensuTrustedCaFile string
-	Labels             string
-	Annotations        string
+	Namespace              string
+	NamespaceFromEvent     bool
+	Namespaces             string
+	NamespaceSelector      string
+	FailFast               bool
+	JobID                  string
+	SanitizeID             bool
+	IDStrategy             string
+	Command                string
+	ExecuteOnly            bool
+	Idempotent             bool
+	Patch                  bool
+	CommandFile            string
+	CommandPrefix          string
+	Playbook               string
+	Subscriptions          string
+	SubscriptionsFile      string
+	ExecuteSubscriptions   string
+	ExcludeLabels          []string
+	StrictExclude          bool
+	RoundRobin             bool
+	CheckStdin             bool
+	Entities               string
+	EntityQuery            string
+	Interactive            bool
+	EntityClass            string
+	Timeout                string
+	AssetDownloadGrace     int
+	MaxParallelExecs       int
+	RuntimeAssets          string
+	Assets                 []string
+	InheritEventAssets     bool
+	AssetURLRewrites       []string
+	ValidateAssets         bool
+	SensuAPIUrl            string
+	SensuAccessToken       string
+	SensuAccessTokenFile   string
+	TokenCommand           string
+	TokenCommandTimeout    string
+	SensuTrustedCaFile     string
+	SensuTrustedCaPEM      string
+	DialSOCKS5             string
+	UserAgent              string
+	Headers                string
+	Retries                int
+	MaxResponseBytes       int
+	APIPrefix              string
+	Labels                 string
+	Annotations            string
+	Reason                 string
+	RequireReason          bool
+	PropagateEventContext  bool
+	TargetTriggeringEntity bool
+	TemplateCommand        bool
+	Output                 string
+	ResultFile             string
+	Export                 string
+	OutputMetricFormat     string
+	OutputMetricHandlers   string
+	Handlers               string
+	ProxyEntityAttributes  string
+	Splay                  bool
+	SplayCoverage          int
+	Secrets                []string
+	Silence                bool
+	SilenceExpire          string
+	SilenceCheck           string
+	PreviewTargets         bool
+	DryRun                 bool
+	Diff                   bool
+	ServerValidate         bool
+	Wait                   bool
+	Follow                 bool
+	PollInterval           string
+	WaitTimeout            string
+	MaxOutputBytes         int
+	RawEvents              bool
+	Repeat                 int
+	RepeatDelay            string
+	UntilSuccess           bool
+	UnpublishAfter         bool
+	Cron                   string
+	LowFlapThreshold       int
+	HighFlapThreshold      int
+	Cleanup                bool
+	RollbackOnFailure      bool
+	Deadline               string
+	Preflight              bool
+	CreateNamespace        bool
+	Confirm                bool
+	DangerousPatterns      string
+	Yes                    bool
+	Quiet                  bool
+	Verbose                bool
+	ExitOK                 int
+	ExitWarning            int
+	ExitCritical           int
 }
 
 // JobRequest represents a job request.
@@ -42,7 +143,50 @@ type JobRequest struct {
 	Annotations   map[string]string `json:"annotations"`
 }
 
+// maxJobIDLength is the maximum length of a runbook job (check) name.
+const maxJobIDLength = 255
+
+// Supported --id-strategy values.
+const (
+	idStrategyFixed       = "fixed"
+	idStrategyRandom      = "random"
+	idStrategyContentHash = "content-hash"
+)
+
+var (
+	// jobIDRegex matches valid Sensu check names.
+	jobIDRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+	// invalidJobIDChars matches characters not allowed in Sensu check names.
+	invalidJobIDChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+)
+
+// outputMetricFormats are the --output-metric-format values supported by the
+// Sensu agent.
+var outputMetricFormats = []string{"nagios_perfdata", "graphite_plaintext", "influxdb_line", "opentsdb_line", "prometheus_text"}
+
+// pageLimit is the number of resources requested per page from list endpoints.
+const pageLimit = 100
+
+// Supported --output modes.
+const (
+	outputText    = "text"
+	outputMetrics = "metrics"
+	outputJSON    = "json"
+	outputYAML    = "yaml"
+	outputJSONL   = "jsonl"
+)
+
 var (
+	// version is the plugin version, set at build time.
+	version = "dev"
+
+	// stdout is where runbook results are written.
+	stdout io.Writer = os.Stdout
+
+	// readFile reads files from disk (overridable in tests).
+	readFile = ioutil.ReadFile
+
 	config = Config{
 		PluginConfig: sensu.PluginConfig{
 			Name:     "sensu-runbook",
@@ -57,20 +201,91 @@ var (
 			Env:       "SENSU_RUNBOOK_JOB_ID",
 			Argument:  "id",
 			Shorthand: "i",
-			Default:   uuid.New().String(),
-			Secret:    true,
-			Usage:     "The ID or name to use for the job (i.e. defaults to a random UUIDv4)",
+			Default:   "",
+			Usage:     "The ID or name to use for the job (defaults to a name derived from the command and subscriptions, so re-runs reuse the same check)",
 			Value:     &config.JobID,
 		},
+		{
+			Path:      "sanitize-id",
+			Env:       "SENSU_RUNBOOK_SANITIZE_ID",
+			Argument:  "sanitize-id",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Replace characters that are not allowed in Sensu check names in the job ID (and truncate it to the maximum length)",
+			Value:     &config.SanitizeID,
+		},
+		{
+			Path:      "id-strategy",
+			Env:       "SENSU_RUNBOOK_ID_STRATEGY",
+			Argument:  "id-strategy",
+			Shorthand: "",
+			Default:   idStrategyFixed,
+			Usage:     "How the job ID is chosen (one of: fixed, random, content-hash); fixed uses the --id as-is, random appends a random suffix to it for every run, and content-hash appends a hash of the command, targets, and assets, so that distinct target sets get distinct (stable) checks",
+			Value:     &config.IDStrategy,
+		},
 		{
 			Path:      "command",
 			Env:       "SENSU_RUNBOOK_COMMAND",
 			Argument:  "command",
 			Shorthand: "c",
 			Default:   "",
-			Usage:     "The command that should be executed by the Sensu Go agent(s)",
+			Usage:     "The command that should be executed by the Sensu Go agent(s) (use - to read it from stdin)",
 			Value:     &config.Command,
 		},
+		{
+			Path:      "command-file",
+			Env:       "SENSU_RUNBOOK_COMMAND_FILE",
+			Argument:  "command-file",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Path to a file containing the command (or multi-line script) that should be executed by the Sensu Go agent(s)",
+			Value:     &config.CommandFile,
+		},
+		{
+			Path:      "command-prefix",
+			Env:       "SENSU_RUNBOOK_COMMAND_PREFIX",
+			Argument:  "command-prefix",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Prefix wrapping the command(s) of the runbook job (e.g. \"timeout 300\"), separated from the command by a space",
+			Value:     &config.CommandPrefix,
+		},
+		{
+			Path:      "playbook",
+			Env:       "SENSU_RUNBOOK_PLAYBOOK",
+			Argument:  "playbook",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Path to a JSON playbook file of steps (each with a name, command, and optional namespace) to run in order, instead of --command",
+			Value:     &config.Playbook,
+		},
+		{
+			Path:      "execute-only",
+			Env:       "SENSU_RUNBOOK_EXECUTE_ONLY",
+			Argument:  "execute-only",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Execute an existing (pre-registered) check named --id instead of registering the job",
+			Value:     &config.ExecuteOnly,
+		},
+		{
+			Path:      "idempotent",
+			Env:       "SENSU_RUNBOOK_IDEMPOTENT",
+			Argument:  "idempotent",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Update the runbook check if it already exists with a different command, assets, or timeout (unchanged checks are left as-is)",
+			Value:     &config.Idempotent,
+		},
+		{
+			Path:      "patch",
+			Env:       "SENSU_RUNBOOK_PATCH",
+			Argument:  "patch",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Like --idempotent, but only send the changed fields of an existing runbook check (as a JSON merge patch)",
+			Value:     &config.Patch,
+		},
 		{
 			Path:      "timeout",
 			Env:       "SENSU_RUNBOOK_TIMEOUT",
@@ -78,7 +293,25 @@ var (
 			Shorthand: "t",
 			Default:   "10",
 			Usage:     "Command execution timeout, in seconds",
-			Value:     &config.Command,
+			Value:     &config.Timeout,
+		},
+		{
+			Path:      "asset-download-grace",
+			Env:       "SENSU_RUNBOOK_ASSET_DOWNLOAD_GRACE",
+			Argument:  "asset-download-grace",
+			Shorthand: "",
+			Default:   0,
+			Usage:     "Seconds added to the --timeout of a runbook job with runtime assets, so that downloading them doesn't count against the command execution timeout",
+			Value:     &config.AssetDownloadGrace,
+		},
+		{
+			Path:      "max-parallel-execs",
+			Env:       "SENSU_RUNBOOK_MAX_PARALLEL_EXECS",
+			Argument:  "max-parallel-execs",
+			Shorthand: "",
+			Default:   0,
+			Usage:     "Request the execution separately for every subscription, with at most this many requests in flight (defaults to a single request for all subscriptions)",
+			Value:     &config.MaxParallelExecs,
 		},
 		{
 			Path:      "runtime-assets",
@@ -89,6 +322,42 @@ var (
 			Usage:     "Comma-separated list of assets to distribute with the command(s)",
 			Value:     &config.RuntimeAssets,
 		},
+		{
+			Path:      "asset",
+			Env:       "SENSU_RUNBOOK_ASSET",
+			Argument:  "asset",
+			Shorthand: "",
+			Default:   []string{},
+			Usage:     "Asset to distribute with the command(s), optionally pinned to a version (name[:version]); may be repeated",
+			Value:     &config.Assets,
+		},
+		{
+			Path:      "inherit-event-assets",
+			Env:       "SENSU_RUNBOOK_INHERIT_EVENT_ASSETS",
+			Argument:  "inherit-event-assets",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Read the triggering event from stdin, and also distribute the runtime assets of its check with the command(s)",
+			Value:     &config.InheritEventAssets,
+		},
+		{
+			Path:      "asset-url-rewrite",
+			Env:       "SENSU_RUNBOOK_ASSET_URL_REWRITES",
+			Argument:  "asset-url-rewrite",
+			Shorthand: "",
+			Default:   []string{},
+			Usage:     "Rewrite the host of full URL asset references, as old-host=new-host (e.g. to use an internal mirror); may be repeated",
+			Value:     &config.AssetURLRewrites,
+		},
+		{
+			Path:      "validate-assets",
+			Env:       "SENSU_RUNBOOK_VALIDATE_ASSETS",
+			Argument:  "validate-assets",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Verify that all assets exist before registering the job (assets pinned to a version are always verified)",
+			Value:     &config.ValidateAssets,
+		},
 		{
 			Path:      "subscriptions",
 			Env:       "SENSU_RUNBOOK_SUBSCRIPTIONS",
@@ -98,15 +367,141 @@ var (
 			Usage:     "Comma-separated list of subscriptions to execute the command(s) on",
 			Value:     &config.Subscriptions,
 		},
+		{
+			Path:      "subscriptions-file",
+			Env:       "SENSU_RUNBOOK_SUBSCRIPTIONS_FILE",
+			Argument:  "subscriptions-file",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Path to a file containing newline- or comma-separated subscriptions to execute the command(s) on (merged with --subscriptions; lines starting with # are ignored)",
+			Value:     &config.SubscriptionsFile,
+		},
+		{
+			Path:      "execute-subscriptions",
+			Env:       "SENSU_RUNBOOK_EXECUTE_SUBSCRIPTIONS",
+			Argument:  "execute-subscriptions",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Comma-separated list of subscriptions to execute the command(s) on, when --subscriptions should only configure the check",
+			Value:     &config.ExecuteSubscriptions,
+		},
+		{
+			Path:      "exclude-label",
+			Env:       "SENSU_RUNBOOK_EXCLUDE_LABELS",
+			Argument:  "exclude-label",
+			Shorthand: "",
+			Default:   []string{},
+			Usage:     "Warn when targeted entities carry this key=value label (e.g. maintenance=true), as they cannot be excluded from the execution; may be repeated",
+			Value:     &config.ExcludeLabels,
+		},
+		{
+			Path:      "strict-exclude",
+			Env:       "SENSU_RUNBOOK_STRICT_EXCLUDE",
+			Argument:  "strict-exclude",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Refuse to execute the runbook job when targeted entities carry an --exclude-label label",
+			Value:     &config.StrictExclude,
+		},
+		{
+			Path:      "round-robin",
+			Env:       "SENSU_RUNBOOK_ROUND_ROBIN",
+			Argument:  "round-robin",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Execute the command on a single agent per subscription (round-robin) instead of all of them",
+			Value:     &config.RoundRobin,
+		},
+		{
+			Path:      "check-stdin",
+			Env:       "SENSU_RUNBOOK_CHECK_STDIN",
+			Argument:  "check-stdin",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Have the agents write the runbook job's event (as JSON) to the stdin of the command(s), which must read it to the end",
+			Value:     &config.CheckStdin,
+		},
+		{
+			Path:      "entities",
+			Env:       "SENSU_RUNBOOK_ENTITIES",
+			Argument:  "entities",
+			Shorthand: "e",
+			Default:   "",
+			Usage:     "Comma-separated list of entity names to execute the command(s) on",
+			Value:     &config.Entities,
+		},
+		{
+			Path:      "entity-query",
+			Env:       "SENSU_RUNBOOK_ENTITY_QUERY",
+			Argument:  "entity-query",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Sensu API field selector matching the entities to execute the command(s) on (e.g. \"entity.entity_class == agent\"), resolved in every namespace",
+			Value:     &config.EntityQuery,
+		},
+		{
+			Path:      "interactive",
+			Env:       "SENSU_RUNBOOK_INTERACTIVE",
+			Argument:  "interactive",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Prompt for the subscriptions to execute the command(s) on, selecting them from the subscriptions of the entities in --namespace (requires a terminal)",
+			Value:     &config.Interactive,
+		},
+		{
+			Path:      "entity-class",
+			Env:       "SENSU_RUNBOOK_ENTITY_CLASS",
+			Argument:  "entity-class",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Only preview and --wait for the targeted entities of this class (agent or proxy), warning if the targets only match the other class",
+			Value:     &config.EntityClass,
+		},
 		{
 			Path:      "namespace",
 			Env:       "SENSU_NAMESPACE", // provided by the sensuctl command plugin execution environment
 			Argument:  "namespace",
 			Shorthand: "n",
 			Default:   "",
-			Usage:     "Sensu Namespace to perform the runbook automation (defaults to $SENSU_NAMESPACE)",
+			Usage:     "Sensu Namespace to perform the runbook automation (defaults to $SENSU_NAMESPACE, the namespace of the triggering event with --namespace-from-event, or the \"namespace\" claim of a JWT access token)",
 			Value:     &config.Namespace,
 		},
+		{
+			Path:      "namespace-from-event",
+			Env:       "SENSU_RUNBOOK_NAMESPACE_FROM_EVENT",
+			Argument:  "namespace-from-event",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Read the triggering event from stdin, and perform the runbook automation in the namespace of its entity (or check) when --namespace is not set",
+			Value:     &config.NamespaceFromEvent,
+		},
+		{
+			Path:      "namespaces",
+			Env:       "SENSU_RUNBOOK_NAMESPACES",
+			Argument:  "namespaces",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Comma-separated list of Sensu Namespaces to perform the runbook automation in (overrides --namespace)",
+			Value:     &config.Namespaces,
+		},
+		{
+			Path:      "namespace-selector",
+			Env:       "SENSU_RUNBOOK_NAMESPACE_SELECTOR",
+			Argument:  "namespace-selector",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Comma-separated label selector (e.g. \"env=prod,tier!=db\") of the Sensu Namespaces to perform the runbook automation in (overrides --namespace)",
+			Value:     &config.NamespaceSelector,
+		},
+		{
+			Path:      "fail-fast",
+			Env:       "SENSU_RUNBOOK_FAIL_FAST",
+			Argument:  "fail-fast",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Stop at the first namespace that fails instead of continuing with the remaining namespaces",
+			Value:     &config.FailFast,
+		},
 		{
 			Path:      "labels",
 			Argument:  "labels",
@@ -123,18 +518,65 @@ var (
 			Usage:     "Comma-separated key=value annotations to append to the check config and resulting event(s)",
 			Value:     &config.Annotations,
 		},
+		{
+			Path:      "reason",
+			Env:       "SENSU_RUNBOOK_REASON",
+			Argument:  "reason",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Why the runbook job is run (e.g. a ticket ID), recorded as the " + reasonAnnotation + " annotation of the check config and in the results",
+			Value:     &config.Reason,
+		},
+		{
+			Path:      "require-reason",
+			Env:       "SENSU_RUNBOOK_REQUIRE_REASON",
+			Argument:  "require-reason",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Refuse to run the runbook job without a --reason",
+			Value:     &config.RequireReason,
+		},
+		{
+			Path:      "propagate-event-context",
+			Env:       "SENSU_RUNBOOK_PROPAGATE_EVENT_CONTEXT",
+			Argument:  "propagate-event-context",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Read the triggering event from stdin, and annotate the check config with its entity and check names",
+			Value:     &config.PropagateEventContext,
+		},
+		{
+			Path:      "target-triggering-entity",
+			Env:       "SENSU_RUNBOOK_TARGET_TRIGGERING_ENTITY",
+			Argument:  "target-triggering-entity",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Read the triggering event from stdin, and execute the command(s) on its entity (overrides --subscriptions and --entities)",
+			Value:     &config.TargetTriggeringEntity,
+		},
+		{
+			Path:      "template-command",
+			Env:       "SENSU_RUNBOOK_TEMPLATE_COMMAND",
+			Argument:  "template-command",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Read the triggering event from stdin, and render the command as a Go template against it (e.g. \"systemctl restart {{ .Check.Name | shellescape }}\")",
+			Value:     &config.TemplateCommand,
+		},
 		{
 			Path:      "sensu-api-url",
 			Env:       "SENSU_API_URL", // provided by the sensuctl command plugin execution environment
 			Argument:  "sensu-api-url",
 			Shorthand: "",
 			Default:   "",
-			Usage:     "Sensu API URL (defaults to $SENSU_API_URL)",
+			Usage:     "Sensu API URL (defaults to $SENSU_API_URL), or a comma-separated list of backend URLs to fail over to in order when a backend cannot be connected to",
 			Value:     &config.SensuAPIUrl,
 		},
 		{
+			// $SENSU_ACCESS_TOKEN (provided by the sensuctl command plugin
+			// execution environment) is resolved in checkArgs, as it has a
+			// lower precedence than --sensu-access-token-file
 			Path:      "sensu-access-token",
-			Env:       "SENSU_ACCESS_TOKEN", // provided by the sensuctl command plugin execution environment
 			Argument:  "sensu-access-token",
 			Shorthand: "",
 			Default:   "",
@@ -142,6 +584,33 @@ var (
 			Usage:     "Sensu API Access Token (defaults to $SENSU_ACCESS_TOKEN)",
 			Value:     &config.SensuAccessToken,
 		},
+		{
+			Path:      "sensu-access-token-file",
+			Env:       "SENSU_ACCESS_TOKEN_FILE",
+			Argument:  "sensu-access-token-file",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Path to a file containing the Sensu API Access Token (used when --sensu-access-token is not set)",
+			Value:     &config.SensuAccessTokenFile,
+		},
+		{
+			Path:      "token-command",
+			Env:       "SENSU_RUNBOOK_TOKEN_COMMAND",
+			Argument:  "token-command",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Shell command that prints the Sensu API Access Token to stdout (used when no other access token is provided)",
+			Value:     &config.TokenCommand,
+		},
+		{
+			Path:      "token-command-timeout",
+			Env:       "SENSU_RUNBOOK_TOKEN_COMMAND_TIMEOUT",
+			Argument:  "token-command-timeout",
+			Shorthand: "",
+			Default:   "30s",
+			Usage:     "How long to wait for --token-command to complete (e.g. 10s, 1m)",
+			Value:     &config.TokenCommandTimeout,
+		},
 		{
 			Path:      "sensu-trusted-ca-file",
 			Env:       "SENSU_TRUSTED_CA_FILE", // provided by the sensuctl command plugin execution environment
@@ -151,220 +620,2653 @@ var (
 			Usage:     "Sensu API Trusted Certificate Authority File (defaults to $SENSU_TRUSTED_CA_FILE)",
 			Value:     &config.SensuTrustedCaFile,
 		},
-	}
-)
-
-func main() {
-	plugin := sensu.NewGoCheck(&config.PluginConfig, options, checkArgs, executePlaybook, false)
-	plugin.Execute()
-}
-
-func checkArgs(event *v2.Event) (int, error) {
-	if len(config.SensuAPIUrl) == 0 {
-		return sensu.CheckStateCritical, errors.New("--sensu-api-url flag or $SENSU_API_URL environment variable must be set")
-	} else if len(config.Namespace) == 0 {
-		return sensu.CheckStateCritical, errors.New("--namespace flag or $SENSU_NAMESPACE environment variable must be set")
-	} else if len(config.Command) == 0 {
-		return sensu.CheckStateWarning, errors.New("--command flag or $SENSU_RUNBOOK_COMMAND environment variable must be set")
-	} else if len(config.Subscriptions) == 0 {
-		return sensu.CheckStateWarning, errors.New("--subscriptions flag or $SENSU_RUNBOOK_SUBSCRIPTIONS environment variable must be set")
-	}
-	return sensu.CheckStateOK, nil
-}
-
-func executePlaybook(event *v2.Event) (int, error) {
-	// TODO: use the sensu-plugin-sdk HTTP client (reference: https://github.com/sensu/sensu-ec2-handler/blob/master/main.go#L12)
-	job, err := generateCheckConfig()
-	if err != nil {
-		return sensu.CheckStateCritical, fmt.Errorf("ERROR: %s", err)
-	}
-	log.Printf("registering runbook job ID %s/%s with --command %s\n", job.Namespace, job.Name, config.Command)
-	err = createJob(&job)
-	if err != nil {
-		return sensu.CheckStateCritical, err
-	}
-	err = executeJob(&job)
-	if err != nil {
-		return sensu.CheckStateCritical, nil
-	}
-	return sensu.CheckStateOK, nil
-}
-
-func generateCheckConfig() (v2.CheckConfig, error) {
-	// Build CheckConfig object
-	var timeout, _ = strconv.Atoi(config.Timeout)
-	var labels = parseKvStringSlice(strings.Split(config.Labels,","))
-	var annotations = parseKvStringSlice(strings.Split(config.Annotations,","))
-	var job = v2.CheckConfig{
-		ObjectMeta: v2.ObjectMeta{
-			Name:        config.JobID,
-			Namespace:   config.Namespace,
-			Labels:      labels,
-			Annotations: annotations,
+		{
+			Path:      "sensu-trusted-ca-pem",
+			Env:       "SENSU_TRUSTED_CA",
+			Argument:  "sensu-trusted-ca-pem",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Sensu API Trusted Certificate Authority, as a PEM string (defaults to $SENSU_TRUSTED_CA; ignored with --sensu-trusted-ca-file)",
+			Value:     &config.SensuTrustedCaPEM,
 		},
-		Command:       config.Command,
-		Publish:       false,
-		Subscriptions: []string{"none"},
-		Interval:      10,
-		Timeout:       uint32(timeout),
-	}
-	if len(config.RuntimeAssets) > 0 {
-		job.RuntimeAssets = strings.Split(config.RuntimeAssets, ",")
-	}
-	return job, nil
-}
-
-// Parse a slice of strings containing key=value pairs
-func parseKvStringSlice(s []string) map[string]string {
-	var m = make(map[string]string)
-	for _, kvString := range s {
-		i := strings.Split(kvString, "=")
-		if len(i) > 1 {
-			k := strings.TrimSpace(i[0])
-			v := strings.TrimSpace(i[1])
-			if len(strings.Split(k, " ")) > 1 {
-				fmt.Printf("WARNING: invalid key name: \"%s\" (did you mean to use --add-all?)\n", k)
-			} else {
-				m[k] = v
-			}
-		}
-	}
-	return m
-}
-
-// LoadCACerts loads the system cert pool.
-func LoadCACerts(path string) (*x509.CertPool, error) {
-	rootCAs, err := x509.SystemCertPool()
-	if err != nil {
-		log.Printf("ERROR: failed to load system cert pool: %s", err)
-		rootCAs = x509.NewCertPool()
-	}
-	if rootCAs == nil {
-		rootCAs = x509.NewCertPool()
-	}
-	if path != "" {
-		certs, err := ioutil.ReadFile(path)
-		if err != nil {
-			log.Fatalf("ERROR: failed to read CA file (%s): %s", path, err)
-			return nil, err
-		}
-		rootCAs.AppendCertsFromPEM(certs)
-	}
-	return rootCAs, nil
-}
-
-func initHTTPClient() *http.Client {
-	certs, err := LoadCACerts(config.SensuTrustedCaFile)
-	if err != nil {
-		log.Fatalf("ERROR: %s\n", err)
-	}
-	tlsConfig := &tls.Config{
-		RootCAs: certs,
-	}
-	tr := &http.Transport{
-		TLSClientConfig: tlsConfig,
-	}
-	client := &http.Client{
-		Transport: tr,
-	}
-	return client
-}
-
-func createJob(job *v2.CheckConfig) error {
-	postBody, err := json.Marshal(job)
-	if err != nil {
-		log.Fatal("ERROR: ", err)
-	}
-	body := bytes.NewReader(postBody)
-	req, err := http.NewRequest(
-		"POST",
-		fmt.Sprintf("%s/api/core/v2/namespaces/%s/checks",
-			config.SensuAPIUrl,
-			config.Namespace,
-		),
-		body,
-	)
-	if err != nil {
-		log.Fatalf("ERROR: %s\n", err)
-	}
-	var httpClient *http.Client = initHTTPClient()
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", config.SensuAccessToken))
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		log.Fatalf("ERROR: %s\n", err)
-		return err
-	} else if resp.StatusCode == 404 {
-		log.Fatalf("ERROR: %v %s (%s)\n", resp.StatusCode, http.StatusText(resp.StatusCode), req.URL)
-		return err
-	} else if resp.StatusCode == 409 {
-		log.Printf("runbook job \"%s\" already exists (%v: %s)\n", job.Name, resp.StatusCode, http.StatusText(resp.StatusCode))
-		return err
-	} else if resp.StatusCode >= 300 {
-		log.Fatalf("ERROR: %v %s", resp.StatusCode, http.StatusText(resp.StatusCode))
-		return err
-	} else if resp.StatusCode == 201 {
-		log.Printf("registered runbook Job \"%s\"", job.Name)
-		return nil
-	} else {
-		defer resp.Body.Close()
-		b, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Fatalf("ERROR: %s\n", err)
-		} else {
-			fmt.Printf("%s\n", string(b))
-		}
-	}
-
-	return err
-}
-
-func executeJob(job *v2.CheckConfig) error {
-	var jobRequest = JobRequest{
-		Check:         job.Name,
-		Subscriptions: strings.Split(config.Subscriptions, ","),
+		{
+			Path:      "dial-socks5",
+			Env:       "SENSU_RUNBOOK_DIAL_SOCKS5",
+			Argument:  "dial-socks5",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Connect to the Sensu API through this SOCKS5 proxy, as host:port or socks5://[user:password@]host:port (e.g. an ssh -D tunnel through a bastion host)",
+			Value:     &config.DialSOCKS5,
+		},
+		{
+			Path:      "user-agent",
+			Env:       "SENSU_RUNBOOK_USER_AGENT",
+			Argument:  "user-agent",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "User-Agent header to identify the Sensu API requests with (defaults to sensu-runbook/<version>)",
+			Value:     &config.UserAgent,
+		},
+		{
+			Path:      "header",
+			Env:       "SENSU_RUNBOOK_HEADERS",
+			Argument:  "header",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Additional HTTP headers to send with every Sensu API request, one \"Name: Value\" per line (e.g. \"X-Tenant-Id: ops\")",
+			Value:     &config.Headers,
+		},
+		{
+			Path:      "retries",
+			Env:       "SENSU_RUNBOOK_RETRIES",
+			Argument:  "retries",
+			Shorthand: "",
+			Default:   0,
+			Usage:     "Retry Sensu API requests that fail transiently (network errors, 429, 502, 503, and 504 responses) up to this many times, with a jittered exponential backoff (or the delay of a Retry-After response header)",
+			Value:     &config.Retries,
+		},
+		{
+			Path:      "max-response-bytes",
+			Env:       "SENSU_RUNBOOK_MAX_RESPONSE_BYTES",
+			Argument:  "max-response-bytes",
+			Shorthand: "",
+			Default:   32 << 20,
+			Usage:     "Fail when a Sensu API response body exceeds this many bytes (0 for no limit)",
+			Value:     &config.MaxResponseBytes,
+		},
+		{
+			Path:      "api-prefix",
+			Env:       "SENSU_RUNBOOK_API_PREFIX",
+			Argument:  "api-prefix",
+			Shorthand: "",
+			Default:   "/api/core/v2",
+			Usage:     "Path prefix of the Sensu API group and version to use",
+			Value:     &config.APIPrefix,
+		},
+		{
+			Path:      "output",
+			Env:       "SENSU_RUNBOOK_OUTPUT",
+			Argument:  "output",
+			Shorthand: "o",
+			Default:   outputText,
+			Usage:     "Output format (one of: text, metrics, json, yaml, jsonl); jsonl prints a JSON object per line for every entity's result as soon as it is reported (requires --wait)",
+			Value:     &config.Output,
+		},
+		{
+			Path:      "result-file",
+			Env:       "SENSU_RUNBOOK_RESULT_FILE",
+			Argument:  "result-file",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Also write the results as JSON (as printed by --output json) to this file, creating its parent directories",
+			Value:     &config.ResultFile,
+		},
+		{
+			Path:      "export",
+			Env:       "SENSU_RUNBOOK_EXPORT",
+			Argument:  "export",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Write the runbook job check(s) to this file as sensuctl create resources (JSON if it ends in .json, YAML otherwise) instead of registering and executing them",
+			Value:     &config.Export,
+		},
+		{
+			Path:      "output-metric-format",
+			Env:       "SENSU_RUNBOOK_OUTPUT_METRIC_FORMAT",
+			Argument:  "output-metric-format",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Metric format of the command output, for metric extraction by the Sensu agent (one of: nagios_perfdata, graphite_plaintext, influxdb_line, opentsdb_line, prometheus_text)",
+			Value:     &config.OutputMetricFormat,
+		},
+		{
+			Path:      "output-metric-handlers",
+			Env:       "SENSU_RUNBOOK_OUTPUT_METRIC_HANDLERS",
+			Argument:  "output-metric-handlers",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Comma-separated list of handlers for the metrics extracted from the command output",
+			Value:     &config.OutputMetricHandlers,
+		},
+		{
+			Path:      "handlers",
+			Env:       "SENSU_RUNBOOK_HANDLERS",
+			Argument:  "handlers",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Comma-separated list of handlers for the runbook job events (e.g. to send the command output to a logging handler)",
+			Value:     &config.Handlers,
+		},
+		{
+			Path:      "silence",
+			Env:       "SENSU_RUNBOOK_SILENCE",
+			Argument:  "silence",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Silence the targeted subscriptions while the runbook job executes",
+			Value:     &config.Silence,
+		},
+		{
+			Path:      "silence-expire",
+			Env:       "SENSU_RUNBOOK_SILENCE_EXPIRE",
+			Argument:  "silence-expire",
+			Shorthand: "",
+			Default:   "10m",
+			Usage:     "How long the --silence silencing entries last (e.g. 30s, 10m, 1h)",
+			Value:     &config.SilenceExpire,
+		},
+		{
+			Path:      "silence-check",
+			Env:       "SENSU_RUNBOOK_SILENCE_CHECK",
+			Argument:  "silence-check",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Name of the check to silence with --silence (defaults to all checks)",
+			Value:     &config.SilenceCheck,
+		},
+		{
+			Path:      "preview-targets",
+			Env:       "SENSU_RUNBOOK_PREVIEW_TARGETS",
+			Argument:  "preview-targets",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Print the entities that match the targeted subscriptions before executing the runbook job",
+			Value:     &config.PreviewTargets,
+		},
+		{
+			Path:      "dry-run",
+			Env:       "SENSU_RUNBOOK_DRY_RUN",
+			Argument:  "dry-run",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Validate the runbook job (and print the --preview-targets) without registering or executing it",
+			Value:     &config.DryRun,
+		},
+		{
+			Path:      "server-validate",
+			Env:       "SENSU_RUNBOOK_SERVER_VALIDATE",
+			Argument:  "server-validate",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Validate the runbook job against the Sensu API (namespace access, existing check, --entities, and assets) without registering or executing it; the check itself is only validated locally",
+			Value:     &config.ServerValidate,
+		},
+		{
+			Path:      "diff",
+			Env:       "SENSU_RUNBOOK_DIFF",
+			Argument:  "diff",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Print the differences between the existing runbook job check (if any) and the desired one, without registering or executing anything",
+			Value:     &config.Diff,
+		},
+		{
+			Path:      "wait",
+			Env:       "SENSU_RUNBOOK_WAIT",
+			Argument:  "wait",
+			Shorthand: "w",
+			Default:   false,
+			Usage:     "Wait for every targeted entity to report the runbook job result, and print the results",
+			Value:     &config.Wait,
+		},
+		{
+			Path:      "follow",
+			Env:       "SENSU_RUNBOOK_FOLLOW",
+			Argument:  "follow",
+			Shorthand: "f",
+			Default:   false,
+			Usage:     "Print every entity's runbook job result as soon as it is reported, until every targeted entity has reported, --wait-timeout, or sensu-runbook is interrupted (implies --wait)",
+			Value:     &config.Follow,
+		},
+		{
+			Path:      "poll-interval",
+			Env:       "SENSU_RUNBOOK_POLL_INTERVAL",
+			Argument:  "poll-interval",
+			Shorthand: "",
+			Default:   "2s",
+			Usage:     "How often to poll the events API for results with --wait or --follow (at least 500ms)",
+			Value:     &config.PollInterval,
+		},
+		{
+			Path:      "wait-timeout",
+			Env:       "SENSU_RUNBOOK_WAIT_TIMEOUT",
+			Argument:  "wait-timeout",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "How long to wait for the results with --wait or --follow (e.g. 5m; defaults to the runbook job timeout plus 1m)",
+			Value:     &config.WaitTimeout,
+		},
+		{
+			Path:      "max-output-bytes",
+			Env:       "SENSU_RUNBOOK_MAX_OUTPUT_BYTES",
+			Argument:  "max-output-bytes",
+			Shorthand: "",
+			Default:   4096,
+			Usage:     "Truncate the output of every entity reported with --wait to this many bytes (0 for no limit)",
+			Value:     &config.MaxOutputBytes,
+		},
+		{
+			Path:      "raw-events",
+			Env:       "SENSU_RUNBOOK_RAW_EVENTS",
+			Argument:  "raw-events",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Include the full, unmodified events reported with --wait in the --output json results",
+			Value:     &config.RawEvents,
+		},
+		{
+			Path:      "repeat",
+			Env:       "SENSU_RUNBOOK_REPEAT",
+			Argument:  "repeat",
+			Shorthand: "",
+			Default:   1,
+			Usage:     "Execute the runbook job this many times (e.g. to verify that a service stays up)",
+			Value:     &config.Repeat,
+		},
+		{
+			Path:      "repeat-delay",
+			Env:       "SENSU_RUNBOOK_REPEAT_DELAY",
+			Argument:  "repeat-delay",
+			Shorthand: "",
+			Default:   "10s",
+			Usage:     "Delay between --repeat executions (e.g. 10s, 1m)",
+			Value:     &config.RepeatDelay,
+		},
+		{
+			Path:      "until-success",
+			Env:       "SENSU_RUNBOOK_UNTIL_SUCCESS",
+			Argument:  "until-success",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Stop repeating once every entity reports success (requires --wait)",
+			Value:     &config.UntilSuccess,
+		},
+		{
+			Path:      "unpublish-after",
+			Env:       "SENSU_RUNBOOK_UNPUBLISH_AFTER",
+			Argument:  "unpublish-after",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Unpublish (unschedule) the runbook check after it is executed (and --wait completes), keeping it for history",
+			Value:     &config.UnpublishAfter,
+		},
+		{
+			Path:      "cron",
+			Env:       "SENSU_RUNBOOK_CRON",
+			Argument:  "cron",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Publish (schedule) the runbook check on its targets with this cron schedule (e.g. \"0 3 * * *\"), in addition to executing it now",
+			Value:     &config.Cron,
+		},
+		{
+			Path:      "low-flap-threshold",
+			Env:       "SENSU_RUNBOOK_LOW_FLAP_THRESHOLD",
+			Argument:  "low-flap-threshold",
+			Shorthand: "",
+			Default:   0,
+			Usage:     "Flap detection low threshold (percent) of the runbook check published with --cron (defaults to no flap detection)",
+			Value:     &config.LowFlapThreshold,
+		},
+		{
+			Path:      "high-flap-threshold",
+			Env:       "SENSU_RUNBOOK_HIGH_FLAP_THRESHOLD",
+			Argument:  "high-flap-threshold",
+			Shorthand: "",
+			Default:   0,
+			Usage:     "Flap detection high threshold (percent) of the runbook check published with --cron (defaults to no flap detection)",
+			Value:     &config.HighFlapThreshold,
+		},
+		{
+			Path:      "cleanup",
+			Env:       "SENSU_RUNBOOK_CLEANUP",
+			Argument:  "cleanup",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Delete the runbook check once it has run (and --wait completes), even when sensu-runbook is interrupted",
+			Value:     &config.Cleanup,
+		},
+		{
+			Path:      "rollback-on-failure",
+			Env:       "SENSU_RUNBOOK_ROLLBACK_ON_FAILURE",
+			Argument:  "rollback-on-failure",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Delete the runbook check registered by this invocation if it cannot be executed (a pre-existing check is kept)",
+			Value:     &config.RollbackOnFailure,
+		},
+		{
+			Path:      "deadline",
+			Env:       "SENSU_RUNBOOK_DEADLINE",
+			Argument:  "deadline",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Overall time limit for the runbook automation, including --wait (e.g. 30s, 5m; defaults to no limit)",
+			Value:     &config.Deadline,
+		},
+		{
+			Path:      "preflight",
+			Env:       "SENSU_RUNBOOK_PREFLIGHT",
+			Argument:  "preflight",
+			Shorthand: "",
+			Default:   true,
+			Usage:     "Verify that the Sensu API is reachable and accepts the access token before doing anything (use --preflight=false to skip)",
+			Value:     &config.Preflight,
+		},
+		{
+			Path:      "create-namespace",
+			Env:       "SENSU_RUNBOOK_CREATE_NAMESPACE",
+			Argument:  "create-namespace",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Create the namespace if it does not exist yet (requires permission to create namespaces)",
+			Value:     &config.CreateNamespace,
+		},
+		{
+			Path:      "confirm",
+			Env:       "SENSU_RUNBOOK_CONFIRM",
+			Argument:  "confirm",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Prompt for confirmation before executing the command(s)",
+			Value:     &config.Confirm,
+		},
+		{
+			Path:      "dangerous-patterns",
+			Env:       "SENSU_RUNBOOK_DANGEROUS_PATTERNS",
+			Argument:  "dangerous-patterns",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Regular expressions matching commands that must be confirmed before they are executed (as with --confirm), one per line",
+			Value:     &config.DangerousPatterns,
+		},
+		{
+			Path:      "proxy-entity-attributes",
+			Env:       "SENSU_RUNBOOK_PROXY_ENTITY_ATTRIBUTES",
+			Argument:  "proxy-entity-attributes",
+			Shorthand: "",
+			Default:   "",
+			Usage:     "Entity attribute expressions selecting the proxy entities to run the command for, one per line (e.g. \"entity.labels.region == 'us-east'\")",
+			Value:     &config.ProxyEntityAttributes,
+		},
+		{
+			Path:      "splay",
+			Env:       "SENSU_RUNBOOK_SPLAY",
+			Argument:  "splay",
+			Shorthand: "",
+			Default:   false,
+			Usage:     "Splay the execution for the --proxy-entity-attributes proxy entities over --splay-coverage percent of the --timeout",
+			Value:     &config.Splay,
+		},
+		{
+			Path:      "splay-coverage",
+			Env:       "SENSU_RUNBOOK_SPLAY_COVERAGE",
+			Argument:  "splay-coverage",
+			Shorthand: "",
+			Default:   90,
+			Usage:     "Percentage (1-100) of the --timeout to splay the proxy entity executions over with --splay",
+			Value:     &config.SplayCoverage,
+		},
+		{
+			Path:      "secret",
+			Env:       "SENSU_RUNBOOK_SECRETS",
+			Argument:  "secret",
+			Shorthand: "",
+			Default:   []string{},
+			Usage:     "Sensu secret to expose to the command as an environment variable, as NAME=secret-name (e.g. DB_PASSWORD=postgres-password); may be repeated",
+			Value:     &config.Secrets,
+		},
+		{
+			Path:      "yes",
+			Env:       "SENSU_RUNBOOK_YES",
+			Argument:  "yes",
+			Shorthand: "y",
+			Default:   false,
+			Usage:     "Execute the command(s) without prompting for confirmation (required to confirm when stdin is not a terminal)",
+			Value:     &config.Yes,
+		},
+		{
+			Path:      "quiet",
+			Env:       "SENSU_RUNBOOK_QUIET",
+			Argument:  "quiet",
+			Shorthand: "q",
+			Default:   false,
+			Usage:     "Suppress informational logging (errors and results are still printed)",
+			Value:     &config.Quiet,
+		},
+		{
+			Path:      "verbose",
+			Env:       "SENSU_RUNBOOK_VERBOSE",
+			Argument:  "verbose",
+			Shorthand: "v",
+			Default:   false,
+			Usage:     "Log every Sensu API request and response, including their bodies, to stderr (the access token is redacted)",
+			Value:     &config.Verbose,
+		},
+		{
+			Path:      "exit-ok",
+			Env:       "SENSU_RUNBOOK_EXIT_OK",
+			Argument:  "exit-ok",
+			Shorthand: "",
+			Default:   sensu.CheckStateOK,
+			Usage:     "Exit status for the OK state",
+			Value:     &config.ExitOK,
+		},
+		{
+			Path:      "exit-warning",
+			Env:       "SENSU_RUNBOOK_EXIT_WARNING",
+			Argument:  "exit-warning",
+			Shorthand: "",
+			Default:   sensu.CheckStateWarning,
+			Usage:     "Exit status for the WARNING state",
+			Value:     &config.ExitWarning,
+		},
+		{
+			Path:      "exit-critical",
+			Env:       "SENSU_RUNBOOK_EXIT_CRITICAL",
+			Argument:  "exit-critical",
+			Shorthand: "",
+			Default:   sensu.CheckStateCritical,
+			Usage:     "Exit status for the CRITICAL state",
+			Value:     &config.ExitCritical,
+		},
+	}
+)
+
+func main() {
+	plugin := sensu.NewGoCheck(&config.PluginConfig, options, withExitStatus(checkArgs), withExitStatus(executePlaybook), false)
+	plugin.Execute()
+}
+
+// invalidExitStatus returns the first exit status option outside of 0-255,
+// if any.
+func invalidExitStatus() (string, bool) {
+	for _, option := range []struct {
+		name   string
+		status int
+	}{
+		{"--exit-ok", config.ExitOK},
+		{"--exit-warning", config.ExitWarning},
+		{"--exit-critical", config.ExitCritical},
+	} {
+		if option.status < 0 || option.status > 255 {
+			return fmt.Sprintf("%s %d", option.name, option.status), true
+		}
+	}
+	return "", false
+}
+
+// withExitStatus maps the check state returned by the plugin function to the
+// --exit-ok, --exit-warning, or --exit-critical exit status. Other states
+// (e.g. an interrupt) are returned as-is.
+func withExitStatus(f func(*v2.Event) (int, error)) func(*v2.Event) (int, error) {
+	return func(event *v2.Event) (int, error) {
+		state, err := f(event)
+		return exitStatus(state), err
+	}
+}
+
+// exitStatus returns the exit status for the check state. Invalid exit
+// statuses (rejected by checkArgs) are ignored.
+func exitStatus(state int) int {
+	var status = state
+	switch state {
+	case sensu.CheckStateOK:
+		status = config.ExitOK
+	case sensu.CheckStateWarning:
+		status = config.ExitWarning
+	case sensu.CheckStateCritical:
+		status = config.ExitCritical
+	}
+	if status < 0 || status > 255 {
+		return state
+	}
+	return status
+}
+
+// checkArgs validates the configuration, and reads the inputs it refers to.
+// Failures use a consistent check state policy:
+//
+//   - CRITICAL: the runbook automation cannot proceed at all, because required
+//     configuration is missing (the Sensu API URL, namespace, access token,
+//     command, or targets) or a referenced file or command cannot be read.
+//   - WARNING: the configuration is present but invalid, and can be corrected
+//     by the user (malformed values, or conflicting flags).
+func checkArgs(event *v2.Event) (int, error) {
+	if config.SanitizeID {
+		config.JobID = sanitizeJobID(config.JobID)
+	}
+	if len(config.CommandFile) > 0 {
+		if len(config.Command) > 0 {
+			return sensu.CheckStateWarning, errors.New("only one of --command or --command-file may be set")
+		}
+		command, err := readFile(config.CommandFile)
+		if err != nil {
+			return sensu.CheckStateCritical, fmt.Errorf("failed to read --command-file: %w", err)
+		}
+		config.Command = string(command)
+	} else if config.Command == "-" {
+		if readsEvent() {
+			return sensu.CheckStateWarning, errors.New("--command - cannot be used with --propagate-event-context, --target-triggering-entity, or --template-command (both read stdin)")
+		}
+		command, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			return sensu.CheckStateCritical, fmt.Errorf("failed to read --command from stdin: %w", err)
+		}
+		if len(strings.TrimSpace(string(command))) == 0 {
+			return sensu.CheckStateWarning, errors.New("--command - read an empty command from stdin")
+		}
+		config.Command = string(command)
+	}
+	if len(config.Playbook) > 0 {
+		if len(config.Command) > 0 {
+			return sensu.CheckStateWarning, errors.New("only one of --command or --playbook may be set")
+		}
+		b, err := readFile(config.Playbook)
+		if err != nil {
+			return sensu.CheckStateCritical, fmt.Errorf("failed to read --playbook: %w", err)
+		}
+		if playbook, err = parsePlaybook(b); err != nil {
+			return sensu.CheckStateWarning, err
+		}
+	}
+	if len(config.TokenCommand) > 0 {
+		if _, err := time.ParseDuration(config.TokenCommandTimeout); err != nil {
+			return sensu.CheckStateWarning, fmt.Errorf("invalid --token-command-timeout \"%s\": %w", config.TokenCommandTimeout, err)
+		}
+	}
+	if readsEvent() {
+		var err error
+		if triggeringEvent, err = readEvent(stdin); err != nil {
+			return sensu.CheckStateCritical, err
+		}
+	}
+	if config.TemplateCommand {
+		if err := renderCommands(triggeringEvent); err != nil {
+			return sensu.CheckStateWarning, err
+		}
+	}
+	if len(config.SubscriptionsFile) > 0 {
+		b, err := readFile(config.SubscriptionsFile)
+		if err != nil {
+			return sensu.CheckStateCritical, fmt.Errorf("failed to read --subscriptions-file: %w", err)
+		}
+		subscriptions := mergeSubscriptions(strings.Split(config.Subscriptions, ","), parseSubscriptionsFile(string(b)))
+		config.Subscriptions = strings.Join(subscriptions, ",")
+	}
+	// pasted lists often carry whitespace, duplicates, or trailing commas
+	config.Subscriptions = normalizeSubscriptions(config.Subscriptions)
+	config.ExecuteSubscriptions = normalizeSubscriptions(config.ExecuteSubscriptions)
+	config.Entities = normalizeSubscriptions(config.Entities)
+	if config.TargetTriggeringEntity {
+		if len(config.Subscriptions) > 0 || len(config.Entities) > 0 {
+			logger.Warnf("--subscriptions and --entities are ignored with --target-triggering-entity\n")
+		}
+		config.Subscriptions = ""
+		config.Entities = triggeringEvent.Entity.Name
+	}
+	if err := resolveAccessToken(); err != nil {
+		return sensu.CheckStateCritical, err
+	}
+	if config.NamespaceFromEvent && len(config.Namespace) == 0 && len(config.Namespaces) == 0 && len(config.NamespaceSelector) == 0 {
+		if namespace := eventNamespace(triggeringEvent); len(namespace) > 0 {
+			logger.Infof("using namespace \"%s\" of the triggering event\n", namespace)
+			config.Namespace = namespace
+		}
+	}
+	if len(config.Namespace) == 0 && len(config.Namespaces) == 0 && len(config.NamespaceSelector) == 0 {
+		if namespace := tokenNamespace(config.SensuAccessToken); len(namespace) > 0 {
+			logger.Infof("using namespace \"%s\" of the access token\n", namespace)
+			config.Namespace = namespace
+		}
+	}
+	if len(config.SensuAPIUrl) == 0 {
+		return sensu.CheckStateCritical, errors.New("--sensu-api-url flag or $SENSU_API_URL environment variable must be set")
+	} else if len(config.Namespace) == 0 && len(config.Namespaces) == 0 && len(config.NamespaceSelector) == 0 {
+		return sensu.CheckStateCritical, errors.New("--namespace, --namespaces, or --namespace-selector flag (or $SENSU_NAMESPACE environment variable) must be set")
+	} else if len(config.Command) == 0 && !config.ExecuteOnly && playbook == nil {
+		return sensu.CheckStateCritical, errors.New("--command, --command-file, or --playbook flag (or $SENSU_RUNBOOK_COMMAND environment variable) must be set")
+	} else if len(config.Subscriptions) == 0 && len(config.Entities) == 0 && len(config.EntityQuery) == 0 && len(config.ExecuteSubscriptions) == 0 && !config.Interactive {
+		return sensu.CheckStateCritical, errors.New("--subscriptions, --entities, or --entity-query flag (or $SENSU_RUNBOOK_SUBSCRIPTIONS, $SENSU_RUNBOOK_ENTITIES, or $SENSU_RUNBOOK_ENTITY_QUERY environment variable) must be set, or --interactive to select the subscriptions")
+	} else if config.RequireReason && len(strings.TrimSpace(config.Reason)) == 0 {
+		return sensu.CheckStateCritical, errors.New("--reason flag (or $SENSU_RUNBOOK_REASON environment variable) must be set with --require-reason")
+	} else if len(config.JobID) == 0 && config.ExecuteOnly {
+		return sensu.CheckStateCritical, errors.New("--execute-only requires the --id of an existing check")
+	} else if sensuAPIUrl, ok := validSensuAPIUrls(); !ok {
+		return sensu.CheckStateWarning, fmt.Errorf("invalid --sensu-api-url \"%s\" (must be an absolute URL, e.g. https://sensu.example.com:8080, or a comma-separated list of them)", sensuAPIUrl)
+	} else if len(config.JobID) > maxJobIDLength {
+		return sensu.CheckStateWarning, fmt.Errorf("--id must not exceed %d characters (got %d; use --sanitize-id to truncate it)", maxJobIDLength, len(config.JobID))
+	} else if len(config.JobID) > 0 && !jobIDRegex.MatchString(config.JobID) {
+		return sensu.CheckStateWarning, fmt.Errorf("invalid --id \"%s\" (may only contain letters, numbers, \"_\", \".\", and \"-\"; use --sanitize-id to replace other characters)", config.JobID)
+	} else if !strings.HasPrefix(config.APIPrefix, "/") {
+		return sensu.CheckStateWarning, fmt.Errorf("invalid --api-prefix \"%s\" (must start with \"/\")", config.APIPrefix)
+	} else if config.MaxParallelExecs < 0 {
+		return sensu.CheckStateWarning, fmt.Errorf("invalid --max-parallel-execs %d (must not be negative)", config.MaxParallelExecs)
+	} else if config.MaxResponseBytes < 0 {
+		return sensu.CheckStateWarning, fmt.Errorf("invalid --max-response-bytes %d (must not be negative)", config.MaxResponseBytes)
+	} else if config.Retries < 0 {
+		return sensu.CheckStateWarning, fmt.Errorf("invalid --retries %d (must not be negative)", config.Retries)
+	} else if config.MaxOutputBytes < 0 {
+		return sensu.CheckStateWarning, fmt.Errorf("invalid --max-output-bytes %d (must not be negative)", config.MaxOutputBytes)
+	} else if config.AssetDownloadGrace < 0 {
+		return sensu.CheckStateWarning, fmt.Errorf("invalid --asset-download-grace %d (must not be negative)", config.AssetDownloadGrace)
+	} else if len(config.EntityClass) > 0 && config.EntityClass != v2.EntityAgentClass && config.EntityClass != v2.EntityProxyClass {
+		return sensu.CheckStateWarning, fmt.Errorf("invalid --entity-class \"%s\" (must be one of: %s, %s)", config.EntityClass, v2.EntityAgentClass, v2.EntityProxyClass)
+	} else if config.Verbose && config.Quiet {
+		return sensu.CheckStateWarning, errors.New("--verbose and --quiet are mutually exclusive")
+	} else if status, ok := invalidExitStatus(); ok {
+		return sensu.CheckStateWarning, fmt.Errorf("invalid %s (must be an exit status between 0 and 255)", status)
+	} else if config.IDStrategy != idStrategyFixed && config.IDStrategy != idStrategyRandom && config.IDStrategy != idStrategyContentHash {
+		return sensu.CheckStateWarning, fmt.Errorf("invalid --id-strategy \"%s\" (must be one of: %s, %s, %s)", config.IDStrategy, idStrategyFixed, idStrategyRandom, idStrategyContentHash)
+	} else if config.IDStrategy != idStrategyFixed && config.ExecuteOnly {
+		return sensu.CheckStateWarning, fmt.Errorf("--id-strategy %s cannot be used with --execute-only (which executes the --id of an existing check)", config.IDStrategy)
+	} else if config.Output != outputText && config.Output != outputMetrics && config.Output != outputJSON && config.Output != outputYAML && config.Output != outputJSONL {
+		return sensu.CheckStateWarning, fmt.Errorf("invalid --output \"%s\" (must be one of: %s, %s, %s, %s, %s)", config.Output, outputText, outputMetrics, outputJSON, outputYAML, outputJSONL)
+	}
+	if (len(config.JobID) == 0 || config.IDStrategy != idStrategyFixed) && !config.Interactive {
+		// only derived once the command and targets are known to be set
+		// (i.e. after the --interactive selection)
+		var err error
+		if config.JobID, err = strategyJobID(); err != nil {
+			return sensu.CheckStateCritical, err
+		}
+	}
+	if len(config.Deadline) > 0 {
+		if _, err := time.ParseDuration(config.Deadline); err != nil {
+			return sensu.CheckStateWarning, fmt.Errorf("invalid --deadline \"%s\": %w", config.Deadline, err)
+		}
+	}
+	if len(config.EntityQuery) > 0 && len(config.Entities) > 0 {
+		if config.TargetTriggeringEntity {
+			return sensu.CheckStateWarning, errors.New("--entity-query cannot be used with --target-triggering-entity")
+		}
+		return sensu.CheckStateWarning, errors.New("--entities and --entity-query are mutually exclusive")
+	}
+	if config.Interactive {
+		switch {
+		case len(config.Subscriptions) > 0 || len(config.Entities) > 0 || len(config.EntityQuery) > 0 || len(config.ExecuteSubscriptions) > 0:
+			return sensu.CheckStateWarning, errors.New("--interactive cannot be used with --subscriptions, --entities, --entity-query, --execute-subscriptions, or --target-triggering-entity")
+		case len(config.Namespaces) > 0 || len(config.NamespaceSelector) > 0:
+			return sensu.CheckStateWarning, errors.New("--interactive cannot be used with --namespaces or --namespace-selector")
+		case readsEvent() || config.Command == "-":
+			return sensu.CheckStateWarning, errors.New("--interactive cannot be used with --command - or the options reading the triggering event (both read stdin)")
+		case !isTerminal():
+			return sensu.CheckStateWarning, errors.New("--interactive requires stdin to be a terminal (use --subscriptions instead)")
+		}
+	}
+	if len(config.Export) > 0 {
+		// the Sensu API is not used with --export
+		switch {
+		case config.ExecuteOnly:
+			return sensu.CheckStateWarning, errors.New("--export cannot be used with --execute-only (the runbook job is not registered)")
+		case len(config.NamespaceSelector) > 0 || len(config.EntityQuery) > 0 || config.Interactive:
+			return sensu.CheckStateWarning, errors.New("--export cannot be used with --namespace-selector, --entity-query, or --interactive (they are resolved with the Sensu API)")
+		}
+	}
+	if playbook != nil && (len(config.Namespaces) > 0 || len(config.NamespaceSelector) > 0) {
+		return sensu.CheckStateWarning, errors.New("--namespaces and --namespace-selector cannot be used with --playbook (set a namespace per playbook step instead)")
+	}
+	if len(config.NamespaceSelector) > 0 {
+		if len(config.Namespaces) > 0 {
+			return sensu.CheckStateWarning, errors.New("--namespaces and --namespace-selector are mutually exclusive")
+		}
+		if _, err := parseLabelSelector(config.NamespaceSelector); err != nil {
+			return sensu.CheckStateWarning, err
+		}
+	}
+	for _, run := range jobRuns() {
+		if len(run.JobID) > maxJobIDLength {
+			return sensu.CheckStateWarning, fmt.Errorf("--playbook job id \"%s\" must not exceed %d characters (got %d)", run.JobID, maxJobIDLength, len(run.JobID))
+		}
+	}
+	if config.Follow {
+		config.Wait = true
+	}
+	if interval, err := time.ParseDuration(config.PollInterval); err != nil {
+		return sensu.CheckStateWarning, fmt.Errorf("invalid --poll-interval \"%s\": %w", config.PollInterval, err)
+	} else if interval < minPollInterval {
+		return sensu.CheckStateWarning, fmt.Errorf("invalid --poll-interval \"%s\" (must be at least %s)", config.PollInterval, minPollInterval)
+	}
+	if len(config.WaitTimeout) > 0 {
+		if timeout, err := time.ParseDuration(config.WaitTimeout); err != nil {
+			return sensu.CheckStateWarning, fmt.Errorf("invalid --wait-timeout \"%s\": %w", config.WaitTimeout, err)
+		} else if timeout <= 0 {
+			return sensu.CheckStateWarning, fmt.Errorf("invalid --wait-timeout \"%s\" (must be positive)", config.WaitTimeout)
+		}
+	}
+	if config.Repeat < 1 {
+		return sensu.CheckStateWarning, fmt.Errorf("invalid --repeat %d (must be at least 1)", config.Repeat)
+	}
+	if _, err := time.ParseDuration(config.RepeatDelay); err != nil {
+		return sensu.CheckStateWarning, fmt.Errorf("invalid --repeat-delay \"%s\": %w", config.RepeatDelay, err)
+	}
+	if config.UntilSuccess && !config.Wait {
+		return sensu.CheckStateWarning, errors.New("--until-success requires --wait")
+	}
+	if config.RawEvents && (!config.Wait || config.Output != outputJSON) {
+		return sensu.CheckStateWarning, fmt.Errorf("--raw-events requires --wait and --output %s", outputJSON)
+	}
+	if config.Output == outputJSONL && !config.Wait {
+		return sensu.CheckStateWarning, fmt.Errorf("--output %s requires --wait (or --follow)", outputJSONL)
+	}
+	if config.Cleanup && config.UnpublishAfter {
+		return sensu.CheckStateWarning, errors.New("only one of --cleanup or --unpublish-after may be set")
+	}
+	if len(config.Cron) > 0 {
+		// the same parser the Sensu API validates check cron schedules with
+		if _, err := cron.ParseStandard(config.Cron); err != nil {
+			return sensu.CheckStateWarning, fmt.Errorf("invalid --cron \"%s\": %w", config.Cron, err)
+		}
+		if config.Cleanup {
+			return sensu.CheckStateWarning, errors.New("--cron cannot be used with --cleanup (deleting the runbook check would unschedule it)")
+		}
+	}
+	for _, threshold := range []struct {
+		name  string
+		value int
+	}{
+		{"--low-flap-threshold", config.LowFlapThreshold},
+		{"--high-flap-threshold", config.HighFlapThreshold},
+	} {
+		if threshold.value < 0 || threshold.value > 100 {
+			return sensu.CheckStateWarning, fmt.Errorf("invalid %s %d (must be a percentage between 0 and 100)", threshold.name, threshold.value)
+		} else if threshold.value > 0 && len(config.Cron) == 0 {
+			// flap detection only applies to the events of a published check
+			return sensu.CheckStateWarning, fmt.Errorf("%s requires --cron", threshold.name)
+		}
+	}
+	if config.LowFlapThreshold > 0 && config.HighFlapThreshold > 0 && config.LowFlapThreshold >= config.HighFlapThreshold {
+		return sensu.CheckStateWarning, fmt.Errorf("--low-flap-threshold %d must be lower than --high-flap-threshold %d", config.LowFlapThreshold, config.HighFlapThreshold)
+	}
+	if config.Wait && config.RoundRobin {
+		return sensu.CheckStateWarning, errors.New("--wait is not supported with --round-robin")
+	}
+	if config.ServerValidate && config.ExecuteOnly {
+		return sensu.CheckStateWarning, errors.New("--server-validate cannot be used with --execute-only (the runbook job is not registered)")
+	}
+	if config.ExecuteOnly && len(config.Command) > 0 {
+		logger.Warnf("--command is ignored with --execute-only\n")
+	}
+	if config.ExecuteOnly && len(config.CommandPrefix) > 0 {
+		logger.Warnf("--command-prefix is ignored with --execute-only\n")
+	}
+	for _, handler := range strings.Split(config.Handlers, ",") {
+		if handler = strings.TrimSpace(handler); len(handler) > 0 && !jobIDRegex.MatchString(handler) {
+			return sensu.CheckStateWarning, fmt.Errorf("invalid --handlers handler name \"%s\" (may only contain letters, numbers, \"_\", \".\", and \"-\")", handler)
+		}
+	}
+	if _, err := parseSecrets(config.Secrets); err != nil {
+		return sensu.CheckStateWarning, err
+	}
+	if _, err := parseAssetURLRewrites(config.AssetURLRewrites); err != nil {
+		return sensu.CheckStateWarning, err
+	}
+	if _, err := parseExcludeLabels(config.ExcludeLabels); err != nil {
+		return sensu.CheckStateWarning, err
+	} else if config.StrictExclude && len(config.ExcludeLabels) == 0 {
+		return sensu.CheckStateWarning, errors.New("--strict-exclude requires --exclude-label")
+	}
+	if _, err := parseHeaders(splitLines(config.Headers)); err != nil {
+		return sensu.CheckStateWarning, err
+	}
+	for _, expression := range splitLines(config.ProxyEntityAttributes) {
+		if err := validateEntityAttribute(expression); err != nil {
+			return sensu.CheckStateWarning, fmt.Errorf("invalid --proxy-entity-attributes \"%s\": %w", expression, err)
+		}
+	}
+	if config.Splay && len(splitLines(config.ProxyEntityAttributes)) == 0 {
+		return sensu.CheckStateWarning, errors.New("--splay requires --proxy-entity-attributes")
+	} else if config.Splay && (config.SplayCoverage < 1 || config.SplayCoverage > 100) {
+		return sensu.CheckStateWarning, fmt.Errorf("invalid --splay-coverage %d (must be between 1 and 100)", config.SplayCoverage)
+	}
+	if len(config.OutputMetricFormat) > 0 && !stringSliceContains(outputMetricFormats, config.OutputMetricFormat) {
+		return sensu.CheckStateWarning, fmt.Errorf("invalid --output-metric-format \"%s\" (must be one of: %s)", config.OutputMetricFormat, strings.Join(outputMetricFormats, ", "))
+	}
+	if _, err := needsConfirmation(config.Command); err != nil {
+		return sensu.CheckStateWarning, err
+	}
+	if config.Silence {
+		if _, err := time.ParseDuration(config.SilenceExpire); err != nil {
+			return sensu.CheckStateWarning, fmt.Errorf("invalid --silence-expire \"%s\": %w", config.SilenceExpire, err)
+		}
+	}
+	if len(config.SensuTrustedCaFile) > 0 {
+		f, err := os.Open(config.SensuTrustedCaFile)
+		if err != nil {
+			return sensu.CheckStateCritical, fmt.Errorf("--sensu-trusted-ca-file is not readable: %w", err)
+		}
+		f.Close()
+	} else if len(config.SensuTrustedCaPEM) > 0 && !x509.NewCertPool().AppendCertsFromPEM([]byte(config.SensuTrustedCaPEM)) {
+		return sensu.CheckStateWarning, errors.New("invalid --sensu-trusted-ca-pem: no PEM certificates found")
+	}
+	if len(config.DialSOCKS5) > 0 {
+		if _, _, err := parseSOCKS5(config.DialSOCKS5); err != nil {
+			return sensu.CheckStateWarning, err
+		}
+	}
+	return sensu.CheckStateOK, nil
+}
+
+// resolveAccessToken sets the Sensu API access token from, in order of
+// precedence, the --sensu-access-token flag, the --sensu-access-token-file
+// file, the $SENSU_ACCESS_TOKEN environment variable, or the output of the
+// --token-command.
+func resolveAccessToken() error {
+	if len(config.SensuAccessToken) > 0 {
+		return nil
+	}
+	if len(config.SensuAccessTokenFile) > 0 {
+		token, err := readFile(config.SensuAccessTokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read --sensu-access-token-file: %w", err)
+		}
+		config.SensuAccessToken = strings.TrimSpace(string(token))
+		return nil
+	}
+	config.SensuAccessToken = os.Getenv("SENSU_ACCESS_TOKEN")
+	if len(config.SensuAccessToken) == 0 && len(config.TokenCommand) > 0 {
+		token, err := runTokenCommand(config.TokenCommand, config.TokenCommandTimeout)
+		if err != nil {
+			return err
+		}
+		config.SensuAccessToken = token
+	}
+	return nil
+}
+
+// tokenNamespace returns the default namespace encoded in the "namespace"
+// claim of a JWT access token, or "" if the token is not a JWT or has no such
+// claim. The token is not verified; that is left to the Sensu API.
+func tokenNamespace(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	var claims struct {
+		Namespace string `json:"namespace"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	return strings.TrimSpace(claims.Namespace)
+}
+
+// runTokenCommand runs the given shell command and returns its (trimmed)
+// stdout as the access token. The command is killed if it does not complete
+// within the given timeout.
+func runTokenCommand(command string, timeout string) (string, error) {
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		return "", fmt.Errorf("invalid --token-command-timeout \"%s\": %w", timeout, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("--token-command timed out after %s", d)
+	} else if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); len(msg) > 0 {
+			return "", fmt.Errorf("--token-command failed: %s: %s", err, msg)
+		}
+		return "", fmt.Errorf("--token-command failed: %w", err)
+	}
+	token := strings.TrimSpace(string(out))
+	if len(token) == 0 {
+		return "", errors.New("--token-command did not print an access token")
+	}
+	return token, nil
+}
+
+func executePlaybook(event *v2.Event) (int, error) {
+	// TODO: use the sensu-plugin-sdk HTTP client (reference: https://github.com/sensu/sensu-ec2-handler/blob/master/main.go#L12)
+	httpClient, err := initHTTPClient()
+	if err != nil {
+		return sensu.CheckStateCritical, fmt.Errorf("ERROR: %w", err)
+	}
+	ctx := context.Background()
+	if len(config.Deadline) > 0 {
+		deadline, err := time.ParseDuration(config.Deadline)
+		if err != nil {
+			return sensu.CheckStateWarning, fmt.Errorf("ERROR: invalid --deadline \"%s\": %w", config.Deadline, err)
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, deadline)
+		defer cancel()
+	}
+	if len(config.NamespaceSelector) > 0 {
+		namespaces, err := selectNamespaces(ctx, httpClient, config.NamespaceSelector)
+		if err != nil {
+			return sensu.CheckStateCritical, fmt.Errorf("ERROR: failed to list namespaces: %w", unprefixed(err))
+		}
+		if len(namespaces) == 0 {
+			return sensu.CheckStateWarning, fmt.Errorf("ERROR: no namespaces match --namespace-selector \"%s\"", config.NamespaceSelector)
+		}
+		logger.Infof("--namespace-selector matched %d namespaces: %s\n", len(namespaces), strings.Join(namespaces, ","))
+		defer func(namespaces string) {
+			config.Namespaces = namespaces
+		}(config.Namespaces)
+		config.Namespaces = strings.Join(namespaces, ",")
+	}
+	if config.Interactive {
+		subscriptions, err := availableSubscriptions(ctx, httpClient, config.Namespace)
+		if err != nil {
+			return sensu.CheckStateCritical, fmt.Errorf("ERROR: %w", err)
+		} else if len(subscriptions) == 0 {
+			return sensu.CheckStateWarning, fmt.Errorf("ERROR: no entities in namespace \"%s\" have subscriptions to select", config.Namespace)
+		}
+		selected, err := selectSubscriptions(stdin, prompt, subscriptions)
+		if err != nil {
+			return sensu.CheckStateWarning, fmt.Errorf("ERROR: %w", err)
+		}
+		logger.Infof("selected subscriptions: %s\n", strings.Join(selected, ","))
+		defer func(subscriptions string, jobID string) {
+			config.Subscriptions, config.JobID = subscriptions, jobID
+		}(config.Subscriptions, config.JobID)
+		config.Subscriptions = strings.Join(selected, ",")
+		if len(config.JobID) == 0 || config.IDStrategy != idStrategyFixed {
+			if config.JobID, err = strategyJobID(); err != nil {
+				return sensu.CheckStateCritical, fmt.Errorf("ERROR: %w", err)
+			}
+		}
+	}
+	var runs = jobRuns()
+	if len(config.Export) > 0 {
+		return exportJobs(config.Export, runs)
+	}
+	if !config.DryRun && !config.Diff && !config.ServerValidate && !config.Yes {
+		for _, run := range runs {
+			confirmationRequired, err := needsConfirmation(run.Command)
+			if err != nil {
+				return sensu.CheckStateWarning, fmt.Errorf("ERROR: %w", err)
+			}
+			if confirmationRequired {
+				if !isTerminal() {
+					return sensu.CheckStateWarning, errors.New("ERROR: the runbook job must be confirmed, but stdin is not a terminal (use --yes to skip the confirmation)")
+				}
+				targets := executionSubscriptions()
+				if len(config.EntityQuery) > 0 {
+					targets = append(targets, fmt.Sprintf("(entities matching \"%s\")", config.EntityQuery))
+				}
+				if !confirm(stdin, prompt, run.Command, targets) {
+					return sensu.CheckStateWarning, errors.New("ERROR: the runbook job was not confirmed")
+				}
+			}
+		}
+	}
+	// stop on SIGINT or SIGTERM (e.g. during a long --wait), reporting what
+	// was seen so far and cleaning up
+	ctx, interrupted, stop := withInterrupts(ctx)
+	defer stop()
+	// Playbook steps are run as the job id and command of the step
+	jobID, command := config.JobID, config.Command
+	defer func() {
+		config.JobID, config.Command = jobID, command
+	}()
+	var metrics runMetrics
+	var results []*RunResult
+	if config.Output == outputMetrics {
+		defer func() {
+			for _, result := range results {
+				metrics.addTimings(result.Timings)
+			}
+			metrics.write(stdout)
+		}()
+	}
+	if config.Output == outputJSON {
+		defer func() {
+			if err := writeResults(stdout, results); err != nil {
+				logger.Errorf("ERROR: failed to write results: %s\n", err)
+			}
+		}()
+	} else if config.Output == outputYAML {
+		defer func() {
+			if err := writeYAMLResults(stdout, results); err != nil {
+				logger.Errorf("ERROR: failed to write results: %s\n", err)
+			}
+		}()
+	} else if config.Output == outputText {
+		defer func() {
+			writeSummary(stdout, results)
+		}()
+	}
+	if len(config.ResultFile) > 0 {
+		// deferred last, so that a failure to write the file is reported in
+		// the output
+		defer func() {
+			if err := writeResultFile(config.ResultFile, results); err != nil {
+				logger.Warnf("%s\n", err)
+				for _, result := range results {
+					result.Warnings = append(result.Warnings, err.Error())
+				}
+			}
+		}()
+	}
+	var state = sensu.CheckStateOK
+	var failures []string
+	for _, run := range runs {
+		config.JobID, config.Command = run.JobID, run.Command
+		metrics.attempted++
+		result := newRunResult(run.Namespace)
+		results = append(results, result)
+		result.deferWait = concurrentWait(runs)
+		status, err := runJob(ctx, httpClient, run.Namespace, result)
+		result.recordBackend()
+		result.state = status
+		result.setError(err)
+		if err == nil && result.wait != nil {
+			// accounted for once the results are in
+			continue
+		} else if err == nil {
+			metrics.succeeded++
+			continue
+		}
+		metrics.failed++
+		if interrupted() {
+			return exitInterrupted, fmt.Errorf("ERROR: interrupted: %w", unprefixed(err))
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			result.state = sensu.CheckStateWarning
+			return sensu.CheckStateWarning, fmt.Errorf("ERROR: deadline exceeded (--deadline %s): %w", config.Deadline, unprefixed(err))
+		}
+		if playbook != nil {
+			logger.Errorf("playbook step %s failed; skipping the remaining steps\n", run.JobID)
+			return status, err
+		}
+		if len(runs) == 1 || config.FailFast {
+			return status, err
+		}
+		logger.Errorf("%s\n", err)
+		failures = append(failures, fmt.Sprintf("%s (%s)", run.Namespace, err))
+		if status > state {
+			state = status
+		}
+	}
+	var waits []*jobWait
+	for _, result := range results {
+		if result.wait != nil {
+			waits = append(waits, result.wait)
+		}
+	}
+	if len(waits) > 0 {
+		started := time.Now()
+		waitErr := waitForJobs(ctx, httpClient, waits)
+		waited := time.Since(started)
+		for _, result := range results {
+			if result.wait == nil {
+				continue
+			}
+			result.addTiming(stageWait, waited)
+			result.recordBackend()
+			events, err := result.wait.outcome(ctx, waitErr)
+			status, err := recordResults(events, err, result)
+			result.state = status
+			result.setError(err)
+			if err == nil {
+				metrics.succeeded++
+				continue
+			}
+			metrics.failed++
+			logger.Errorf("%s\n", err)
+			failures = append(failures, fmt.Sprintf("%s (%s)", result.Namespace, err))
+			if status > state {
+				state = status
+			}
+		}
+	}
+	if len(failures) > 0 {
+		err := fmt.Errorf("ERROR: runbook job failed in %d of %d namespaces: %s", len(failures), len(runs), strings.Join(failures, "; "))
+		if interrupted() {
+			return exitInterrupted, fmt.Errorf("ERROR: interrupted: %w", unprefixed(err))
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return sensu.CheckStateWarning, fmt.Errorf("ERROR: deadline exceeded (--deadline %s): %w", config.Deadline, unprefixed(err))
+		}
+		return state, err
+	}
+	return sensu.CheckStateOK, nil
+}
+
+// concurrentWait reports whether the results of the runbook jobs are waited
+// for all at once, after executing the runbook job in every namespace, rather
+// than one namespace at a time. This requires --wait and multiple namespaces,
+// and is not possible when the results of a namespace must be in before
+// moving on: to run the next playbook step, to repeat the execution, to stop
+// with --fail-fast, or to clean up after the execution.
+func concurrentWait(runs []jobRun) bool {
+	return config.Wait && len(runs) > 1 && playbook == nil && config.Repeat <= 1 && !config.FailFast &&
+		!config.Cleanup && !config.UnpublishAfter && !config.Silence
+}
+
+// Runbook job stages, used to distinguish failures to register the job
+// from failures to trigger its execution, and to time them.
+const (
+	stageCreate  = "create"
+	stageExecute = "execute"
+	stageWait    = "wait"
+)
+
+// describedError is an error with a different message, e.g. explaining the
+// API error it wraps.
+type describedError struct {
+	msg string
+	err error
+}
+
+// describe returns an error with the formatted message that still matches
+// err with errors.Is and errors.As.
+func describe(err error, format string, a ...interface{}) error {
+	return &describedError{msg: fmt.Sprintf(format, a...), err: err}
+}
+
+// unprefixed returns err without its "ERROR: " prefix, for wrapping in
+// another error message.
+func unprefixed(err error) error {
+	return describe(err, "%s", strings.TrimPrefix(err.Error(), "ERROR: "))
+}
+
+func (e *describedError) Error() string {
+	return e.msg
+}
+
+func (e *describedError) Unwrap() error {
+	return e.err
+}
+
+// stageError is an error that occurred during a specific runbook job stage.
+type stageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *stageError) Error() string {
+	return fmt.Sprintf("ERROR: failed to %s runbook job: %s", e.Stage, strings.TrimPrefix(e.Err.Error(), "ERROR: "))
+}
+
+func (e *stageError) Unwrap() error {
+	return e.Err
+}
+
+// runMetrics counts the runbook job executions of a single invocation, and
+// sums the durations of their stages (in milliseconds).
+type runMetrics struct {
+	attempted int
+	succeeded int
+	failed    int
+	durations map[string]float64
+}
+
+// addTimings adds the stage durations of a runbook job.
+func (m *runMetrics) addTimings(timings map[string]float64) {
+	for stage, d := range timings {
+		if m.durations == nil {
+			m.durations = make(map[string]float64)
+		}
+		m.durations[stage] += d
+	}
+}
+
+// write prints the metrics in Prometheus text exposition format, suitable for
+// Sensu's "prometheus_text" output metric extraction.
+func (m runMetrics) write(w io.Writer) {
+	fmt.Fprintf(w, "# TYPE runbook_executions_total counter\n")
+	fmt.Fprintf(w, "runbook_executions_total %d\n", m.attempted)
+	fmt.Fprintf(w, "# TYPE runbook_execution_successes_total counter\n")
+	fmt.Fprintf(w, "runbook_execution_successes_total %d\n", m.succeeded)
+	fmt.Fprintf(w, "# TYPE runbook_execution_errors_total counter\n")
+	fmt.Fprintf(w, "runbook_execution_errors_total %d\n", m.failed)
+	if len(m.durations) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# TYPE runbook_stage_duration_milliseconds gauge\n")
+	for _, stage := range []string{stageCreate, stageExecute, stageWait} {
+		if d, ok := m.durations[stage]; ok {
+			fmt.Fprintf(w, "runbook_stage_duration_milliseconds{stage=\"%s\"} %s\n", stage, strconv.FormatFloat(d, 'f', 3, 64))
+		}
+	}
+}
+
+// targetNamespaces returns the namespaces to perform the runbook automation
+// in; --namespaces takes precedence over --namespace.
+func targetNamespaces() []string {
+	if len(config.Namespaces) > 0 {
+		var namespaces []string
+		for _, namespace := range strings.Split(config.Namespaces, ",") {
+			if namespace = strings.TrimSpace(namespace); len(namespace) > 0 {
+				namespaces = append(namespaces, namespace)
+			}
+		}
+		return namespaces
+	}
+	return []string{config.Namespace}
+}
+
+// runJob registers and executes the runbook job in the given namespace,
+// recording its progress in result. With --execute-only the job is expected to
+// already exist, and is only executed.
+func runJob(ctx context.Context, httpClient *http.Client, namespace string, result *RunResult) (int, error) {
+	job, err := generateCheckConfig(namespace)
+	if err != nil {
+		return sensu.CheckStateWarning, fmt.Errorf("ERROR: %w", err)
+	}
+	if config.Preflight {
+		if err = preflight(ctx, httpClient, namespace); err != nil {
+			return sensu.CheckStateCritical, err
+		}
+	}
+	if len(config.Entities) > 0 {
+		err = validateEntities(ctx, httpClient, namespace, mergeSubscriptions(strings.Split(config.Entities, ",")))
+		if err != nil {
+			return sensu.CheckStateCritical, fmt.Errorf("ERROR: %w", err)
+		}
+	}
+	if !config.ExecuteOnly {
+		err = validateAssets(ctx, httpClient, namespace)
+		if err != nil {
+			return sensu.CheckStateCritical, fmt.Errorf("ERROR: %w", err)
+		}
+	}
+	if config.Diff {
+		return diffJob(ctx, httpClient, &job)
+	}
+	if config.ServerValidate {
+		return serverValidateJob(ctx, httpClient, &job)
+	}
+	if len(config.EntityQuery) > 0 {
+		entities, err := queryEntities(ctx, httpClient, namespace, config.EntityQuery)
+		if err != nil {
+			return sensu.CheckStateCritical, fmt.Errorf("ERROR: failed to resolve --entity-query: %w", unprefixed(err))
+		}
+		if len(entities) == 0 {
+			return sensu.CheckStateWarning, fmt.Errorf("ERROR: no entities in namespace \"%s\" match --entity-query \"%s\"", namespace, config.EntityQuery)
+		}
+		logger.Infof("--entity-query matched %d entities in namespace %s: %s\n", len(entities), namespace, strings.Join(entities, ","))
+		// the matching entities are targeted like --entities, in this
+		// namespace only
+		defer func() {
+			config.Entities = ""
+		}()
+		config.Entities = strings.Join(entities, ",")
+	}
+	var targets []string
+	if config.PreviewTargets || config.Wait || len(config.EntityClass) > 0 {
+		var otherClass []string
+		targets, otherClass, err = matchingEntities(ctx, httpClient, namespace, executionSubscriptions())
+		if err != nil {
+			return sensu.CheckStateCritical, fmt.Errorf("ERROR: failed to list targets: %w", err)
+		}
+		if len(targets) == 0 && len(otherClass) > 0 {
+			return sensu.CheckStateWarning, fmt.Errorf("ERROR: the targeted subscriptions only match entities that are not of --entity-class %s: %s", config.EntityClass, strings.Join(otherClass, ","))
+		} else if len(otherClass) > 0 {
+			logger.Warnf("ignoring %d targeted entities that are not of --entity-class %s: %s\n", len(otherClass), config.EntityClass, strings.Join(otherClass, ","))
+		}
+		if config.Wait && len(targets) == 0 {
+			return sensu.CheckStateWarning, errors.New("ERROR: no entities match the targeted subscriptions, nothing to --wait for")
+		}
+	}
+	if config.PreviewTargets {
+		if config.Output == outputText {
+			fmt.Fprintf(stdout, "runbook job %s/%s targets %d entities: %s\n", job.Namespace, job.Name, len(targets), strings.Join(targets, ","))
+		} else {
+			logger.Infof("runbook job %s/%s targets %d entities: %s\n", job.Namespace, job.Name, len(targets), strings.Join(targets, ","))
+		}
+	}
+	if len(config.ExcludeLabels) > 0 {
+		excluded, err := excludedEntities(ctx, httpClient, namespace, executionSubscriptions())
+		if err != nil {
+			return sensu.CheckStateCritical, fmt.Errorf("ERROR: failed to list targets: %w", err)
+		}
+		if len(excluded) > 0 && config.StrictExclude {
+			return sensu.CheckStateWarning, fmt.Errorf("ERROR: runbook job %s/%s targets %d excluded entities: %s", job.Namespace, job.Name, len(excluded), strings.Join(excluded, ","))
+		} else if len(excluded) > 0 {
+			logger.Warnf("runbook job %s/%s targets %d excluded entities, which will also execute it: %s\n", job.Namespace, job.Name, len(excluded), strings.Join(excluded, ","))
+		}
+	}
+	if config.DryRun {
+		logger.Infof("dry run: not registering or executing runbook job %s/%s\n", job.Namespace, job.Name)
+		return sensu.CheckStateOK, nil
+	}
+	if !config.ExecuteOnly {
+		logger.Infof("registering runbook job ID %s/%s with --command %s\n", job.Namespace, job.Name, config.Command)
+		started := time.Now()
+		created, registered, err := createJob(ctx, httpClient, &job)
+		result.addTiming(stageCreate, time.Since(started))
+		if err != nil {
+			return sensu.CheckStateCritical, &stageError{Stage: stageCreate, Err: err}
+		}
+		job = *created
+		result.Created = true
+		result.conflicted = !registered
+		if config.Cleanup {
+			defer cleanupJob(httpClient, &job)
+		} else if config.RollbackOnFailure && registered {
+			// don't leave the check registered by this invocation behind when
+			// it could not be executed
+			defer func() {
+				if !result.Executed {
+					logger.Infof("rolling back runbook job %s/%s, as it was not executed\n", job.Namespace, job.Name)
+					cleanupJob(httpClient, &job)
+				}
+			}()
+		}
+	}
+	var silences []*v2.Silenced
+	if config.Silence {
+		silences, err = generateSilences(&job)
+		if err != nil {
+			return sensu.CheckStateWarning, fmt.Errorf("ERROR: %w", err)
+		}
+		for _, silence := range silences {
+			if err = createSilence(ctx, httpClient, silence); err != nil {
+				deleteSilences(httpClient, silences)
+				return sensu.CheckStateCritical, err
+			}
+		}
+	}
+	status, err := executeRepeatedly(ctx, httpClient, &job, targets, silences, result)
+	if !result.Executed {
+		return status, err
+	}
+	if config.UnpublishAfter {
+		if unpublishErr := unpublishJob(ctx, httpClient, &job); unpublishErr != nil {
+			if err != nil {
+				logger.Errorf("ERROR: failed to unpublish runbook job: %s\n", strings.TrimPrefix(unpublishErr.Error(), "ERROR: "))
+				return status, err
+			}
+			return sensu.CheckStateCritical, fmt.Errorf("ERROR: failed to unpublish runbook job: %w", unprefixed(unpublishErr))
+		}
+	}
+	return status, err
+}
+
+// prefixCommand returns the command wrapped by --command-prefix (if any),
+// separated by a single space. A multi-line script (e.g. from --command-file)
+// is wrapped as a whole, by running it with "sh -c".
+func prefixCommand(command string) string {
+	prefix := strings.TrimRightFunc(config.CommandPrefix, unicode.IsSpace)
+	if len(prefix) == 0 {
+		return command
+	}
+	command = strings.TrimSpace(command)
+	if strings.Contains(command, "\n") {
+		command = "sh -c " + shellEscape(command)
+	}
+	return prefix + " " + command
+}
+
+// reasonAnnotation records the --reason of the runbook job on its check, for
+// auditing.
+const reasonAnnotation = "sensu.io/plugins/sensu-runbook/reason"
+
+func generateCheckConfig(namespace string) (v2.CheckConfig, error) {
+	// Build CheckConfig object
+	timeout, err := strconv.ParseUint(config.Timeout, 10, 32)
+	if err != nil {
+		return v2.CheckConfig{}, fmt.Errorf("invalid --timeout \"%s\" (must be a number of seconds)", config.Timeout)
+	}
+	var labels = parseKvStringSlice(strings.Split(config.Labels, ","))
+	var annotations = parseKvStringSlice(strings.Split(config.Annotations, ","))
+	if config.PropagateEventContext && triggeringEvent != nil {
+		for k, v := range eventAnnotations(triggeringEvent) {
+			annotations[k] = v
+		}
+	}
+	if len(config.Reason) > 0 {
+		annotations[reasonAnnotation] = config.Reason
+	}
+	var job = v2.CheckConfig{
+		ObjectMeta: v2.ObjectMeta{
+			Name:        config.JobID,
+			Namespace:   namespace,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Command:       prefixCommand(config.Command),
+		Publish:       false,
+		Subscriptions: []string{"none"},
+		// The interval is unused since the check is only published with
+		// --cron, but the Sensu API rejects checks without an interval or
+		// cron schedule (even with publish: false), and always serializes it.
+		Interval: 10,
+		Timeout:  uint32(timeout),
+		// Round-robin distribution is performed by the Sensu backend, which
+		// sends each request to only one of the agents in every subscription.
+		RoundRobin:         config.RoundRobin,
+		Stdin:              config.CheckStdin,
+		OutputMetricFormat: config.OutputMetricFormat,
+	}
+	if len(config.OutputMetricHandlers) > 0 {
+		for _, handler := range strings.Split(config.OutputMetricHandlers, ",") {
+			job.OutputMetricHandlers = append(job.OutputMetricHandlers, strings.TrimSpace(handler))
+		}
+	}
+	if job.Secrets, err = parseSecrets(config.Secrets); err != nil {
+		return v2.CheckConfig{}, err
+	}
+	if attributes := splitLines(config.ProxyEntityAttributes); len(attributes) > 0 {
+		job.ProxyRequests = &v2.ProxyRequests{EntityAttributes: attributes}
+		if config.Splay {
+			job.ProxyRequests.Splay = true
+			job.ProxyRequests.SplayCoverage = uint32(config.SplayCoverage)
+		}
+	}
+	if len(config.Handlers) > 0 {
+		for _, handler := range strings.Split(config.Handlers, ",") {
+			if handler = strings.TrimSpace(handler); len(handler) > 0 {
+				job.Handlers = append(job.Handlers, handler)
+			}
+		}
+	}
+	if len(config.ExecuteSubscriptions) > 0 && len(config.Subscriptions) > 0 {
+		// --subscriptions configures the check, rather than the execution
+		job.Subscriptions = mergeSubscriptions(strings.Split(config.Subscriptions, ","))
+	}
+	if len(config.Cron) > 0 {
+		// a scheduled check is published on the targets of the execution,
+		// and the Sensu API rejects checks with both an interval and a cron
+		// schedule
+		job.Publish = true
+		job.Cron = config.Cron
+		job.Interval = 0
+		job.LowFlapThreshold = uint32(config.LowFlapThreshold)
+		job.HighFlapThreshold = uint32(config.HighFlapThreshold)
+		if len(config.ExecuteSubscriptions) == 0 || len(config.Subscriptions) == 0 {
+			job.Subscriptions = nil
+			for _, subscription := range executionSubscriptions() {
+				job.Subscriptions = append(job.Subscriptions, strings.TrimSpace(subscription))
+			}
+		}
+	}
+	assets, err := runtimeAssets()
+	if err != nil {
+		return v2.CheckConfig{}, err
+	}
+	for _, asset := range assets {
+		job.RuntimeAssets = append(job.RuntimeAssets, asset.Name)
+	}
+	if len(job.RuntimeAssets) > 0 && config.AssetDownloadGrace > 0 {
+		// The check timeout has to cover fetching the runtime assets as well
+		// as the command, so the effective timeout is the --timeout budget of
+		// the command plus the grace: e.g. --timeout 10 with
+		// --asset-download-grace 50 registers a timeout of 60 seconds. Without
+		// runtime assets there is nothing to download, and --timeout applies
+		// as-is.
+		effective := timeout + uint64(config.AssetDownloadGrace)
+		if effective > math.MaxUint32 {
+			return v2.CheckConfig{}, fmt.Errorf("--timeout %d plus --asset-download-grace %d exceeds the maximum check timeout", timeout, config.AssetDownloadGrace)
+		}
+		job.Timeout = uint32(effective)
+	}
+	return job, nil
+}
+
+// envVarName matches valid environment variable names.
+var envVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseSecrets parses the --secret NAME=secret-name options into check
+// secrets, exposing the Sensu secret resource as the NAME environment variable.
+func parseSecrets(specs []string) ([]*v2.Secret, error) {
+	var secrets []*v2.Secret
+	var names = make(map[string]bool)
+	for _, spec := range specs {
+		i := strings.Index(spec, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid --secret \"%s\" (must be NAME=secret-name)", spec)
+		}
+		name, secret := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+		if !envVarName.MatchString(name) {
+			return nil, fmt.Errorf("invalid --secret \"%s\": \"%s\" is not a valid environment variable name", spec, name)
+		} else if len(secret) == 0 {
+			return nil, fmt.Errorf("invalid --secret \"%s\": no secret name", spec)
+		} else if names[name] {
+			return nil, fmt.Errorf("invalid --secret \"%s\": %s is set more than once", spec, name)
+		}
+		names[name] = true
+		secrets = append(secrets, &v2.Secret{Name: name, Secret: secret})
+	}
+	return secrets, nil
+}
+
+// entityReference matches a reference to the entity outside of the string
+// literals of an entity attribute expression.
+var entityReference = regexp.MustCompile(`\bentity\b`)
+
+// openingBrackets maps the closing brackets of an entity attribute expression
+// to their opening brackets.
+var openingBrackets = map[rune]rune{')': '(', ']': '[', '}': '{'}
+
+// validateEntityAttribute performs a minimal syntax check of a proxy request
+// entity attribute expression; the expression itself is evaluated by the
+// Sensu backend. It must refer to the entity and be a complete expression,
+// which catches the fragments of an expression split on commas or spaces
+// (like "==" or "'us-east'").
+func validateEntityAttribute(expression string) error {
+	if len(strings.TrimSpace(expression)) == 0 {
+		return errors.New("empty expression")
+	}
+	var brackets []rune
+	var quote rune
+	var code strings.Builder
+	for _, c := range expression {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+			continue
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(' || c == '[' || c == '{':
+			brackets = append(brackets, c)
+		case c == ')' || c == ']' || c == '}':
+			if len(brackets) == 0 || brackets[len(brackets)-1] != openingBrackets[c] {
+				return errors.New("unbalanced brackets")
+			}
+			brackets = brackets[:len(brackets)-1]
+		}
+		code.WriteRune(c)
+	}
+	if quote != 0 {
+		return errors.New("unterminated string")
+	} else if len(brackets) != 0 {
+		return errors.New("unbalanced brackets")
+	}
+	trimmed := strings.TrimSpace(code.String())
+	if strings.ContainsAny(trimmed[:1], "=<>&|*/%,?:.") || strings.ContainsAny(trimmed[len(trimmed)-1:], "=!<>&|+-*/%,?:.") {
+		return errors.New("incomplete expression")
+	} else if !entityReference.MatchString(trimmed) {
+		return errors.New("the expression does not refer to the entity")
+	}
+	return nil
+}
+
+// deriveJobID returns a job ID derived from the command(s) and targets, used
+// when no --id is given; the same runbook job always gets the same ID, so
+// re-running it reuses its check rather than registering a new one.
+func deriveJobID() string {
+	return fmt.Sprintf("runbook-%x", jobHash(false))
+}
+
+// jobHash returns a hash of the command(s) and targets, and of the assets if
+// requested.
+func jobHash(withAssets bool) []byte {
+	h := sha256.New()
+	for _, s := range []string{config.Command, config.Subscriptions, config.Entities, config.ExecuteSubscriptions} {
+		fmt.Fprintf(h, "%s\x00", s)
+	}
+	// only hashed when set, so that the IDs of other jobs don't change
+	if len(config.EntityQuery) > 0 {
+		fmt.Fprintf(h, "%s\x00", config.EntityQuery)
+	}
+	if len(config.CommandPrefix) > 0 {
+		fmt.Fprintf(h, "prefix:%s\x00", config.CommandPrefix)
+	}
+	if playbook != nil {
+		for _, step := range playbook.Steps {
+			fmt.Fprintf(h, "%s\x00%s\x00%s\x00", step.Name, step.Command, step.Namespace)
+		}
+	}
+	if withAssets {
+		// invalid asset references are reported when generating the check
+		refs, _ := runtimeAssets()
+		for _, ref := range refs {
+			fmt.Fprintf(h, "asset:%s:%s\x00", ref.Name, ref.Version)
+		}
+	}
+	return h.Sum(nil)[:6]
+}
+
+// strategyJobID returns the job ID chosen by the --id-strategy: the --id (or
+// the ID derived by deriveJobID without one) for fixed, or the --id (or
+// "runbook") with a random or content hash suffix. The --id is truncated so
+// that the suffixed ID doesn't exceed maxJobIDLength.
+func strategyJobID() (string, error) {
+	var suffix []byte
+	switch config.IDStrategy {
+	case idStrategyRandom:
+		suffix = make([]byte, 6)
+		if _, err := rand.Read(suffix); err != nil {
+			return "", fmt.Errorf("failed to generate a random job ID: %w", err)
+		}
+	case idStrategyContentHash:
+		suffix = jobHash(true)
+	default:
+		if len(config.JobID) == 0 {
+			return deriveJobID(), nil
+		}
+		return config.JobID, nil
+	}
+	prefix := config.JobID
+	if len(prefix) == 0 {
+		prefix = "runbook"
+	} else if max := maxJobIDLength - 2*len(suffix) - 1; len(prefix) > max {
+		prefix = prefix[:max]
+	}
+	return fmt.Sprintf("%s-%x", prefix, suffix), nil
+}
+
+// sanitizeJobID replaces characters that are not allowed in Sensu check names
+// with "-" and truncates the result to maxJobIDLength.
+func sanitizeJobID(id string) string {
+	sanitized := invalidJobIDChars.ReplaceAllString(strings.TrimSpace(id), "-")
+	if len(sanitized) > maxJobIDLength {
+		sanitized = sanitized[:maxJobIDLength]
+	}
+	return sanitized
+}
+
+// executionSubscriptions returns the subscriptions targeted by the adhoc
+// execution request: --execute-subscriptions when set, or --subscriptions
+// otherwise, trimmed and without duplicates. The Sensu execute API does not
+// accept entity names, so entities are targeted via the "entity:<name>"
+// subscription that every Sensu agent is automatically subscribed to.
+func executionSubscriptions() []string {
+	var subscriptions []string
+	if len(config.ExecuteSubscriptions) > 0 {
+		subscriptions = append(subscriptions, strings.Split(config.ExecuteSubscriptions, ",")...)
+	} else if len(config.Subscriptions) > 0 {
+		subscriptions = append(subscriptions, strings.Split(config.Subscriptions, ",")...)
+	}
+	if len(config.Entities) > 0 {
+		for _, entity := range strings.Split(config.Entities, ",") {
+			if entity = strings.TrimSpace(entity); len(entity) > 0 {
+				subscriptions = append(subscriptions, fmt.Sprintf("entity:%s", entity))
+			}
+		}
+	}
+	return mergeSubscriptions(subscriptions)
+}
+
+// parseSubscriptionsFile parses newline- or comma-separated subscriptions,
+// ignoring blank lines and comments (lines starting with "#").
+func parseSubscriptionsFile(s string) []string {
+	var subscriptions []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, subscription := range strings.Split(line, ",") {
+			if subscription = strings.TrimSpace(subscription); len(subscription) > 0 {
+				subscriptions = append(subscriptions, subscription)
+			}
+		}
+	}
+	return subscriptions
+}
+
+// splitLines returns the non-blank lines of a newline-separated option value,
+// trimmed. Options whose values may contain commas or spaces (like --header)
+// are newline-separated rather than slices, which would be split on those.
+func splitLines(s string) []string {
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// normalizeSubscriptions returns the comma-separated subscriptions (or entity
+// names) trimmed, without empty entries, and without duplicates (keeping the
+// first).
+func normalizeSubscriptions(subscriptions string) string {
+	return strings.Join(mergeSubscriptions(strings.Split(subscriptions, ",")), ",")
+}
+
+// mergeSubscriptions returns the non-empty subscriptions of every list, in
+// order, without duplicates.
+func mergeSubscriptions(lists ...[]string) []string {
+	var seen = make(map[string]bool)
+	var subscriptions []string
+	for _, list := range lists {
+		for _, subscription := range list {
+			subscription = strings.TrimSpace(subscription)
+			if len(subscription) == 0 || seen[subscription] {
+				continue
+			}
+			seen[subscription] = true
+			subscriptions = append(subscriptions, subscription)
+		}
+	}
+	return subscriptions
+}
+
+// Parse a slice of strings containing key=value pairs
+func parseKvStringSlice(s []string) map[string]string {
+	var m = make(map[string]string)
+	for _, kvString := range s {
+		i := strings.Split(kvString, "=")
+		if len(i) > 1 {
+			k := strings.TrimSpace(i[0])
+			v := strings.TrimSpace(i[1])
+			if len(strings.Split(k, " ")) > 1 {
+				logger.Warnf("invalid key name: \"%s\" (did you mean to use --add-all?)\n", k)
+			} else {
+				m[k] = v
+			}
+		}
+	}
+	return m
+}
+
+// LoadCACerts loads the system cert pool, adding the CA certificates read from
+// path or, when path is empty, the inline PEM certificates.
+func LoadCACerts(path string, inlinePEM string) (*x509.CertPool, error) {
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		logger.Errorf("ERROR: failed to load system cert pool: %s", err)
+		rootCAs = x509.NewCertPool()
+	}
+	if rootCAs == nil {
+		rootCAs = x509.NewCertPool()
+	}
+	if path != "" {
+		certs, err := readFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file (%s): %w", path, err)
+		}
+		rootCAs.AppendCertsFromPEM(certs)
+	} else if inlinePEM != "" {
+		if !rootCAs.AppendCertsFromPEM([]byte(inlinePEM)) {
+			return nil, errors.New("failed to load the inline CA: no PEM certificates found")
+		}
+	}
+	return rootCAs, nil
+}
+
+func initHTTPClient() (*http.Client, error) {
+	certs, err := LoadCACerts(config.SensuTrustedCaFile, config.SensuTrustedCaPEM)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		RootCAs: certs,
+	}
+	tr := &http.Transport{
+		TLSClientConfig: tlsConfig,
+	}
+	if len(config.DialSOCKS5) > 0 {
+		if tr.DialContext, err = socks5Dial(config.DialSOCKS5); err != nil {
+			return nil, err
+		}
+	}
+	client := &http.Client{
+		Transport: tr,
+	}
+	return client, nil
+}
+
+// apiPath returns the path of a Sensu API resource under the --api-prefix.
+func apiPath(format string, a ...interface{}) string {
+	return strings.TrimRight(config.APIPrefix, "/") + fmt.Sprintf(format, a...)
+}
+
+// apiURL returns the URL of an API path (which may include a query) under the
+// current --sensu-api-url backend, preserving any path of the latter (e.g.
+// when the Sensu API is exposed behind a gateway at
+// https://gateway.example.com/sensu).
+func apiURL(path string) (string, error) {
+	return apiURLOf(currentBackend(), path)
+}
+
+// apiURLOf returns the URL of an API path under the given --sensu-api-url
+// backend.
+func apiURLOf(sensuAPIUrl string, path string) (string, error) {
+	base, err := url.Parse(sensuAPIUrl)
+	if err != nil {
+		return "", fmt.Errorf("invalid --sensu-api-url \"%s\": %w", sensuAPIUrl, err)
+	}
+	ref, err := url.Parse(strings.TrimPrefix(path, "/"))
+	if err != nil {
+		return "", err
+	}
+	// resolve the path relative to the base "directory"
+	base.Path = strings.TrimRight(base.Path, "/") + "/"
+	base.RawPath = ""
+	return base.ResolveReference(ref).String(), nil
+}
+
+// newAPIRequest builds an authenticated request against the Sensu API, bound
+// to the given context.
+func newAPIRequest(ctx context.Context, method string, path string, body io.Reader) (*http.Request, error) {
+	u, err := apiURL(path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
 	}
-	postBody, err := json.Marshal(jobRequest)
+	headers, err := parseHeaders(splitLines(config.Headers))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", config.SensuAccessToken))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent())
+	return req, nil
+}
+
+// headerName matches valid HTTP header names (RFC 7230 tokens).
+var headerName = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// reservedHeaders are the headers set on every Sensu API request, which
+// --header cannot override, and the options that set them instead.
+var reservedHeaders = map[string]string{
+	"Authorization": "--sensu-access-token",
+	"Content-Type":  "",
+	"User-Agent":    "--user-agent",
+}
+
+// parseHeaders parses the --header "Name: Value" lines. A header may be
+// repeated to send several values.
+func parseHeaders(specs []string) (http.Header, error) {
+	var headers = make(http.Header)
+	for _, spec := range specs {
+		i := strings.Index(spec, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid --header \"%s\" (must be \"Name: Value\")", spec)
+		}
+		name, value := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+		if !headerName.MatchString(name) {
+			return nil, fmt.Errorf("invalid --header \"%s\": \"%s\" is not a valid header name", spec, name)
+		} else if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("invalid --header \"%s\": the value must not contain line breaks", spec)
+		}
+		name = http.CanonicalHeaderKey(name)
+		if option, reserved := reservedHeaders[name]; reserved {
+			if len(option) > 0 {
+				return nil, fmt.Errorf("invalid --header \"%s\": %s cannot be overridden (use %s instead)", spec, name, option)
+			}
+			return nil, fmt.Errorf("invalid --header \"%s\": %s cannot be overridden", spec, name)
+		}
+		headers.Add(name, value)
+	}
+	return headers, nil
+}
+
+// userAgent returns the User-Agent header for the Sensu API requests.
+func userAgent() string {
+	if len(config.UserAgent) > 0 {
+		return config.UserAgent
+	}
+	return fmt.Sprintf("%s/%s", config.Name, version)
+}
+
+// getAllPaginated retrieves every page of a Sensu API list endpoint into
+// "into", which must be a pointer to a slice. Pages are requested using the
+// "limit" and "continue" query parameters until the backend stops returning a
+// "Sensu-Continue" token.
+func getAllPaginated(ctx context.Context, httpClient *http.Client, path string, into interface{}) error {
+	results := reflect.ValueOf(into)
+	if results.Kind() != reflect.Ptr || results.Elem().Kind() != reflect.Slice {
+		return errors.New("paginated results must be a pointer to a slice")
+	}
+	var continueToken string
+	for {
+		query := url.Values{}
+		query.Set("limit", strconv.Itoa(pageLimit))
+		if len(continueToken) > 0 {
+			query.Set("continue", continueToken)
+		}
+		page := reflect.New(results.Elem().Type())
+		separator := "?"
+		if strings.Contains(path, "?") {
+			separator = "&"
+		}
+		next, err := getPage(ctx, httpClient, path+separator+query.Encode(), page.Interface())
+		if err != nil {
+			return err
+		}
+		results.Elem().Set(reflect.AppendSlice(results.Elem(), page.Elem()))
+		continueToken = next
+		if len(continueToken) == 0 {
+			return nil
+		}
+	}
+}
+
+// getPage retrieves a single page of a Sensu API list endpoint into "page",
+// returning the continue token for the next page (if any).
+func getPage(ctx context.Context, httpClient *http.Client, path string, page interface{}) (string, error) {
+	req, err := newAPIRequest(ctx, "GET", path, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := doWithRetry(httpClient, req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", responseError(req, resp)
+	}
+	err = json.NewDecoder(resp.Body).Decode(page)
+	if err != nil {
+		return "", err
+	}
+	return resp.Header.Get("Sensu-Continue"), nil
+}
+
+// Sentinel errors matched by the API errors (see APIError.Is), so that callers
+// can distinguish the failures with errors.Is.
+var (
+	// ErrUnauthorized is matched by requests rejected for the access token
+	// (401 Unauthorized or 403 Forbidden).
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrNotFound is matched by requests for resources (or namespaces) that
+	// don't exist (404 Not Found).
+	ErrNotFound = errors.New("not found")
+)
+
+// APIError is an unsuccessful Sensu API response.
+type APIError struct {
+	StatusCode int
+	URL        string
+	Body       string
+	// Err is the error reading the response body (e.g. because it exceeds
+	// --max-response-bytes), in which case Body is incomplete
+	Err error
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("ERROR: %v %s (%s)", e.StatusCode, http.StatusText(e.StatusCode), e.URL)
+	if e.Err != nil {
+		return fmt.Sprintf("%s: failed to read the response body: %s", msg, e.Err)
+	}
+	body := strings.TrimSpace(e.Body)
+	if len(body) == 0 {
+		return msg
+	}
+	// Sensu API errors are formatted as {"message": "...", "code": N}
+	var apiErr struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal([]byte(body), &apiErr) == nil && len(apiErr.Message) > 0 {
+		return fmt.Sprintf("%s: %s", msg, apiErr.Message)
+	}
+	return fmt.Sprintf("%s: %s", msg, body)
+}
+
+// Is reports whether the API error matches one of the sentinel errors.
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+// Unwrap returns the error reading the response body, if any.
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// responseError builds an *APIError for an unsuccessful API response,
+// including the response body when present, or the error reading it. The
+// response body is consumed, but must still be closed by the caller.
+func responseError(req *http.Request, resp *http.Response) error {
+	b, err := ioutil.ReadAll(resp.Body)
+	return &APIError{
+		StatusCode: resp.StatusCode,
+		URL:        req.URL.String(),
+		Body:       string(b),
+		Err:        err,
+	}
+}
+
+// errResponseTooLarge is returned when reading a response body larger than
+// --max-response-bytes.
+var errResponseTooLarge = errors.New("response body exceeds --max-response-bytes")
+
+// limitedBody is a response body that fails with errResponseTooLarge once more
+// than the remaining bytes are read.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		// fail only if there is more to read
+		var buf [1]byte
+		if n, err := b.ReadCloser.Read(buf[:]); n == 0 {
+			return 0, err
+		}
+		return 0, errResponseTooLarge
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// preflight verifies that the Sensu API is reachable, and that the access
+// token is accepted for the given namespace.
+func preflight(ctx context.Context, httpClient *http.Client, namespace string) error {
+	req, err := newAPIRequest(ctx, "GET", apiPath("/namespaces/%s", namespace), nil)
+	if err != nil {
+		return fmt.Errorf("ERROR: %w", err)
+	}
+	resp, err := doWithRetry(httpClient, req)
+	if err != nil {
+		return fmt.Errorf("ERROR: cannot reach Sensu API at %s: %w", currentBackend(), err)
+	}
+	defer resp.Body.Close()
+	status := fmt.Sprintf("%v %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	switch {
+	case resp.StatusCode == 401:
+		return describe(responseError(req, resp), "ERROR: cannot reach Sensu API at %s: the access token was rejected (%s)", currentBackend(), status)
+	case resp.StatusCode == 404 && config.CreateNamespace:
+		logger.Infof("namespace \"%s\" not found; it will be created with the runbook job\n", namespace)
+		return nil
+	case resp.StatusCode == 403 || resp.StatusCode == 404:
+		return describe(responseError(req, resp), "ERROR: cannot reach Sensu API at %s: namespace \"%s\" not found or not accessible (%s)", currentBackend(), namespace, status)
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("ERROR: cannot reach Sensu API at %s: %w", currentBackend(), unprefixed(responseError(req, resp)))
+	}
+	return nil
+}
+
+func listEntities(ctx context.Context, httpClient *http.Client, namespace string) ([]v2.Entity, error) {
+	var entities []v2.Entity
+	err := getAllPaginated(ctx, httpClient, apiPath("/namespaces/%s/entities", namespace), &entities)
+	if err != nil {
+		return nil, err
+	}
+	return entities, nil
+}
+
+// queryEntities returns the (sorted) names of the entities in the given
+// namespace that match the field selector, using the filtering of the
+// entities API.
+func queryEntities(ctx context.Context, httpClient *http.Client, namespace string, selector string) ([]string, error) {
+	var entities []v2.Entity
+	query := url.Values{"fieldSelector": []string{selector}}
+	err := getAllPaginated(ctx, httpClient, apiPath("/namespaces/%s/entities?%s", namespace, query.Encode()), &entities)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entity := range entities {
+		names = append(names, entity.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// validateEntities verifies that every requested entity exists in the
+// given namespace.
+func validateEntities(ctx context.Context, httpClient *http.Client, namespace string, names []string) error {
+	entities, err := listEntities(ctx, httpClient, namespace)
+	if err != nil {
+		return fmt.Errorf("failed to list entities: %w", err)
+	}
+	var known = make(map[string]bool)
+	for _, entity := range entities {
+		known[entity.Name] = true
+	}
+	var missing []string
+	for _, name := range names {
+		if !known[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("entities not found in namespace \"%s\": %s", namespace, strings.Join(missing, ","))
+	}
+	return nil
+}
+
+// matchingEntities returns the (sorted) names of the entities in the given
+// namespace that are subscribed to any of the given subscriptions. With
+// --entity-class, the matching entities of another class are returned
+// separately.
+func matchingEntities(ctx context.Context, httpClient *http.Client, namespace string, subscriptions []string) ([]string, []string, error) {
+	entities, err := subscribedEntities(ctx, httpClient, namespace, subscriptions)
+	if err != nil {
+		return nil, nil, err
+	}
+	var names, otherClass []string
+	for _, entity := range entities {
+		if len(config.EntityClass) > 0 && entity.EntityClass != config.EntityClass {
+			otherClass = append(otherClass, entity.Name)
+		} else {
+			names = append(names, entity.Name)
+		}
+	}
+	sort.Strings(names)
+	sort.Strings(otherClass)
+	return names, otherClass, nil
+}
+
+// subscribedEntities returns the entities in the given namespace that are
+// subscribed to any of the given subscriptions.
+func subscribedEntities(ctx context.Context, httpClient *http.Client, namespace string, subscriptions []string) ([]v2.Entity, error) {
+	entities, err := listEntities(ctx, httpClient, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list entities: %w", err)
+	}
+	var wanted = make(map[string]bool)
+	for _, subscription := range subscriptions {
+		wanted[strings.TrimSpace(subscription)] = true
+	}
+	var subscribed []v2.Entity
+	for _, entity := range entities {
+		// the "entity:<name>" subscription is implicit, and may not be listed
+		matched := wanted[fmt.Sprintf("entity:%s", entity.Name)]
+		for _, subscription := range entity.Subscriptions {
+			if wanted[subscription] {
+				matched = true
+				break
+			}
+		}
+		if matched {
+			subscribed = append(subscribed, entity)
+		}
+	}
+	return subscribed, nil
+}
+
+// parseExcludeLabels parses the --exclude-label key=value options.
+func parseExcludeLabels(specs []string) (map[string]string, error) {
+	var labels = make(map[string]string)
+	for _, spec := range specs {
+		i := strings.Index(spec, "=")
+		if i < 0 || len(strings.TrimSpace(spec[:i])) == 0 {
+			return nil, fmt.Errorf("invalid --exclude-label \"%s\" (must be key=value)", spec)
+		}
+		labels[strings.TrimSpace(spec[:i])] = strings.TrimSpace(spec[i+1:])
+	}
+	return labels, nil
+}
+
+// excludedEntities returns the (sorted) names of the entities subscribed to
+// any of the given subscriptions that carry any of the --exclude-label labels.
+// The execution of a runbook job cannot skip them, as it targets the
+// subscriptions as a whole.
+func excludedEntities(ctx context.Context, httpClient *http.Client, namespace string, subscriptions []string) ([]string, error) {
+	labels, err := parseExcludeLabels(config.ExcludeLabels)
+	if err != nil {
+		return nil, err
+	}
+	entities, err := subscribedEntities(ctx, httpClient, namespace, subscriptions)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entity := range entities {
+		for k, v := range labels {
+			if value, ok := entity.Labels[k]; ok && value == v {
+				names = append(names, entity.Name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// createJob registers the runbook job check, returning the check as
+// registered by the Sensu API (including any metadata it set) when the
+// response includes it, or the given check otherwise, and whether this
+// invocation registered it (i.e. it did not already exist).
+func createJob(ctx context.Context, httpClient *http.Client, job *v2.CheckConfig) (*v2.CheckConfig, bool, error) {
+	return postJob(ctx, httpClient, job, config.CreateNamespace)
+}
+
+// postJob registers the runbook job. If createNamespace is true and the
+// namespace does not exist, it is created and the registration retried once.
+func postJob(ctx context.Context, httpClient *http.Client, job *v2.CheckConfig, createNamespace bool) (*v2.CheckConfig, bool, error) {
+	postBody, err := json.Marshal(job)
 	if err != nil {
-		log.Fatal("ERROR: ", err)
+		return nil, false, fmt.Errorf("ERROR: %w", err)
 	}
 	body := bytes.NewReader(postBody)
-	req, err := http.NewRequest(
+	req, err := newAPIRequest(
+		ctx,
 		"POST",
-		fmt.Sprintf("%s/api/core/v2/namespaces/%s/checks/%s/execute",
-			config.SensuAPIUrl,
-			config.Namespace,
-			config.JobID,
-		),
+		apiPath("/namespaces/%s/checks", job.Namespace),
 		body,
 	)
 	if err != nil {
-		log.Fatalf("ERROR: %s\n", err)
+		return nil, false, fmt.Errorf("ERROR: %w", err)
 	}
-	var httpClient *http.Client = initHTTPClient()
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", config.SensuAccessToken))
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := httpClient.Do(req)
+	resp, err := doWithRetry(httpClient, req)
 	if err != nil {
-		log.Fatalf("ERROR: %s\n", err)
-		return err
-	} else if resp.StatusCode == 404 {
-		log.Fatalf("ERROR: %v %s (%s)\n", resp.StatusCode, http.StatusText(resp.StatusCode), req.URL)
-		return err
+		return nil, false, fmt.Errorf("ERROR: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 404 && createNamespace {
+		if err := createNamespaceIfMissing(ctx, httpClient, job.Namespace); err != nil {
+			return nil, false, err
+		}
+		return postJob(ctx, httpClient, job, false)
+	} else if resp.StatusCode == 409 {
+		logger.Infof("runbook job \"%s\" already exists (%v: %s)\n", job.Name, resp.StatusCode, http.StatusText(resp.StatusCode))
+		if config.Idempotent || config.Patch {
+			return job, false, reconcileJob(ctx, httpClient, job)
+		}
+		// the existing check is deliberately executed as-is
+		return job, false, nil
 	} else if resp.StatusCode >= 300 {
-		log.Fatalf("ERROR: %v %s", resp.StatusCode, http.StatusText(resp.StatusCode))
-		return err
+		return nil, false, responseError(req, resp)
+	} else if resp.StatusCode == 201 {
+		logger.Infof("registered runbook Job \"%s\"", job.Name)
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil || len(bytes.TrimSpace(b)) == 0 {
+			return job, true, nil
+		}
+		var created v2.CheckConfig
+		if err := json.Unmarshal(b, &created); err != nil {
+			logger.Warnf("failed to parse the registered runbook job: %s\n", err)
+			return job, true, nil
+		}
+		return &created, true, nil
+	} else {
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, false, fmt.Errorf("ERROR: %w", err)
+		}
+		// logged rather than printed, so that it doesn't corrupt the --output
+		logger.Infof("registered runbook Job \"%s\" (%s): %s\n", job.Name, resp.Status, bytes.TrimSpace(b))
+		return job, true, nil
+	}
+}
+
+// createNamespaceIfMissing creates the namespace, as the runbook job could not
+// be registered in it. The namespace may also have been created concurrently,
+// which is not an error.
+func createNamespaceIfMissing(ctx context.Context, httpClient *http.Client, namespace string) error {
+	putBody, err := json.Marshal(v2.Namespace{Name: namespace})
+	if err != nil {
+		return fmt.Errorf("ERROR: %w", err)
+	}
+	req, err := newAPIRequest(ctx, "PUT", apiPath("/namespaces/%s", namespace), bytes.NewReader(putBody))
+	if err != nil {
+		return fmt.Errorf("ERROR: %w", err)
+	}
+	resp, err := doWithRetry(httpClient, req)
+	if err != nil {
+		return fmt.Errorf("ERROR: %w", err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == 401 || resp.StatusCode == 403:
+		return describe(responseError(req, resp), "ERROR: namespace \"%s\" does not exist, and the access token is not permitted to create it (%v %s)", namespace, resp.StatusCode, http.StatusText(resp.StatusCode))
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("ERROR: failed to create namespace \"%s\": %w", namespace, unprefixed(responseError(req, resp)))
+	}
+	logger.Infof("created namespace \"%s\"\n", namespace)
+	return nil
+}
+
+// executionResult is the result of a single execution request.
+type executionResult struct {
+	Subscriptions []string
+	ID            string
+	// Issued is the time the Sensu backend issued the check request (0 if
+	// unknown).
+	Issued int64
+	Err    error
+}
+
+// executeJobs requests the execution of the runbook job, returning the number
+// of successful execution requests and the result of every request (see
+// executionIDs and issuedAt). With --max-parallel-execs, a separate
+// request is made for every subscription, with at most --max-parallel-execs
+// requests in flight; otherwise a single request is made for all of them.
+// Failures are reported in the order of the subscriptions.
+func executeJobs(ctx context.Context, httpClient *http.Client, job *v2.CheckConfig, conflicted bool) (int, []executionResult, error) {
+	subscriptions := executionSubscriptions()
+	if config.MaxParallelExecs == 0 {
+		accepted, err := executeJob(ctx, httpClient, job, subscriptions, conflicted)
+		if err != nil {
+			return 0, nil, err
+		}
+		return 1, []executionResult{{Subscriptions: subscriptions, ID: accepted.executionID(), Issued: accepted.Issued}}, nil
+	}
+	results := make([]executionResult, len(subscriptions))
+	sem := make(chan struct{}, config.MaxParallelExecs)
+	var wg sync.WaitGroup
+	for i, subscription := range subscriptions {
+		results[i].Subscriptions = []string{subscription}
+		wg.Add(1)
+		go func(result *executionResult) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			var accepted executeResponse
+			accepted, result.Err = executeJob(ctx, httpClient, job, result.Subscriptions, conflicted)
+			result.ID, result.Issued = accepted.executionID(), accepted.Issued
+		}(&results[i])
+	}
+	wg.Wait()
+	var executed int
+	var failures []string
+	for _, result := range results {
+		if result.Err == nil {
+			executed++
+			continue
+		}
+		failures = append(failures, fmt.Sprintf("%s (%s)", strings.Join(result.Subscriptions, ","), strings.TrimPrefix(result.Err.Error(), "ERROR: ")))
+	}
+	if len(failures) == 1 && len(results) == 1 {
+		return executed, nil, results[0].Err
+	} else if len(failures) > 0 {
+		return executed, results, fmt.Errorf("execution failed on %d of %d subscriptions: %s", len(failures), len(results), strings.Join(failures, "; "))
+	}
+	return executed, results, nil
+}
+
+// executionIDs returns the execution IDs of the successful execution requests
+// that returned one.
+func executionIDs(results []executionResult) []string {
+	var ids []string
+	for _, result := range results {
+		if result.Err == nil && len(result.ID) > 0 {
+			ids = append(ids, result.ID)
+		}
+	}
+	return ids
+}
+
+// issuedAt returns the time the earliest of the successful execution requests
+// was issued by the Sensu backend, or 0 if the backend did not return it for
+// every one of them.
+func issuedAt(results []executionResult) int64 {
+	var issued int64
+	for _, result := range results {
+		if result.Err != nil {
+			continue
+		} else if result.Issued == 0 {
+			return 0
+		} else if issued == 0 || result.Issued < issued {
+			issued = result.Issued
+		}
+	}
+	return issued
+}
+
+// executeResponse is the body of an accepted (202) execute request. Sensu
+// returns the time the check request was issued, which the resulting events
+// carry as check.issued; an "id" is preferred when the API returns one.
+type executeResponse struct {
+	ID     string `json:"id"`
+	Issued int64  `json:"issued"`
+}
+
+// executionID returns the ID correlating the execution with its events, or ""
+// if there is none.
+func (r executeResponse) executionID() string {
+	if len(r.ID) > 0 {
+		return r.ID
+	} else if r.Issued > 0 {
+		return strconv.FormatInt(r.Issued, 10)
+	}
+	return ""
+}
+
+// executeJob requests the execution of the runbook job on the given
+// subscriptions, returning the accepted execute response of the Sensu API
+// (empty if there is none). If conflicted is true, i.e. the runbook job already existed when this
+// invocation tried to register it, a 404 is retried up to conflictRetries
+// times, as the check may not be persisted yet.
+func executeJob(ctx context.Context, httpClient *http.Client, job *v2.CheckConfig, subscriptions []string, conflicted bool) (executeResponse, error) {
+	var jobRequest = JobRequest{
+		Check:         job.Name,
+		Subscriptions: subscriptions,
+	}
+	postBody, err := json.Marshal(jobRequest)
+	if err != nil {
+		return executeResponse{}, fmt.Errorf("ERROR: %w", err)
+	}
+	var req *http.Request
+	var resp *http.Response
+	for retry := 0; ; retry++ {
+		req, err = newAPIRequest(
+			ctx,
+			"POST",
+			apiPath("/namespaces/%s/checks/%s/execute", job.Namespace, job.Name),
+			bytes.NewReader(postBody),
+		)
+		if err != nil {
+			return executeResponse{}, fmt.Errorf("ERROR: %w", err)
+		}
+		resp, err = doWithRetry(httpClient, req)
+		if err != nil {
+			return executeResponse{}, fmt.Errorf("ERROR: %w", err)
+		}
+		if resp.StatusCode != 404 || !conflicted || retry >= conflictRetries {
+			break
+		}
+		// the runbook job was registered concurrently by another invocation,
+		// and may not be persisted yet
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		logger.Warnf("runbook job %s/%s not found after it was registered concurrently; retrying in %s (%d of %d)\n", job.Namespace, job.Name, conflictRetryDelay, retry+1, conflictRetries)
+		if err := sleep(ctx, conflictRetryDelay); err != nil {
+			return executeResponse{}, fmt.Errorf("ERROR: %w", err)
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 404 && config.ExecuteOnly {
+		return executeResponse{}, fmt.Errorf("ERROR: runbook job \"%s\" not found in namespace \"%s\" (--execute-only requires an existing check)", job.Name, job.Namespace)
+	} else if resp.StatusCode >= 300 {
+		return executeResponse{}, responseError(req, resp)
 	} else if resp.StatusCode == 202 {
-		log.Printf("requested runbook Job \"%s\" execution on subscriptions: %s\n", job.Name, config.Subscriptions)
-		return nil
+		logger.Infof("requested runbook Job \"%s\" execution on subscriptions: %s\n", job.Name, strings.Join(jobRequest.Subscriptions, ","))
+		var accepted executeResponse
+		if b, err := ioutil.ReadAll(resp.Body); err == nil && len(bytes.TrimSpace(b)) > 0 {
+			if err := json.Unmarshal(b, &accepted); err != nil {
+				logger.Warnf("failed to parse the execute response: %s\n", err)
+			}
+		}
+		return accepted, nil
 	} else {
-		defer resp.Body.Close()
 		b, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			log.Fatalf("ERROR: %s\n", err)
-			return err
+			return executeResponse{}, fmt.Errorf("ERROR: %w", err)
 		}
-		fmt.Printf("%s\n", string(b))
+		logger.Infof("requested runbook Job \"%s\" execution (%s): %s\n", job.Name, resp.Status, bytes.TrimSpace(b))
+		return executeResponse{}, nil
+	}
+}
+
+func getJob(ctx context.Context, httpClient *http.Client, namespace string, name string) (*v2.CheckConfig, error) {
+	req, err := newAPIRequest(
+		ctx,
+		"GET",
+		apiPath("/namespaces/%s/checks/%s", namespace, name),
+		nil,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: %w", err)
+	}
+	resp, err := doWithRetry(httpClient, req)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, responseError(req, resp)
+	}
+	var job v2.CheckConfig
+	err = json.NewDecoder(resp.Body).Decode(&job)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: %w", err)
+	}
+	return &job, nil
+}
+
+func updateJob(ctx context.Context, httpClient *http.Client, job *v2.CheckConfig) error {
+	putBody, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("ERROR: %w", err)
+	}
+	req, err := newAPIRequest(
+		ctx,
+		"PUT",
+		apiPath("/namespaces/%s/checks/%s", job.Namespace, job.Name),
+		bytes.NewReader(putBody),
+	)
+	if err != nil {
+		return fmt.Errorf("ERROR: %w", err)
+	}
+	resp, err := doWithRetry(httpClient, req)
+	if err != nil {
+		return fmt.Errorf("ERROR: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return responseError(req, resp)
+	}
+	logger.Infof("updated runbook Job \"%s\"\n", job.Name)
+	return nil
+}
+
+// deleteJob deletes the runbook job check; a check that no longer exists is
+// not an error.
+func deleteJob(ctx context.Context, httpClient *http.Client, job *v2.CheckConfig) error {
+	req, err := newAPIRequest(
+		ctx,
+		"DELETE",
+		apiPath("/namespaces/%s/checks/%s", job.Namespace, job.Name),
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("ERROR: %w", err)
+	}
+	resp, err := doWithRetry(httpClient, req)
+	if err != nil {
+		return fmt.Errorf("ERROR: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode != 404 {
+		return responseError(req, resp)
+	}
+	logger.Infof("deleted runbook job \"%s\"\n", job.Name)
+	return nil
+}
+
+// unpublishJob disables the scheduled execution of the runbook job check,
+// keeping the check itself. The registered check is retrieved first, so that
+// a pre-registered (--execute-only) check is otherwise left unchanged.
+func unpublishJob(ctx context.Context, httpClient *http.Client, job *v2.CheckConfig) error {
+	existing, err := getJob(ctx, httpClient, job.Namespace, job.Name)
+	if err != nil {
+		return err
+	}
+	existing.Publish = false
+	return updateJob(ctx, httpClient, existing)
+}
+
+// reconcileJob updates (or with --patch, patches) the existing runbook job
+// check to match the given check config, unless they are already equivalent.
+func reconcileJob(ctx context.Context, httpClient *http.Client, job *v2.CheckConfig) error {
+	existing, err := getJob(ctx, httpClient, job.Namespace, job.Name)
+	if err != nil {
+		return err
+	}
+	if jobsEqual(existing, job) {
+		logger.Infof("runbook job \"%s\" unchanged\n", job.Name)
 		return nil
 	}
+	if config.Patch {
+		return patchJob(ctx, httpClient, existing, job)
+	}
+	return updateJob(ctx, httpClient, job)
+}
+
+// jobsEqual reports whether two runbook job check configs would execute the
+// same way. Labels and annotations are not compared, as they describe the
+// request rather than the job.
+func jobsEqual(a *v2.CheckConfig, b *v2.CheckConfig) bool {
+	return a.Command == b.Command &&
+		a.Timeout == b.Timeout &&
+		a.RoundRobin == b.RoundRobin &&
+		a.Stdin == b.Stdin &&
+		a.Publish == b.Publish &&
+		a.Cron == b.Cron &&
+		a.LowFlapThreshold == b.LowFlapThreshold &&
+		a.HighFlapThreshold == b.HighFlapThreshold &&
+		a.OutputMetricFormat == b.OutputMetricFormat &&
+		stringSlicesEqual(a.OutputMetricHandlers, b.OutputMetricHandlers) &&
+		stringSlicesEqual(a.RuntimeAssets, b.RuntimeAssets) &&
+		stringSlicesEqual(a.Subscriptions, b.Subscriptions) &&
+		stringSlicesEqual(a.Handlers, b.Handlers) &&
+		proxyRequestsEqual(a.ProxyRequests, b.ProxyRequests) &&
+		secretsEqual(a.Secrets, b.Secrets)
+}
+
+// secretsEqual reports whether two checks expose the same secrets in the same
+// order.
+func secretsEqual(a []*v2.Secret, b []*v2.Secret) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Secret != b[i].Secret {
+			return false
+		}
+	}
+	return true
+}
+
+// proxyRequestsEqual reports whether two checks select the same proxy
+// entities, treating nil and empty proxy requests as equal.
+func proxyRequestsEqual(a *v2.ProxyRequests, b *v2.ProxyRequests) bool {
+	if a == nil {
+		a = &v2.ProxyRequests{}
+	}
+	if b == nil {
+		b = &v2.ProxyRequests{}
+	}
+	return stringSlicesEqual(a.EntityAttributes, b.EntityAttributes) &&
+		a.Splay == b.Splay &&
+		a.SplayCoverage == b.SplayCoverage
+}
+
+// stringSliceContains reports whether the slice contains the string.
+func stringSliceContains(slice []string, s string) bool {
+	for _, v := range slice {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// stringSlicesEqual reports whether two string slices have the same elements
+// in the same order, treating nil and empty slices as equal.
+func stringSlicesEqual(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
@@ -1,8 +1,2561 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
 )
 
 func TestMain(t *testing.T) {
 }
+
+func TestExecutionSubscriptions(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	config.Subscriptions = "linux"
+	config.Entities = "server-1, server-2"
+	expected := []string{"linux", "entity:server-1", "entity:server-2"}
+	if got := executionSubscriptions(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestNormalizeSubscriptions(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "web, web , db,"
+
+	if _, err := checkArgs(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if config.Subscriptions != "web,db" {
+		t.Errorf("expected --subscriptions \"web,db\", got %q", config.Subscriptions)
+	}
+	// the execute request is normalized even without checkArgs
+	config.Subscriptions = "web, web , db,"
+	config.Entities = "web-1,, web-1"
+	expected := []string{"web", "db", "entity:web-1"}
+	if got := executionSubscriptions(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	config.Entities = ""
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	requests := sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks/test-job/execute")
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 execute request, got %d", len(requests))
+	}
+	var request JobRequest
+	if err := json.Unmarshal(requests[0].Body, &request); err != nil {
+		t.Fatalf("failed to decode the execute request: %s", err)
+	}
+	if expected := []string{"web", "db"}; !reflect.DeepEqual(request.Subscriptions, expected) {
+		t.Errorf("expected execution on %v, got %v", expected, request.Subscriptions)
+	}
+}
+
+func TestExecutePlaybookEntities(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "server-1", Namespace: "default"}},
+		{ObjectMeta: v2.ObjectMeta{Name: "server-2", Namespace: "default"}},
+	})
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Entities = "server-1,server-2"
+
+	status, err := executePlaybook(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if status != sensu.CheckStateOK {
+		t.Errorf("expected status %d, got %d", sensu.CheckStateOK, status)
+	}
+	requests := sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks/test-job/execute")
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 execute request, got %d", len(requests))
+	}
+	var jobRequest JobRequest
+	requests[0].decode(t, &jobRequest)
+	expected := []string{"entity:server-1", "entity:server-2"}
+	if !reflect.DeepEqual(jobRequest.Subscriptions, expected) {
+		t.Errorf("expected execute subscriptions %v, got %v", expected, jobRequest.Subscriptions)
+	}
+
+	// pasted lists often carry whitespace and trailing commas
+	for _, entities := range []string{" server-1 , server-2,", "server-1,,server-2, server-1 "} {
+		config.Entities = entities
+		if _, err := checkArgs(nil); err != nil {
+			t.Fatalf("%q: unexpected error: %s", entities, err)
+		}
+		if config.Entities != "server-1,server-2" {
+			t.Errorf("%q: expected --entities \"server-1,server-2\", got %q", entities, config.Entities)
+		}
+		// the entities are normalized even without checkArgs
+		config.Entities = entities
+		if status, err := executePlaybook(nil); err != nil || status != sensu.CheckStateOK {
+			t.Fatalf("%q: unexpected error: %d (%v)", entities, status, err)
+		}
+		requests = sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks/test-job/execute")
+		requests[len(requests)-1].decode(t, &jobRequest)
+		if !reflect.DeepEqual(jobRequest.Subscriptions, expected) {
+			t.Errorf("%q: expected execute subscriptions %v, got %v", entities, expected, jobRequest.Subscriptions)
+		}
+	}
+
+	config.Entities = "server-1,server-3"
+	status, err = executePlaybook(nil)
+	if err == nil || !strings.Contains(err.Error(), "server-3") {
+		t.Errorf("expected unknown entity error, got %v", err)
+	}
+	if status != sensu.CheckStateCritical {
+		t.Errorf("expected status %d, got %d", sensu.CheckStateCritical, status)
+	}
+}
+
+func TestExecutePlaybookEntityQuery(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	sensuAPI.handle("GET", "/api/core/v2/namespaces/default/entities", func(w http.ResponseWriter, r *http.Request) {
+		var entities []v2.Entity
+		if r.URL.Query().Get("fieldSelector") == "entity.system.platform == ubuntu" {
+			entities = []v2.Entity{
+				{ObjectMeta: v2.ObjectMeta{Name: "web-2"}, Subscriptions: []string{"web"}},
+				{ObjectMeta: v2.ObjectMeta{Name: "db-1"}, Subscriptions: []string{"db"}},
+			}
+		}
+		writeJSON(t, w, entities)
+	})
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "apt-get update"
+	config.EntityQuery = "entity.system.platform == ubuntu"
+
+	if _, err := checkArgs(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	queries := sensuAPI.requestsTo("GET", "/api/core/v2/namespaces/default/entities")
+	if len(queries) != 1 || queries[0].Query.Get("fieldSelector") != config.EntityQuery || queries[0].Query.Get("limit") == "" {
+		t.Errorf("expected 1 paginated entities request with the field selector, got %+v", queries)
+	}
+	requests := sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks/test-job/execute")
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 execute request, got %d", len(requests))
+	}
+	var jobRequest JobRequest
+	requests[0].decode(t, &jobRequest)
+	expected := []string{"entity:db-1", "entity:web-2"}
+	if !reflect.DeepEqual(jobRequest.Subscriptions, expected) {
+		t.Errorf("expected execute subscriptions %v, got %v", expected, jobRequest.Subscriptions)
+	}
+	if len(config.Entities) != 0 {
+		t.Errorf("expected --entities to be restored, got %q", config.Entities)
+	}
+
+	config.EntityQuery = "entity.system.platform == centos"
+	status, err := executePlaybook(nil)
+	if status != sensu.CheckStateWarning || err == nil || !strings.Contains(err.Error(), "no entities in namespace \"default\" match --entity-query") {
+		t.Errorf("expected warning when no entities match, got %d (%v)", status, err)
+	}
+
+	config.Entities = "web-1"
+	if status, err := checkArgs(nil); status != sensu.CheckStateWarning || err == nil {
+		t.Errorf("expected warning with both --entities and --entity-query, got %d (%v)", status, err)
+	}
+}
+
+func TestExecutePlaybookNamespaces(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	sensuAPI.on("POST", "/api/core/v2/namespaces/broken/checks", http.StatusInternalServerError, nil)
+	config.Namespaces = "broken,default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "linux"
+
+	status, err := executePlaybook(nil)
+	if status != sensu.CheckStateCritical {
+		t.Errorf("expected status %d, got %d", sensu.CheckStateCritical, status)
+	}
+	if err == nil || !strings.Contains(err.Error(), "1 of 2 namespaces") || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("expected aggregated namespace error, got %v", err)
+	}
+	if n := len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks/test-job/execute")); n != 1 {
+		t.Errorf("expected 1 execute request in namespace default, got %d", n)
+	}
+	if n := len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/broken/checks/test-job/execute")); n != 0 {
+		t.Errorf("expected no execute requests in namespace broken, got %d", n)
+	}
+
+	config.FailFast = true
+	status, err = executePlaybook(nil)
+	if status != sensu.CheckStateCritical || err == nil {
+		t.Errorf("expected critical status and error, got %d (%v)", status, err)
+	}
+	if n := len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks")); n != 1 {
+		t.Errorf("expected --fail-fast to skip namespace default, got %d create requests", n)
+	}
+}
+
+func TestExecutePlaybookMetrics(t *testing.T) {
+	var out bytes.Buffer
+	stdout = &out
+	defer func() {
+		stdout = os.Stdout
+	}()
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	sensuAPI.on("POST", "/api/core/v2/namespaces/broken/checks", http.StatusInternalServerError, nil)
+	config.Namespaces = "default,broken"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "linux"
+	config.Output = outputMetrics
+
+	status, _ := executePlaybook(nil)
+	if status != sensu.CheckStateCritical {
+		t.Errorf("expected status %d, got %d", sensu.CheckStateCritical, status)
+	}
+	for _, line := range []string{
+		"runbook_executions_total 2\n",
+		"runbook_execution_successes_total 1\n",
+		"runbook_execution_errors_total 1\n",
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("expected metric line %q in output:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestWithExitStatus(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	sensuAPI.on("POST", "/api/core/v2/namespaces/default/checks", http.StatusInternalServerError, nil)
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "linux"
+	config.ExitCritical = 42
+
+	status, err := withExitStatus(executePlaybook)(nil)
+	if status != 42 || err == nil {
+		t.Errorf("expected --exit-critical 42 when the execution fails, got %d (%v)", status, err)
+	}
+
+	config.ExitOK = 10
+	sensuAPI.on("POST", "/api/core/v2/namespaces/default/checks", http.StatusCreated, nil)
+	if status, err := withExitStatus(executePlaybook)(nil); status != 10 || err != nil {
+		t.Errorf("expected --exit-ok 10, got %d (%v)", status, err)
+	}
+
+	// only the OK, WARNING, and CRITICAL states are mapped
+	if status := exitStatus(exitInterrupted); status != exitInterrupted {
+		t.Errorf("expected the interrupted exit status %d, got %d", exitInterrupted, status)
+	}
+	if status := exitStatus(sensu.CheckStateWarning); status != sensu.CheckStateWarning {
+		t.Errorf("expected the default WARNING exit status, got %d", status)
+	}
+}
+
+func TestGetAllPaginated(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	sensuAPI.handle("GET", "/api/core/v2/namespaces/default/entities", func(w http.ResponseWriter, r *http.Request) {
+		var entities []v2.Entity
+		switch r.URL.Query().Get("continue") {
+		case "":
+			entities = []v2.Entity{{ObjectMeta: v2.ObjectMeta{Name: "server-1"}}}
+			w.Header().Set("Sensu-Continue", "page-2")
+		case "page-2":
+			entities = []v2.Entity{{ObjectMeta: v2.ObjectMeta{Name: "server-2"}}}
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(entities)
+	})
+
+	entities, err := listEntities(context.Background(), sensuAPI.Client(), "default")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	requests := sensuAPI.requestsTo("GET", "/api/core/v2/namespaces/default/entities")
+	if len(requests) != 2 {
+		t.Errorf("expected 2 requests, got %d", len(requests))
+	}
+	for _, r := range requests {
+		if r.Query.Get("limit") != "100" {
+			t.Errorf("expected limit=100, got %q", r.Query.Get("limit"))
+		}
+	}
+	var names []string
+	for _, entity := range entities {
+		names = append(names, entity.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"server-1", "server-2"}) {
+		t.Errorf("expected entities from both pages, got %v", names)
+	}
+
+	var notASlice v2.Entity
+	if err := getAllPaginated(context.Background(), sensuAPI.Client(), "/api/core/v2/namespaces/default/entities", &notASlice); err == nil {
+		t.Error("expected error for non-slice results")
+	}
+}
+
+func TestExecutePlaybookInvalidTimeout(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "linux"
+	config.Timeout = "notanumber"
+
+	status, err := executePlaybook(nil)
+	if status != sensu.CheckStateWarning {
+		t.Errorf("expected status %d, got %d", sensu.CheckStateWarning, status)
+	}
+	if err == nil || !strings.Contains(err.Error(), "--timeout") {
+		t.Errorf("expected --timeout error, got %v", err)
+	}
+}
+
+func TestCheckArgsJobID(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	config.SensuAPIUrl = "http://127.0.0.1:8080"
+	config.Namespace = "default"
+	config.Command = "hostname"
+	config.Subscriptions = "linux"
+
+	config.JobID = strings.Repeat("a", maxJobIDLength+1)
+	status, err := checkArgs(nil)
+	if status != sensu.CheckStateWarning || err == nil || !strings.Contains(err.Error(), "must not exceed") {
+		t.Errorf("expected too-long --id warning, got %d (%v)", status, err)
+	}
+
+	config.JobID = "restart web servers"
+	status, err = checkArgs(nil)
+	if status != sensu.CheckStateWarning || err == nil || !strings.Contains(err.Error(), "invalid --id") {
+		t.Errorf("expected invalid --id warning, got %d (%v)", status, err)
+	}
+
+	config.SanitizeID = true
+	status, err = checkArgs(nil)
+	if status != sensu.CheckStateOK || err != nil {
+		t.Errorf("expected sanitized --id to be accepted, got %d (%v)", status, err)
+	}
+	if config.JobID != "restart-web-servers" {
+		t.Errorf("expected sanitized --id \"restart-web-servers\", got %q", config.JobID)
+	}
+
+	config.JobID = strings.Repeat("a", maxJobIDLength+1)
+	if _, err = checkArgs(nil); err != nil || len(config.JobID) != maxJobIDLength {
+		t.Errorf("expected sanitized --id to be truncated to %d characters, got %d (%v)", maxJobIDLength, len(config.JobID), err)
+	}
+}
+
+func TestCheckArgsIDStrategy(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	jobID := func(strategy string, subscriptions string, assets ...string) string {
+		resetConfig()
+		config.SensuAPIUrl = "http://127.0.0.1:8080"
+		config.Namespace = "default"
+		config.Command = "hostname"
+		config.Subscriptions = subscriptions
+		config.Assets = assets
+		config.JobID = "restart-nginx"
+		config.IDStrategy = strategy
+		if _, err := checkArgs(nil); err != nil {
+			t.Fatalf("unexpected error with --id-strategy %s: %s", strategy, err)
+		}
+		return config.JobID
+	}
+
+	if a, b := jobID(idStrategyFixed, "web"), jobID(idStrategyFixed, "db"); a != "restart-nginx" || b != "restart-nginx" {
+		t.Errorf("expected the fixed --id for every target set, got %q and %q", a, b)
+	}
+
+	a, b := jobID(idStrategyRandom, "web"), jobID(idStrategyRandom, "web")
+	if a == b {
+		t.Errorf("expected distinct random job IDs for identical inputs, got %q twice", a)
+	}
+	for _, id := range []string{a, b} {
+		if !strings.HasPrefix(id, "restart-nginx-") || len(id) != len("restart-nginx-")+12 || !jobIDRegex.MatchString(id) {
+			t.Errorf("expected a random suffix appended to the --id, got %q", id)
+		}
+	}
+
+	web := jobID(idStrategyContentHash, "web")
+	if !strings.HasPrefix(web, "restart-nginx-") || len(web) != len("restart-nginx-")+12 {
+		t.Errorf("expected a content hash appended to the --id, got %q", web)
+	}
+	if again := jobID(idStrategyContentHash, "web"); again != web {
+		t.Errorf("expected a stable job ID for identical inputs, got %q and %q", web, again)
+	}
+	if db := jobID(idStrategyContentHash, "db"); db == web {
+		t.Errorf("expected distinct job IDs for distinct subscriptions, got %q twice", db)
+	}
+	if withAssets := jobID(idStrategyContentHash, "web", "jq"); withAssets == web {
+		t.Errorf("expected distinct job IDs for distinct assets, got %q twice", withAssets)
+	}
+
+	// the --id is truncated to fit the suffix
+	resetConfig()
+	config.SensuAPIUrl = "http://127.0.0.1:8080"
+	config.Namespace = "default"
+	config.Command = "hostname"
+	config.Subscriptions = "web"
+	config.JobID = strings.Repeat("a", maxJobIDLength)
+	config.IDStrategy = idStrategyContentHash
+	if _, err := checkArgs(nil); err != nil || len(config.JobID) != maxJobIDLength {
+		t.Errorf("expected the job ID to be truncated to %d characters, got %d (%v)", maxJobIDLength, len(config.JobID), err)
+	}
+
+	config.JobID = ""
+	config.IDStrategy = "sequential"
+	if status, err := checkArgs(nil); status != sensu.CheckStateWarning || err == nil {
+		t.Errorf("expected warning for an invalid --id-strategy, got %d (%v)", status, err)
+	}
+}
+
+func TestCheckArgsStates(t *testing.T) {
+	testCases := []struct {
+		name  string
+		setup func()
+		state int
+	}{
+		{"valid", func() {}, sensu.CheckStateOK},
+		// unrecoverable: required configuration is missing or unreadable
+		{"missing api url", func() { config.SensuAPIUrl = "" }, sensu.CheckStateCritical},
+		{"missing namespace", func() { config.Namespace = "" }, sensu.CheckStateCritical},
+		{"missing command", func() { config.Command = "" }, sensu.CheckStateCritical},
+		{"missing targets", func() { config.Subscriptions = "" }, sensu.CheckStateCritical},
+		{"execute-only without id", func() { config.JobID = ""; config.ExecuteOnly = true }, sensu.CheckStateCritical},
+		{"unreadable command file", func() { config.Command = ""; config.CommandFile = "/nonexistent/command" }, sensu.CheckStateCritical},
+		{"unreadable subscriptions file", func() { config.SubscriptionsFile = "/nonexistent/subscriptions" }, sensu.CheckStateCritical},
+		{"unreadable ca file", func() { config.SensuTrustedCaFile = "/nonexistent/ca.pem" }, sensu.CheckStateCritical},
+		{"invalid inline ca", func() { config.SensuTrustedCaPEM = "not a certificate" }, sensu.CheckStateWarning},
+		// user-correctable: invalid values or conflicting flags
+		{"command and command file", func() { config.CommandFile = "/nonexistent/command" }, sensu.CheckStateWarning},
+		{"invalid id", func() { config.JobID = "restart web" }, sensu.CheckStateWarning},
+		{"negative max parallel execs", func() { config.MaxParallelExecs = -1 }, sensu.CheckStateWarning},
+		{"invalid output", func() { config.Output = "xml" }, sensu.CheckStateWarning},
+		{"invalid sensu api url", func() { config.SensuAPIUrl = "sensu.example.com:8080" }, sensu.CheckStateWarning},
+		{"invalid api prefix", func() { config.APIPrefix = "api/core/v2" }, sensu.CheckStateWarning},
+		{"invalid deadline", func() { config.Deadline = "soon" }, sensu.CheckStateWarning},
+		{"invalid poll interval", func() { config.PollInterval = "2" }, sensu.CheckStateWarning},
+		{"poll interval too short", func() { config.PollInterval = "100ms" }, sensu.CheckStateWarning},
+		{"invalid repeat", func() { config.Repeat = 0 }, sensu.CheckStateWarning},
+		{"until success without wait", func() { config.UntilSuccess = true }, sensu.CheckStateWarning},
+		{"raw events without json output", func() { config.Wait = true; config.RawEvents = true }, sensu.CheckStateWarning},
+		{"server validate with execute only", func() { config.ServerValidate = true; config.ExecuteOnly = true; config.JobID = "test-job" }, sensu.CheckStateWarning},
+		{"wait with round robin", func() { config.Wait = true; config.RoundRobin = true }, sensu.CheckStateWarning},
+		{"invalid output metric format", func() { config.OutputMetricFormat = "csv" }, sensu.CheckStateWarning},
+		{"invalid silence expire", func() { config.Silence = true; config.SilenceExpire = "later" }, sensu.CheckStateWarning},
+		{"invalid secret", func() { config.Secrets = []string{"PASSWORD"} }, sensu.CheckStateWarning},
+		{"invalid proxy entity attributes", func() { config.ProxyEntityAttributes = "entity.name == 'a" }, sensu.CheckStateWarning},
+		{"splay without proxy entity attributes", func() { config.Splay = true }, sensu.CheckStateWarning},
+		{"negative asset download grace", func() { config.AssetDownloadGrace = -1 }, sensu.CheckStateWarning},
+		{"export with execute only", func() {
+			config.Export = "test-job.yaml"
+			config.ExecuteOnly = true
+		}, sensu.CheckStateWarning},
+		{"export with entity query", func() {
+			config.Export = "test-job.yaml"
+			config.Subscriptions = ""
+			config.EntityQuery = "entity.entity_class == agent"
+		}, sensu.CheckStateWarning},
+		{"multiple api urls", func() { config.SensuAPIUrl = "http://127.0.0.1:8080, http://127.0.0.2:8080" }, sensu.CheckStateOK},
+		{"invalid api url in list", func() { config.SensuAPIUrl = "http://127.0.0.1:8080,127.0.0.2:8080" }, sensu.CheckStateWarning},
+		{"invalid exit status", func() { config.ExitCritical = 256 }, sensu.CheckStateWarning},
+		{"id strategy with execute only", func() { config.IDStrategy = idStrategyRandom; config.ExecuteOnly = true }, sensu.CheckStateWarning},
+		{"missing required reason", func() { config.RequireReason = true }, sensu.CheckStateCritical},
+		{"blank required reason", func() {
+			config.RequireReason = true
+			config.Reason = " "
+		}, sensu.CheckStateCritical},
+		{"required reason", func() {
+			config.RequireReason = true
+			config.Reason = "INC-1234"
+		}, sensu.CheckStateOK},
+		{"invalid splay coverage", func() {
+			config.ProxyEntityAttributes = "entity.entity_class == 'proxy'"
+			config.Splay = true
+			config.SplayCoverage = 101
+		}, sensu.CheckStateWarning},
+		{"invalid wait timeout", func() { config.WaitTimeout = "soon" }, sensu.CheckStateWarning},
+		{"non-positive wait timeout", func() { config.WaitTimeout = "0s" }, sensu.CheckStateWarning},
+		{"invalid dangerous pattern", func() { config.DangerousPatterns = "rm -rf (" }, sensu.CheckStateWarning},
+		{"negative max response bytes", func() { config.MaxResponseBytes = -1 }, sensu.CheckStateWarning},
+		{"invalid cron", func() { config.Cron = "every day" }, sensu.CheckStateWarning},
+		{"invalid cron field", func() { config.Cron = "0 25 * * *" }, sensu.CheckStateWarning},
+		{"cron with cleanup", func() { config.Cron = "@daily"; config.Cleanup = true }, sensu.CheckStateWarning},
+		{"invalid entity class", func() { config.EntityClass = "backend" }, sensu.CheckStateWarning},
+		{"verbose and quiet", func() { config.Verbose = true; config.Quiet = true }, sensu.CheckStateWarning},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resetConfig()
+			defer resetConfig()
+			config.SensuAPIUrl = "http://127.0.0.1:8080"
+			config.Namespace = "default"
+			config.JobID = "test-job"
+			config.Command = "hostname"
+			config.Subscriptions = "linux"
+			tc.setup()
+
+			status, err := checkArgs(nil)
+			if status != tc.state {
+				t.Errorf("expected status %d, got %d (%v)", tc.state, status, err)
+			}
+			if (err == nil) != (tc.state == sensu.CheckStateOK) {
+				t.Errorf("expected an error only for a non-OK status, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckArgsDerivedJobID(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	derive := func(command string, subscriptions string) string {
+		resetConfig()
+		config.SensuAPIUrl = "http://127.0.0.1:8080"
+		config.Namespace = "default"
+		config.Command = command
+		config.Subscriptions = subscriptions
+		if _, err := checkArgs(nil); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return config.JobID
+	}
+
+	id := derive("systemctl restart nginx", "web")
+	if !jobIDRegex.MatchString(id) || !strings.HasPrefix(id, "runbook-") {
+		t.Errorf("expected a valid derived job ID, got %q", id)
+	}
+	if again := derive("systemctl restart nginx", "web"); again != id {
+		t.Errorf("expected the same inputs to derive the same job ID %q, got %q", id, again)
+	}
+	if other := derive("systemctl restart nginx", "db"); other == id {
+		t.Errorf("expected different subscriptions to derive a different job ID, got %q", other)
+	}
+	if other := derive("systemctl reload nginx", "web"); other == id {
+		t.Errorf("expected a different command to derive a different job ID, got %q", other)
+	}
+
+	config.JobID = ""
+	config.ExecuteOnly = true
+	if status, err := checkArgs(nil); status != sensu.CheckStateCritical || err == nil {
+		t.Errorf("expected --execute-only without --id to be critical, got %d (%v)", status, err)
+	}
+
+	config.ExecuteOnly = false
+	config.Command = ""
+	if status, err := checkArgs(nil); status != sensu.CheckStateCritical || err == nil {
+		t.Errorf("expected a missing command to be critical, got %d (%v)", status, err)
+	}
+	if len(config.JobID) > 0 {
+		t.Errorf("expected no job ID to be derived when checkArgs fails, got %q", config.JobID)
+	}
+}
+
+func TestGenerateCheckConfigRoundRobin(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	config.Command = "systemctl restart nginx"
+	config.RoundRobin = true
+
+	job, err := generateCheckConfig("default")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	b, err := json.Marshal(job)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.Contains(string(b), `"round_robin":true`) {
+		t.Errorf("expected round_robin to be true in %s", b)
+	}
+}
+
+func TestGenerateCheckConfigStdin(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	config.Command = "jq -r .check.metadata.name"
+
+	job, err := generateCheckConfig("default")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if job.Stdin {
+		t.Errorf("expected stdin to be false by default")
+	}
+	config.CheckStdin = true
+	if job, err = generateCheckConfig("default"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	b, err := json.Marshal(job)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.Contains(string(b), `"stdin":true`) {
+		t.Errorf("expected stdin to be true in %s", b)
+	}
+}
+
+func TestGenerateCheckConfigInterval(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	config.JobID = "test-job"
+	config.Command = "systemctl restart nginx"
+
+	job, err := generateCheckConfig("default")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if job.Publish {
+		t.Error("expected an adhoc (unpublished) check")
+	}
+	// the Sensu API requires an interval (or cron schedule) even for
+	// unpublished checks
+	if err := job.Validate(); err != nil {
+		t.Errorf("expected the adhoc check to pass the Sensu API validation, got %s", err)
+	}
+	job.Interval = 0
+	if err := job.Validate(); err == nil {
+		t.Error("expected an adhoc check without an interval to fail the Sensu API validation")
+	}
+}
+
+func TestGenerateCheckConfigCron(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	config.JobID = "test-job"
+	config.Command = "logrotate -f /etc/logrotate.conf"
+	config.Subscriptions = "web"
+	config.Entities = "db-1"
+	config.Cron = "0 3 * * *"
+
+	job, err := generateCheckConfig("default")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := job.Validate(); err != nil {
+		t.Errorf("expected the scheduled check to pass the Sensu API validation, got %s", err)
+	}
+	b, err := json.Marshal(job)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var serialized map[string]interface{}
+	if err := json.Unmarshal(b, &serialized); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if serialized["cron"] != "0 3 * * *" || serialized["publish"] != true {
+		t.Errorf("expected a published check with the cron schedule, got %s", b)
+	}
+	// the interval is always serialized, but must be unset with a cron schedule
+	if serialized["interval"] != float64(0) {
+		t.Errorf("expected no interval with --cron, got %s", b)
+	}
+	if expected := []string{"web", "entity:db-1"}; !reflect.DeepEqual(job.Subscriptions, expected) {
+		t.Errorf("expected the check to be scheduled on %v, got %v", expected, job.Subscriptions)
+	}
+
+	config.Cron = ""
+	job, err = generateCheckConfig("default")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(job.Cron) > 0 || job.Interval == 0 || job.Publish {
+		t.Errorf("expected an unscheduled check with an interval without --cron, got %+v", job)
+	}
+}
+
+func TestCreateJobErrorMessage(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	sensuAPI.on("POST", "/api/core/v2/namespaces/default/checks", http.StatusBadRequest, map[string]interface{}{
+		"message": "subscriptions must not be empty",
+		"code":    3,
+	})
+	config.JobID = "test-job"
+	config.Command = "hostname"
+
+	job, err := generateCheckConfig("default")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	_, _, err = createJob(context.Background(), sensuAPI.Client(), &job)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !strings.Contains(err.Error(), "400 Bad Request") || !strings.Contains(err.Error(), "subscriptions must not be empty") {
+		t.Errorf("expected API error message in error, got %q", err)
+	}
+}
+
+func TestExecutePlaybookQuiet(t *testing.T) {
+	var logs bytes.Buffer
+	logger.SetOutput(&logs)
+	defer logger.SetOutput(os.Stderr)
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	sensuAPI.on("POST", "/api/core/v2/namespaces/broken/checks", http.StatusInternalServerError, nil)
+	config.Namespaces = "default,broken"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "linux"
+	config.Quiet = true
+
+	if _, err := executePlaybook(nil); err == nil {
+		t.Fatal("expected error")
+	}
+	for _, info := range []string{"registering runbook job", "registered runbook Job", "requested runbook Job"} {
+		if strings.Contains(logs.String(), info) {
+			t.Errorf("expected %q to be suppressed by --quiet:\n%s", info, logs.String())
+		}
+	}
+	if !strings.Contains(logs.String(), "500 Internal Server Error") {
+		t.Errorf("expected error to be logged with --quiet:\n%s", logs.String())
+	}
+}
+
+func TestExecutePlaybookReadsCAFileOnce(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "server-1"}},
+	})
+	sensuAPI.on("GET", "/api/core/v2/namespaces/other/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "server-1"}},
+	})
+	var reads int
+	readFile = func(path string) ([]byte, error) {
+		reads++
+		return []byte{}, nil
+	}
+	defer func() {
+		readFile = ioutil.ReadFile
+	}()
+	config.SensuTrustedCaFile = "/etc/sensu/ca.pem"
+	config.Namespaces = "default,other"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Entities = "server-1"
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if reads != 1 {
+		t.Errorf("expected the CA file to be read once, got %d reads", reads)
+	}
+}
+
+func TestUnreadableCAFile(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	config.SensuAPIUrl = "http://127.0.0.1:8080"
+	config.Namespace = "default"
+	config.Command = "hostname"
+	config.Subscriptions = "linux"
+	config.SensuTrustedCaFile = "/nonexistent/sensu-ca.pem"
+
+	status, err := checkArgs(nil)
+	if status != sensu.CheckStateCritical {
+		t.Errorf("expected status %d, got %d", sensu.CheckStateCritical, status)
+	}
+	if err == nil || !strings.Contains(err.Error(), "--sensu-trusted-ca-file") {
+		t.Errorf("expected descriptive CA file error, got %v", err)
+	}
+
+	status, err = executePlaybook(nil)
+	if status != sensu.CheckStateCritical {
+		t.Errorf("expected status %d, got %d", sensu.CheckStateCritical, status)
+	}
+	if err == nil || !strings.Contains(err.Error(), "/nonexistent/sensu-ca.pem") {
+		t.Errorf("expected descriptive CA file error, got %v", err)
+	}
+}
+
+func TestLoadCACertsInlinePEM(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	inlinePEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	get := func(pool *x509.CertPool) error {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	pool, err := LoadCACerts("", inlinePEM)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := get(pool); err != nil {
+		t.Errorf("expected the inline CA to be trusted: %s", err)
+	}
+
+	// the CA file takes precedence over the inline PEM
+	readFile = func(path string) ([]byte, error) {
+		return []byte{}, nil
+	}
+	defer func() {
+		readFile = ioutil.ReadFile
+	}()
+	pool, err = LoadCACerts("/etc/sensu/ca.pem", inlinePEM)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := get(pool); err == nil {
+		t.Error("expected the inline CA to be ignored with a CA file")
+	}
+
+	if _, err := LoadCACerts("", "not a certificate"); err == nil {
+		t.Error("expected error for an invalid inline CA")
+	}
+}
+
+func TestGenerateCheckConfigCommandPrefix(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	script := "#!/bin/sh\nset -e\nsystemctl restart 'nginx'\n"
+	f, err := ioutil.TempFile("", "sensu-runbook-command")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(script); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	f.Close()
+	testCases := []struct {
+		prefix      string
+		command     string
+		commandFile string
+		expected    string
+	}{
+		{"", "systemctl restart nginx", "", "systemctl restart nginx"},
+		{"timeout 300", "systemctl restart nginx", "", "timeout 300 systemctl restart nginx"},
+		{"timeout 300  ", "  systemctl restart nginx", "", "timeout 300 systemctl restart nginx"},
+		{"/usr/local/bin/audit-log --", "systemctl restart nginx", "", "/usr/local/bin/audit-log -- systemctl restart nginx"},
+		{"timeout 300", "", f.Name(), `timeout 300 sh -c '#!/bin/sh
+set -e
+systemctl restart '"'"'nginx'"'"''`},
+	}
+	for _, tc := range testCases {
+		resetConfig()
+		config.SensuAPIUrl = "http://127.0.0.1:8080"
+		config.Namespace = "default"
+		config.JobID = "test-job"
+		config.Subscriptions = "linux"
+		config.Command = tc.command
+		config.CommandFile = tc.commandFile
+		config.CommandPrefix = tc.prefix
+
+		if _, err := checkArgs(nil); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		job, err := generateCheckConfig("default")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if job.Command != tc.expected {
+			t.Errorf("expected command %q with --command-prefix %q, got %q", tc.expected, tc.prefix, job.Command)
+		}
+	}
+}
+
+func TestCheckArgsCommandFile(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	script := "#!/bin/sh\nset -e\n\nfor svc in nginx php-fpm; do\n  systemctl restart \"$svc\"\ndone\n"
+	f, err := ioutil.TempFile("", "sensu-runbook-command")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(script); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	f.Close()
+	config.SensuAPIUrl = "http://127.0.0.1:8080"
+	config.Namespace = "default"
+	config.Subscriptions = "linux"
+	config.CommandFile = f.Name()
+
+	if _, err := checkArgs(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	job, err := generateCheckConfig("default")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if job.Command != script {
+		t.Errorf("expected command %q, got %q", script, job.Command)
+	}
+
+	config.Command = "hostname"
+	status, err := checkArgs(nil)
+	if status != sensu.CheckStateWarning || err == nil {
+		t.Errorf("expected warning when both --command and --command-file are set, got %d (%v)", status, err)
+	}
+}
+
+func TestExecutePlaybookFailureStage(t *testing.T) {
+	testCases := []struct {
+		path   string
+		stage  string
+		prefix string
+	}{
+		{"/api/core/v2/namespaces/default/checks", stageCreate, "ERROR: failed to create runbook job: 500"},
+		{"/api/core/v2/namespaces/default/checks/test-job/execute", stageExecute, "ERROR: failed to execute runbook job: 500"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.stage, func(t *testing.T) {
+			resetConfig()
+			defer resetConfig()
+			sensuAPI := newFakeSensu(t)
+			defer sensuAPI.Close()
+			sensuAPI.on("POST", tc.path, http.StatusInternalServerError, nil)
+			config.Namespace = "default"
+			config.JobID = "test-job"
+			config.Command = "hostname"
+			config.Subscriptions = "linux"
+
+			status, err := executePlaybook(nil)
+			if status != sensu.CheckStateCritical {
+				t.Errorf("expected status %d, got %d", sensu.CheckStateCritical, status)
+			}
+			var stageErr *stageError
+			if !errors.As(err, &stageErr) {
+				t.Fatalf("expected a stage error, got %v", err)
+			}
+			if stageErr.Stage != tc.stage {
+				t.Errorf("expected stage %q, got %q", tc.stage, stageErr.Stage)
+			}
+			if !strings.HasPrefix(err.Error(), tc.prefix) {
+				t.Errorf("expected error prefix %q, got %q", tc.prefix, err)
+			}
+		})
+	}
+}
+
+func TestAccessTokenFile(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	f, err := ioutil.TempFile("", "sensu-runbook-token")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("file-token\n"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	f.Close()
+	os.Setenv("SENSU_ACCESS_TOKEN", "env-token")
+	defer os.Unsetenv("SENSU_ACCESS_TOKEN")
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "linux"
+	config.SensuAccessTokenFile = f.Name()
+
+	if _, err := checkArgs(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	requests := sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks")
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 create request, got %d", len(requests))
+	}
+	if got := requests[0].Header.Get("Authorization"); got != "Bearer file-token" {
+		t.Errorf("expected Authorization header from token file, got %q", got)
+	}
+
+	testCases := []struct {
+		flag     string
+		file     string
+		expected string
+	}{
+		{"flag-token", f.Name(), "flag-token"},
+		{"", f.Name(), "file-token"},
+		{"", "", "env-token"},
+	}
+	for _, tc := range testCases {
+		config.SensuAccessToken = tc.flag
+		config.SensuAccessTokenFile = tc.file
+		if err := resolveAccessToken(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if config.SensuAccessToken != tc.expected {
+			t.Errorf("expected access token %q, got %q", tc.expected, config.SensuAccessToken)
+		}
+	}
+}
+
+func TestRunJobClosesResponseBodies(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "server-1"}},
+	})
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/assets/jq", http.StatusOK, v2.Asset{})
+	sensuAPI.on("POST", "/api/core/v2/namespaces/default/silenced", http.StatusCreated, nil)
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Entities = "server-1"
+	config.Assets = []string{"jq"}
+	config.ValidateAssets = true
+	config.Silence = true
+
+	transport := &trackingTransport{}
+	httpClient := &http.Client{Transport: transport}
+	if _, err := runJob(context.Background(), httpClient, "default", newRunResult("default")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	sensuAPI.on("POST", "/api/core/v2/namespaces/default/checks/test-job/execute", http.StatusInternalServerError, map[string]string{"message": "oops"})
+	if _, err := runJob(context.Background(), httpClient, "default", newRunResult("default")); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(transport.bodies) == 0 {
+		t.Fatal("expected requests through the tracking transport")
+	}
+	if unclosed := transport.unclosed(); len(unclosed) > 0 {
+		t.Errorf("expected all response bodies to be closed, unclosed: %v", unclosed)
+	}
+}
+
+func TestExecutePlaybookExecuteOnly(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Subscriptions = "linux"
+	config.ExecuteOnly = true
+
+	if _, err := checkArgs(nil); err != nil {
+		t.Fatalf("expected --command to be optional with --execute-only, got %s", err)
+	}
+	status, err := executePlaybook(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if status != sensu.CheckStateOK {
+		t.Errorf("expected status %d, got %d", sensu.CheckStateOK, status)
+	}
+	if requests := sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks"); len(requests) != 0 {
+		t.Errorf("expected no create requests, got %d", len(requests))
+	}
+	if requests := sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks/test-job/execute"); len(requests) != 1 {
+		t.Errorf("expected 1 execute request, got %d", len(requests))
+	}
+
+	sensuAPI.on("POST", "/api/core/v2/namespaces/default/checks/test-job/execute", http.StatusNotFound, nil)
+	status, err = executePlaybook(nil)
+	if status != sensu.CheckStateCritical {
+		t.Errorf("expected status %d, got %d", sensu.CheckStateCritical, status)
+	}
+	expected := "ERROR: failed to execute runbook job: runbook job \"test-job\" not found in namespace \"default\""
+	if err == nil || !strings.HasPrefix(err.Error(), expected) {
+		t.Errorf("expected error prefix %q, got %v", expected, err)
+	}
+}
+
+func TestTokenCommand(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	os.Unsetenv("SENSU_ACCESS_TOKEN")
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "linux"
+	config.TokenCommand = "echo command-token"
+
+	if _, err := checkArgs(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	requests := sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks")
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 create request, got %d", len(requests))
+	}
+	if got := requests[0].Header.Get("Authorization"); got != "Bearer command-token" {
+		t.Errorf("expected Authorization header from token command, got %q", got)
+	}
+
+	config.SensuAccessToken = ""
+	config.TokenCommand = "exit 3"
+	status, err := checkArgs(nil)
+	if status != sensu.CheckStateCritical || err == nil || !strings.Contains(err.Error(), "--token-command failed") {
+		t.Errorf("expected critical token command failure, got %d (%v)", status, err)
+	}
+}
+
+func TestCheckArgsTokenNamespace(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	jwt := func(claims string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+			base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".c2lnbmF0dXJl"
+	}
+	testCases := []struct {
+		token     string
+		namespace string
+		expected  string
+		state     int
+	}{
+		{jwt(`{"sub":"runbook","namespace":"ops"}`), "", "ops", sensu.CheckStateOK},
+		{jwt(`{"sub":"runbook","namespace":"ops"}`), "default", "default", sensu.CheckStateOK},
+		{jwt(`{"sub":"runbook"}`), "", "", sensu.CheckStateCritical},
+		{"not-a-jwt", "", "", sensu.CheckStateCritical},
+		{"a.b.c", "", "", sensu.CheckStateCritical},
+	}
+	for _, tc := range testCases {
+		resetConfig()
+		config.SensuAPIUrl = "http://127.0.0.1:8080"
+		config.JobID = "test-job"
+		config.Command = "hostname"
+		config.Subscriptions = "linux"
+		config.SensuAccessToken = tc.token
+		config.Namespace = tc.namespace
+
+		status, err := checkArgs(nil)
+		if status != tc.state {
+			t.Errorf("%q: expected state %d, got %d (%v)", tc.token, tc.state, status, err)
+		}
+		if tc.state == sensu.CheckStateOK && config.Namespace != tc.expected {
+			t.Errorf("%q: expected namespace %q, got %q", tc.token, tc.expected, config.Namespace)
+		}
+	}
+}
+
+func TestMatchingEntities(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "web-2"}, Subscriptions: []string{"linux", "web"}},
+		{ObjectMeta: v2.ObjectMeta{Name: "web-1"}, Subscriptions: []string{"linux", "web"}},
+		{ObjectMeta: v2.ObjectMeta{Name: "db-1"}, Subscriptions: []string{"linux", "db"}},
+		{ObjectMeta: v2.ObjectMeta{Name: "win-1"}, Subscriptions: []string{"windows"}},
+	})
+
+	testCases := []struct {
+		subscriptions []string
+		expected      []string
+	}{
+		{[]string{"web"}, []string{"web-1", "web-2"}},
+		{[]string{"web", "linux"}, []string{"db-1", "web-1", "web-2"}},
+		{[]string{"db", "entity:win-1"}, []string{"db-1", "win-1"}},
+		{[]string{"mac"}, nil},
+	}
+	for _, tc := range testCases {
+		got, _, err := matchingEntities(context.Background(), sensuAPI.Client(), "default", tc.subscriptions)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("expected %v entities to match %v, got %v", tc.subscriptions, tc.expected, got)
+		}
+	}
+}
+
+func TestExecutePlaybookExcludeLabel(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	var logs bytes.Buffer
+	logger.SetOutput(&logs)
+	defer logger.SetOutput(os.Stderr)
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "web-1"}, Subscriptions: []string{"web"}},
+		{ObjectMeta: v2.ObjectMeta{Name: "web-2", Labels: map[string]string{"maintenance": "true"}}, Subscriptions: []string{"web"}},
+		{ObjectMeta: v2.ObjectMeta{Name: "web-3", Labels: map[string]string{"maintenance": "false"}}, Subscriptions: []string{"web"}},
+		{ObjectMeta: v2.ObjectMeta{Name: "db-1", Labels: map[string]string{"maintenance": "true"}}, Subscriptions: []string{"db"}},
+	})
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "systemctl restart nginx"
+	config.Subscriptions = "web"
+	config.ExcludeLabels = []string{"maintenance=true"}
+
+	if _, err := checkArgs(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.Contains(logs.String(), "WARNING: runbook job default/test-job targets 1 excluded entities, which will also execute it: web-2\n") {
+		t.Errorf("expected a warning about the excluded entity, got %q", logs.String())
+	}
+	if n := len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks/test-job/execute")); n != 1 {
+		t.Errorf("expected 1 execute request, got %d", n)
+	}
+
+	config.StrictExclude = true
+	status, err := executePlaybook(nil)
+	if status != sensu.CheckStateWarning {
+		t.Errorf("expected status %d, got %d", sensu.CheckStateWarning, status)
+	}
+	if err == nil || !strings.HasSuffix(err.Error(), "runbook job default/test-job targets 1 excluded entities: web-2") {
+		t.Errorf("expected excluded entities error, got %v", err)
+	}
+	if n := len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks/test-job/execute")); n != 1 {
+		t.Errorf("expected no further execute requests with --strict-exclude, got %d", n)
+	}
+
+	config.ExcludeLabels = []string{"maintenance"}
+	if status, err := checkArgs(nil); status != sensu.CheckStateWarning || err == nil {
+		t.Errorf("expected warning for an invalid --exclude-label, got %d (%v)", status, err)
+	}
+}
+
+func TestExecutePlaybookPreviewTargets(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "web-1"}, Subscriptions: []string{"linux", "web"}},
+		{ObjectMeta: v2.ObjectMeta{Name: "db-1"}, Subscriptions: []string{"linux", "db"}},
+	})
+	var out bytes.Buffer
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "web"
+	config.PreviewTargets = true
+	config.DryRun = true
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := "runbook job default/test-job targets 1 entities: web-1\n" +
+		"RESULT job_id=test-job namespace=default status=OK created=false executed=false entities_ok=0 entities_failed=0\n"
+	if out.String() != expected {
+		t.Errorf("expected output %q, got %q", expected, out.String())
+	}
+	if requests := sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks"); len(requests) != 0 {
+		t.Errorf("expected no create requests with --dry-run, got %d", len(requests))
+	}
+
+	config.DryRun = false
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if requests := sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks/test-job/execute"); len(requests) != 1 {
+		t.Errorf("expected 1 execute request, got %d", len(requests))
+	}
+}
+
+func TestExecutePlaybookEntityClass(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "web-1"}, EntityClass: v2.EntityAgentClass, Subscriptions: []string{"web"}},
+		{ObjectMeta: v2.ObjectMeta{Name: "web-2"}, EntityClass: v2.EntityAgentClass, Subscriptions: []string{"web"}},
+		{ObjectMeta: v2.ObjectMeta{Name: "web-lb"}, EntityClass: v2.EntityProxyClass, Subscriptions: []string{"web"}},
+		{ObjectMeta: v2.ObjectMeta{Name: "switch-1"}, EntityClass: v2.EntityProxyClass, Subscriptions: []string{"network"}},
+	})
+	var out, logs bytes.Buffer
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	logger.SetOutput(&logs)
+	defer logger.SetOutput(os.Stderr)
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "web"
+	config.PreviewTargets = true
+	config.DryRun = true
+	config.EntityClass = v2.EntityAgentClass
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if expected := "runbook job default/test-job targets 2 entities: web-1,web-2\n"; !strings.HasPrefix(out.String(), expected) {
+		t.Errorf("expected output %q, got %q", expected, out.String())
+	}
+	if expected := "WARNING: ignoring 1 targeted entities that are not of --entity-class agent: web-lb\n"; !strings.Contains(logs.String(), expected) {
+		t.Errorf("expected logs to contain %q, got %q", expected, logs.String())
+	}
+
+	out.Reset()
+	config.EntityClass = v2.EntityProxyClass
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if expected := "runbook job default/test-job targets 1 entities: web-lb\n"; !strings.HasPrefix(out.String(), expected) {
+		t.Errorf("expected output %q, got %q", expected, out.String())
+	}
+
+	config.Subscriptions = "network"
+	config.EntityClass = v2.EntityAgentClass
+	status, err := executePlaybook(nil)
+	if status != sensu.CheckStateWarning || err == nil || !strings.Contains(err.Error(), "only match entities that are not of --entity-class agent: switch-1") {
+		t.Errorf("expected warning when the targets only match proxy entities, got %d (%v)", status, err)
+	}
+}
+
+func TestExecutePlaybookUnpublishAfter(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/checks/test-job", http.StatusOK, v2.CheckConfig{
+		ObjectMeta:    v2.ObjectMeta{Name: "test-job", Namespace: "default"},
+		Command:       "/opt/runbooks/restart-nginx.sh",
+		Subscriptions: []string{"web"},
+		Interval:      60,
+		Publish:       true,
+	})
+	sensuAPI.on("PUT", "/api/core/v2/namespaces/default/checks/test-job", http.StatusCreated, nil)
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Subscriptions = "web"
+	config.ExecuteOnly = true
+	config.UnpublishAfter = true
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	requests := sensuAPI.requestsTo("PUT", "/api/core/v2/namespaces/default/checks/test-job")
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 update request, got %d", len(requests))
+	}
+	var body map[string]interface{}
+	requests[0].decode(t, &body)
+	if publish, ok := body["publish"]; !ok || publish != false {
+		t.Errorf("expected update request with publish:false, got %v", body["publish"])
+	}
+	var job v2.CheckConfig
+	requests[0].decode(t, &job)
+	if job.Command != "/opt/runbooks/restart-nginx.sh" || job.Interval != 60 {
+		t.Errorf("expected the registered check to be otherwise unchanged, got %+v", job)
+	}
+}
+
+func TestCreateJobIdempotent(t *testing.T) {
+	testCases := []struct {
+		name     string
+		command  string
+		expected int
+	}{
+		{"unchanged", "systemctl restart nginx", 0},
+		{"changed", "systemctl reload nginx", 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resetConfig()
+			defer resetConfig()
+			sensuAPI := newFakeSensu(t)
+			defer sensuAPI.Close()
+			config.Namespace = "default"
+			config.JobID = "test-job"
+			config.Command = "systemctl restart nginx"
+			config.Subscriptions = "web"
+			config.Idempotent = true
+			job, err := generateCheckConfig("default")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			existing := job
+			existing.Command = tc.command
+			existing.RuntimeAssets = []string{}
+			sensuAPI.on("POST", "/api/core/v2/namespaces/default/checks", http.StatusConflict, nil)
+			sensuAPI.on("GET", "/api/core/v2/namespaces/default/checks/test-job", http.StatusOK, existing)
+			sensuAPI.on("PUT", "/api/core/v2/namespaces/default/checks/test-job", http.StatusCreated, nil)
+
+			status, err := executePlaybook(nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if status != sensu.CheckStateOK {
+				t.Errorf("expected status %d, got %d", sensu.CheckStateOK, status)
+			}
+			requests := sensuAPI.requestsTo("PUT", "/api/core/v2/namespaces/default/checks/test-job")
+			if len(requests) != tc.expected {
+				t.Fatalf("expected %d update requests, got %d", tc.expected, len(requests))
+			}
+			if len(requests) > 0 {
+				var updated v2.CheckConfig
+				requests[0].decode(t, &updated)
+				if updated.Command != config.Command {
+					t.Errorf("expected updated command %q, got %q", config.Command, updated.Command)
+				}
+			}
+			if requests := sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks/test-job/execute"); len(requests) != 1 {
+				t.Errorf("expected 1 execute request, got %d", len(requests))
+			}
+		})
+	}
+}
+
+func TestCreateJobIdempotentOutputMetrics(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "df -h"
+	config.Subscriptions = "web"
+	config.OutputMetricFormat = "influxdb_line"
+	config.OutputMetricHandlers = "influxdb"
+	config.Idempotent = true
+	job, err := generateCheckConfig("default")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// the existing check only differs in its output metric fields
+	existing := job
+	existing.OutputMetricFormat = "nagios_perfdata"
+	existing.OutputMetricHandlers = []string{"graphite"}
+	if jobsEqual(&existing, &job) {
+		t.Errorf("expected checks with distinct output metric fields to differ")
+	}
+	expected := []fieldDiff{
+		{Field: "output_metric_format", Current: "nagios_perfdata", Desired: "influxdb_line"},
+		{Field: "output_metric_handlers", Current: "graphite", Desired: "influxdb"},
+	}
+	if diffs := diffJobs(&existing, &job); !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("expected diffs %+v, got %+v", expected, diffs)
+	}
+	sensuAPI.on("POST", "/api/core/v2/namespaces/default/checks", http.StatusConflict, nil)
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/checks/test-job", http.StatusOK, existing)
+	sensuAPI.on("PUT", "/api/core/v2/namespaces/default/checks/test-job", http.StatusCreated, nil)
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	requests := sensuAPI.requestsTo("PUT", "/api/core/v2/namespaces/default/checks/test-job")
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 update request, got %d", len(requests))
+	}
+	var updated v2.CheckConfig
+	requests[0].decode(t, &updated)
+	if updated.OutputMetricFormat != "influxdb_line" || !reflect.DeepEqual(updated.OutputMetricHandlers, []string{"influxdb"}) {
+		t.Errorf("expected the output metric fields to be updated, got %q %v", updated.OutputMetricFormat, updated.OutputMetricHandlers)
+	}
+}
+
+func TestExecutePlaybookAPIError(t *testing.T) {
+	testCases := []struct {
+		path       string
+		statusCode int
+	}{
+		{"/api/core/v2/namespaces/default/checks", http.StatusUnprocessableEntity},
+		{"/api/core/v2/namespaces/default/checks/test-job/execute", http.StatusNotFound},
+	}
+	for _, tc := range testCases {
+		t.Run(http.StatusText(tc.statusCode), func(t *testing.T) {
+			resetConfig()
+			defer resetConfig()
+			sensuAPI := newFakeSensu(t)
+			defer sensuAPI.Close()
+			sensuAPI.on("POST", tc.path, tc.statusCode, map[string]interface{}{"message": "oops", "code": 1})
+			config.Namespace = "default"
+			config.JobID = "test-job"
+			config.Command = "hostname"
+			config.Subscriptions = "linux"
+
+			_, err := executePlaybook(nil)
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("expected an API error, got %v", err)
+			}
+			if apiErr.StatusCode != tc.statusCode {
+				t.Errorf("expected status code %d, got %d", tc.statusCode, apiErr.StatusCode)
+			}
+			if apiErr.URL != sensuAPI.URL+tc.path {
+				t.Errorf("expected URL %q, got %q", sensuAPI.URL+tc.path, apiErr.URL)
+			}
+			if !strings.Contains(apiErr.Body, `"message":"oops"`) {
+				t.Errorf("expected the response body, got %q", apiErr.Body)
+			}
+		})
+	}
+}
+
+func TestExecutePlaybookMaxParallelExecs(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	var inFlight, maxInFlight int32
+	sensuAPI.handle("POST", "/api/core/v2/namespaces/default/checks/test-job/execute", func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		var jobRequest JobRequest
+		_ = json.NewDecoder(r.Body).Decode(&jobRequest)
+		if len(jobRequest.Subscriptions) == 1 && strings.HasPrefix(jobRequest.Subscriptions[0], "bad") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "web,bad-1,db,cache,bad-2,queue"
+	config.MaxParallelExecs = 2
+
+	status, err := executePlaybook(nil)
+	if status != sensu.CheckStateCritical {
+		t.Errorf("expected status %d, got %d", sensu.CheckStateCritical, status)
+	}
+	requests := sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks/test-job/execute")
+	if len(requests) != 6 {
+		t.Errorf("expected 6 execute requests, got %d", len(requests))
+	}
+	if max := atomic.LoadInt32(&maxInFlight); max > 2 {
+		t.Errorf("expected at most 2 execute requests in flight, got %d", max)
+	}
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	expected := regexp.MustCompile(`^ERROR: failed to execute runbook job: execution failed on 2 of 6 subscriptions: bad-1 \(500 .*\); bad-2 \(500 .*\)$`)
+	if !expected.MatchString(err.Error()) {
+		t.Errorf("expected error matching %s, got %q", expected, err)
+	}
+}
+
+func TestCheckArgsSubscriptionsFile(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	contents := "# web tier\nweb\n\n  api , worker\n# db tier\n#db\ncache\r\nweb\n"
+	expected := []string{"web", "api", "worker", "cache", "web"}
+	if got := parseSubscriptionsFile(contents); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected subscriptions %v, got %v", expected, got)
+	}
+
+	f, err := ioutil.TempFile("", "sensu-runbook-subscriptions")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(contents); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	f.Close()
+	config.SensuAPIUrl = "http://127.0.0.1:8080"
+	config.Namespace = "default"
+	config.Command = "hostname"
+	config.Subscriptions = "linux,web"
+	config.SubscriptionsFile = f.Name()
+
+	if _, err := checkArgs(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected = []string{"linux", "web", "api", "worker", "cache"}
+	if got := executionSubscriptions(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected execution subscriptions %v, got %v", expected, got)
+	}
+}
+
+func TestExecutePlaybookJobExists(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	sensuAPI.on("POST", "/api/core/v2/namespaces/default/checks", http.StatusConflict, map[string]string{"message": "resource already exists"})
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "linux"
+
+	status, err := executePlaybook(nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if status != sensu.CheckStateOK {
+		t.Errorf("expected status %d, got %d", sensu.CheckStateOK, status)
+	}
+	if requests := sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks/test-job/execute"); len(requests) != 1 {
+		t.Errorf("expected 1 execute request, got %d", len(requests))
+	}
+	if requests := sensuAPI.requestsTo("PUT", "/api/core/v2/namespaces/default/checks/test-job"); len(requests) != 0 {
+		t.Errorf("expected no update requests without --idempotent, got %d", len(requests))
+	}
+}
+
+func TestExecutePlaybookPreflight(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "linux"
+
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default", http.StatusUnauthorized, map[string]string{"message": "bad credentials"})
+	status, err := executePlaybook(nil)
+	if status != sensu.CheckStateCritical {
+		t.Errorf("expected status %d, got %d", sensu.CheckStateCritical, status)
+	}
+	expected := "ERROR: cannot reach Sensu API at " + sensuAPI.URL + ": the access token was rejected (401 Unauthorized)"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+	if requests := sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks"); len(requests) != 0 {
+		t.Errorf("expected no create requests after a failed preflight, got %d", len(requests))
+	}
+
+	config.Preflight = false
+	if _, err := executePlaybook(nil); err != nil {
+		t.Errorf("expected the preflight to be skipped, got %s", err)
+	}
+
+	config.Preflight = true
+	sensuAPI.Close()
+	status, err = executePlaybook(nil)
+	if status != sensu.CheckStateCritical {
+		t.Errorf("expected status %d, got %d", sensu.CheckStateCritical, status)
+	}
+	if err == nil || !strings.HasPrefix(err.Error(), "ERROR: cannot reach Sensu API at "+sensuAPI.URL+": ") {
+		t.Errorf("expected cannot reach Sensu API error, got %v", err)
+	}
+}
+
+func TestExecutePlaybookCreateNamespace(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	var namespaceCreated bool
+	sensuAPI.on("GET", "/api/core/v2/namespaces/new", http.StatusNotFound, map[string]string{"message": "not found"})
+	sensuAPI.handle("POST", "/api/core/v2/namespaces/new/checks", func(w http.ResponseWriter, r *http.Request) {
+		if !namespaceCreated {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	sensuAPI.handle("PUT", "/api/core/v2/namespaces/new", func(w http.ResponseWriter, r *http.Request) {
+		namespaceCreated = true
+		w.WriteHeader(http.StatusCreated)
+	})
+	config.Namespace = "new"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "linux"
+	config.CreateNamespace = true
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	requests := sensuAPI.requestsTo("PUT", "/api/core/v2/namespaces/new")
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 namespace create request, got %d", len(requests))
+	}
+	var namespace v2.Namespace
+	requests[0].decode(t, &namespace)
+	if namespace.Name != "new" {
+		t.Errorf("expected namespace \"new\", got %q", namespace.Name)
+	}
+	if n := len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/new/checks")); n != 2 {
+		t.Errorf("expected the create request to be retried once, got %d create requests", n)
+	}
+	if n := len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/new/checks/test-job/execute")); n != 1 {
+		t.Errorf("expected 1 execute request, got %d", n)
+	}
+
+	namespaceCreated = false
+	sensuAPI.on("PUT", "/api/core/v2/namespaces/new", http.StatusForbidden, map[string]string{"message": "forbidden"})
+	status, err := executePlaybook(nil)
+	if status != sensu.CheckStateCritical {
+		t.Errorf("expected status %d, got %d", sensu.CheckStateCritical, status)
+	}
+	if err == nil || !strings.Contains(err.Error(), "not permitted to create it (403 Forbidden)") {
+		t.Errorf("expected namespace permission error, got %v", err)
+	}
+}
+
+func TestGenerateCheckConfigOutputMetrics(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	config.JobID = "test-job"
+	config.Command = "df -P"
+	config.OutputMetricFormat = "prometheus_text"
+	config.OutputMetricHandlers = "influxdb, tsdb"
+
+	job, err := generateCheckConfig("default")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	b, err := json.Marshal(job)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if fields["output_metric_format"] != "prometheus_text" {
+		t.Errorf("expected output_metric_format %q, got %v", "prometheus_text", fields["output_metric_format"])
+	}
+	expected := []interface{}{"influxdb", "tsdb"}
+	if !reflect.DeepEqual(fields["output_metric_handlers"], expected) {
+		t.Errorf("expected output_metric_handlers %v, got %v", expected, fields["output_metric_handlers"])
+	}
+
+	config.SensuAPIUrl = "http://127.0.0.1:8080"
+	config.Namespace = "default"
+	config.Subscriptions = "linux"
+	config.OutputMetricFormat = "json"
+	status, err := checkArgs(nil)
+	if status != sensu.CheckStateWarning || err == nil {
+		t.Errorf("expected warning for an invalid --output-metric-format, got %d (%v)", status, err)
+	}
+}
+
+func TestGenerateCheckConfigProxyRequests(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	config.JobID = "test-job"
+	config.Command = "systemctl restart nginx"
+	config.ProxyEntityAttributes = "entity.labels.region == 'us-east'\n\nentity.entity_class == 'proxy'\n"
+
+	job, err := generateCheckConfig("default")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	b, err := json.Marshal(job)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var proxyRequests map[string]interface{}
+	if err := json.Unmarshal(fields["proxy_requests"], &proxyRequests); err != nil {
+		t.Fatalf("failed to decode proxy_requests %s: %s", fields["proxy_requests"], err)
+	}
+	expected := []interface{}{"entity.labels.region == 'us-east'", "entity.entity_class == 'proxy'"}
+	if !reflect.DeepEqual(proxyRequests["entity_attributes"], expected) {
+		t.Errorf("expected entity_attributes %v, got %v", expected, proxyRequests["entity_attributes"])
+	}
+
+	config.ProxyEntityAttributes = ""
+	if job, err = generateCheckConfig("default"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if job.ProxyRequests != nil {
+		t.Errorf("expected no proxy_requests, got %+v", job.ProxyRequests)
+	}
+}
+
+func TestGenerateCheckConfigFlapThresholds(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	config.JobID = "test-job"
+	config.Command = "logrotate -f /etc/logrotate.conf"
+	config.Subscriptions = "web"
+	config.Cron = "0 3 * * *"
+	config.LowFlapThreshold = 20
+	config.HighFlapThreshold = 60
+
+	job, err := generateCheckConfig("default")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := job.Validate(); err != nil {
+		t.Errorf("expected the check to pass the Sensu API validation, got %s", err)
+	}
+	b, err := json.Marshal(job)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var serialized map[string]interface{}
+	if err := json.Unmarshal(b, &serialized); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if serialized["low_flap_threshold"] != float64(20) || serialized["high_flap_threshold"] != float64(60) {
+		t.Errorf("expected flap thresholds 20 and 60, got %s", b)
+	}
+
+	testCases := []struct {
+		low   int
+		high  int
+		cron  string
+		state int
+	}{
+		{20, 60, "0 3 * * *", sensu.CheckStateOK},
+		{20, 0, "0 3 * * *", sensu.CheckStateOK},
+		{60, 60, "0 3 * * *", sensu.CheckStateWarning},
+		{60, 20, "0 3 * * *", sensu.CheckStateWarning},
+		{20, 101, "0 3 * * *", sensu.CheckStateWarning},
+		{-1, 0, "0 3 * * *", sensu.CheckStateWarning},
+		{20, 60, "", sensu.CheckStateWarning},
+	}
+	for _, tc := range testCases {
+		resetConfig()
+		config.SensuAPIUrl = "http://127.0.0.1:8080"
+		config.Namespace = "default"
+		config.JobID = "test-job"
+		config.Command = "logrotate -f /etc/logrotate.conf"
+		config.Subscriptions = "web"
+		config.Cron = tc.cron
+		config.LowFlapThreshold = tc.low
+		config.HighFlapThreshold = tc.high
+
+		if status, err := checkArgs(nil); status != tc.state {
+			t.Errorf("expected state %d for low %d, high %d, cron %q, got %d (%v)", tc.state, tc.low, tc.high, tc.cron, status, err)
+		}
+	}
+}
+
+func TestGenerateCheckConfigReason(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	config.JobID = "test-job"
+	config.Command = "systemctl restart nginx"
+	config.Subscriptions = "web"
+	config.Reason = "INC-1234: nginx is leaking memory"
+
+	job, err := generateCheckConfig("default")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if reason := job.Annotations[reasonAnnotation]; reason != config.Reason {
+		t.Errorf("expected the %s annotation %q, got %q", reasonAnnotation, config.Reason, reason)
+	}
+	if job.Annotations["request"] != "sensu-runbook" {
+		t.Errorf("expected the --annotations to be kept, got %v", job.Annotations)
+	}
+	if result := newRunResult("default"); result.Reason != config.Reason {
+		t.Errorf("expected the result reason %q, got %q", config.Reason, result.Reason)
+	}
+
+	config.Reason = ""
+	if job, err = generateCheckConfig("default"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, ok := job.Annotations[reasonAnnotation]; ok {
+		t.Errorf("expected no %s annotation without --reason, got %v", reasonAnnotation, job.Annotations)
+	}
+}
+
+func TestGenerateCheckConfigSplay(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	config.JobID = "test-job"
+	config.Command = "systemctl restart nginx"
+	config.Splay = true
+	config.SplayCoverage = 50
+
+	// splay only applies to proxy requests
+	job, err := generateCheckConfig("default")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	b, err := json.Marshal(job)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, ok := fields["proxy_requests"]; ok {
+		t.Errorf("expected no proxy_requests without --proxy-entity-attributes, got %s", fields["proxy_requests"])
+	}
+
+	config.ProxyEntityAttributes = "entity.entity_class == 'proxy'"
+	if job, err = generateCheckConfig("default"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if b, err = json.Marshal(job); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	fields = nil
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var proxyRequests map[string]interface{}
+	if err := json.Unmarshal(fields["proxy_requests"], &proxyRequests); err != nil {
+		t.Fatalf("failed to decode proxy_requests %s: %s", fields["proxy_requests"], err)
+	}
+	if proxyRequests["splay"] != true || proxyRequests["splay_coverage"] != float64(50) {
+		t.Errorf("expected splay with splay_coverage 50, got %v", proxyRequests)
+	}
+
+	config.Splay = false
+	if job, err = generateCheckConfig("default"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if job.ProxyRequests.Splay || job.ProxyRequests.SplayCoverage != 0 {
+		t.Errorf("expected no splay without --splay, got %+v", job.ProxyRequests)
+	}
+}
+
+func TestGenerateCheckConfigHandlers(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	config.JobID = "test-job"
+	config.Command = "journalctl -u nginx"
+	config.Handlers = "elasticsearch, slack,"
+
+	job, err := generateCheckConfig("default")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	b, err := json.Marshal(job)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []interface{}{"elasticsearch", "slack"}
+	if !reflect.DeepEqual(fields["handlers"], expected) {
+		t.Errorf("expected handlers %v, got %v", expected, fields["handlers"])
+	}
+
+	config.SensuAPIUrl = "http://127.0.0.1:8080"
+	config.Namespace = "default"
+	config.Subscriptions = "linux"
+	config.Handlers = "elasticsearch,slack alerts"
+	if status, err := checkArgs(nil); status != sensu.CheckStateWarning || err == nil {
+		t.Errorf("expected warning for an invalid handler name, got %d (%v)", status, err)
+	}
+}
+
+func TestGenerateCheckConfigSecrets(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	config.JobID = "test-job"
+	config.Command = "psql -c 'select 1'"
+	config.Secrets = []string{"PGPASSWORD=postgres-password", " PGUSER = postgres-user "}
+
+	job, err := generateCheckConfig("default")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	b, err := json.Marshal(job)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var secrets []map[string]string
+	if err := json.Unmarshal(fields["secrets"], &secrets); err != nil {
+		t.Fatalf("failed to decode secrets %s: %s", fields["secrets"], err)
+	}
+	expected := []map[string]string{
+		{"name": "PGPASSWORD", "secret": "postgres-password"},
+		{"name": "PGUSER", "secret": "postgres-user"},
+	}
+	if !reflect.DeepEqual(secrets, expected) {
+		t.Errorf("expected secrets %v, got %v", expected, secrets)
+	}
+
+	config.SensuAPIUrl = "http://127.0.0.1:8080"
+	config.Namespace = "default"
+	config.Subscriptions = "linux"
+	for _, secret := range []string{"PGPASSWORD", "PG PASSWORD=postgres-password", "1PASSWORD=postgres-password", "PGPASSWORD=", "PGUSER=a,PGUSER=b"} {
+		config.Secrets = strings.Split(secret, ",")
+		if status, err := checkArgs(nil); status != sensu.CheckStateWarning || err == nil {
+			t.Errorf("%q: expected warning for an invalid --secret, got %d (%v)", secret, status, err)
+		}
+	}
+}
+
+func TestValidateEntityAttribute(t *testing.T) {
+	for _, expression := range []string{
+		"entity.labels.region == 'us-east'",
+		`(entity.system.os == "linux") && entity.labels.tier != 'db'`,
+		"entity.name.indexOf('(') >= 0",
+		"['amd64','arm64'].indexOf(entity.system.arch) >= 0",
+		"!entity.labels.maintenance",
+	} {
+		if err := validateEntityAttribute(expression); err != nil {
+			t.Errorf("%q: unexpected error: %s", expression, err)
+		}
+	}
+	for _, expression := range []string{"", " ", "entity.labels.region == 'us-east", "(entity.labels.region == 'us-east'", "entity.name)(",
+		"==", "entity.labels.region ==", "'us-east'", "['amd64'", "'arm64'].indexOf(entity.system.arch) >= 0", "(entity.name]", "length > 0",
+	} {
+		if err := validateEntityAttribute(expression); err == nil {
+			t.Errorf("%q: expected error", expression)
+		}
+	}
+}
+
+func TestProxyEntityAttributesParsing(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	attributes := "entity.labels.region == 'us-east'\n['amd64','arm64'].indexOf(entity.system.arch) >= 0"
+	tests := []struct {
+		name string
+		env  []string
+		args []string
+	}{
+		{"flag", nil, []string{"--proxy-entity-attributes", attributes}},
+		{"env", []string{"SENSU_RUNBOOK_PROXY_ENTITY_ATTRIBUTES=" + attributes}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "sensu-runbook-proxy")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			defer os.RemoveAll(dir)
+			export := filepath.Join(dir, "test-job.json")
+			args := append([]string{"--sensu-api-url", "http://127.0.0.1:8080", "--namespace", "default", "--id", "test-job", "--command", "hostname", "--subscriptions", "linux", "--export", export}, test.args...)
+			if out, status := runMain(t, test.env, args...); status != sensu.CheckStateOK {
+				t.Fatalf("expected exit status %d, got %d: %s", sensu.CheckStateOK, status, out)
+			}
+			b, err := ioutil.ReadFile(export)
+			if err != nil {
+				t.Fatalf("expected the --export file to be written: %s", err)
+			}
+			var document struct {
+				Spec v2.CheckConfig `json:"spec"`
+			}
+			if err := json.Unmarshal(b, &document); err != nil {
+				t.Fatalf("failed to decode the exported resource %q: %s", b, err)
+			}
+			expected := []string{"entity.labels.region == 'us-east'", "['amd64','arm64'].indexOf(entity.system.arch) >= 0"}
+			if document.Spec.ProxyRequests == nil || !reflect.DeepEqual(document.Spec.ProxyRequests.EntityAttributes, expected) {
+				t.Errorf("expected entity_attributes %q, got %+v", expected, document.Spec.ProxyRequests)
+			}
+		})
+	}
+}
+
+func TestExecutePlaybookAPIPrefix(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	sensuAPI.on("GET", "/api/core/v3/namespaces/default", http.StatusOK, map[string]string{})
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "linux"
+	config.APIPrefix = "/api/core/v3/"
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := len(sensuAPI.requestsTo("POST", "/api/core/v3/namespaces/default/checks")); n != 1 {
+		t.Errorf("expected 1 create request under the --api-prefix, got %d", n)
+	}
+	if n := len(sensuAPI.requestsTo("POST", "/api/core/v3/namespaces/default/checks/test-job/execute")); n != 1 {
+		t.Errorf("expected 1 execute request under the --api-prefix, got %d", n)
+	}
+	if n := len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks")); n != 0 {
+		t.Errorf("expected no requests under the default prefix, got %d", n)
+	}
+}
+
+func TestAPIURL(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	testCases := []struct {
+		baseURL  string
+		path     string
+		expected string
+	}{
+		{"https://sensu.example.com:8080", "/api/core/v2/namespaces/default/checks", "https://sensu.example.com:8080/api/core/v2/namespaces/default/checks"},
+		{"https://gw.example.com/sensu", "/api/core/v2/namespaces/default/checks", "https://gw.example.com/sensu/api/core/v2/namespaces/default/checks"},
+		{"https://gw.example.com/sensu/", "/api/core/v2/namespaces/default/checks?dryRun=true", "https://gw.example.com/sensu/api/core/v2/namespaces/default/checks?dryRun=true"},
+	}
+	for _, tc := range testCases {
+		config.SensuAPIUrl = tc.baseURL
+		got, err := apiURL(tc.path)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got != tc.expected {
+			t.Errorf("expected %s under %s to be %s, got %s", tc.path, tc.baseURL, tc.expected, got)
+		}
+	}
+}
+
+func TestExecutePlaybookAPIURLPath(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	sensuAPI.on("GET", "/sensu/api/core/v2/namespaces/default", http.StatusOK, map[string]string{})
+	config.SensuAPIUrl = sensuAPI.URL + "/sensu"
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "linux"
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, path := range []string{"/sensu/api/core/v2/namespaces/default/checks", "/sensu/api/core/v2/namespaces/default/checks/test-job/execute"} {
+		if n := len(sensuAPI.requestsTo("POST", path)); n != 1 {
+			t.Errorf("expected 1 POST %s request, got %d", path, n)
+		}
+	}
+}
+
+func TestExecutePlaybookErrorSentinels(t *testing.T) {
+	testCases := []struct {
+		name      string
+		method    string
+		path      string
+		status    int
+		preflight bool
+		sentinel  error
+	}{
+		{"unauthorized preflight", "GET", "/api/core/v2/namespaces/default", http.StatusUnauthorized, true, ErrUnauthorized},
+		{"forbidden create", "POST", "/api/core/v2/namespaces/default/checks", http.StatusForbidden, false, ErrUnauthorized},
+		{"missing namespace", "POST", "/api/core/v2/namespaces/default/checks", http.StatusNotFound, false, ErrNotFound},
+		{"missing check", "POST", "/api/core/v2/namespaces/default/checks/test-job/execute", http.StatusNotFound, false, ErrNotFound},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resetConfig()
+			defer resetConfig()
+			sensuAPI := newFakeSensu(t)
+			defer sensuAPI.Close()
+			sensuAPI.on(tc.method, tc.path, tc.status, map[string]string{"message": http.StatusText(tc.status)})
+			config.Namespace = "default"
+			config.JobID = "test-job"
+			config.Command = "hostname"
+			config.Subscriptions = "linux"
+			config.Preflight = tc.preflight
+
+			_, err := executePlaybook(nil)
+			if !errors.Is(err, tc.sentinel) {
+				t.Errorf("expected the error to match %q, got %v", tc.sentinel, err)
+			}
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || apiErr.StatusCode != tc.status {
+				t.Errorf("expected the error to wrap a %d API error, got %v", tc.status, err)
+			}
+			if err != nil && strings.Count(err.Error(), "ERROR: ") != 1 {
+				t.Errorf("expected a single ERROR prefix, got %q", err)
+			}
+		})
+	}
+
+	// unrelated failures don't match the sentinels
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	sensuAPI.on("POST", "/api/core/v2/namespaces/default/checks", http.StatusInternalServerError, nil)
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "linux"
+	_, err := executePlaybook(nil)
+	if err == nil || errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrNotFound) {
+		t.Errorf("expected an error matching no sentinel, got %v", err)
+	}
+}
+
+func TestLimitedBody(t *testing.T) {
+	testCases := []struct {
+		body     string
+		limit    int64
+		tooLarge bool
+	}{
+		{"0123456789", 10, false},
+		{"0123456789", 11, false},
+		{"0123456789", 9, true},
+	}
+	for _, tc := range testCases {
+		b, err := ioutil.ReadAll(&limitedBody{ReadCloser: ioutil.NopCloser(strings.NewReader(tc.body)), remaining: tc.limit})
+		if tc.tooLarge && err != errResponseTooLarge {
+			t.Errorf("expected %q to exceed %d bytes, got %v", tc.body, tc.limit, err)
+		} else if !tc.tooLarge && (err != nil || string(b) != tc.body) {
+			t.Errorf("expected %q within %d bytes, got %q (%v)", tc.body, tc.limit, b, err)
+		}
+		if int64(len(b)) > tc.limit {
+			t.Errorf("expected at most %d bytes to be read, got %d", tc.limit, len(b))
+		}
+	}
+}
+
+func TestExecutePlaybookMaxResponseBytes(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	var entities []v2.Entity
+	for i := 0; i < 100; i++ {
+		entities = append(entities, v2.Entity{ObjectMeta: v2.ObjectMeta{Name: fmt.Sprintf("web-%d", i)}, Subscriptions: []string{"web"}})
+	}
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, entities)
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "web"
+	config.PreviewTargets = true
+	config.DryRun = true
+	config.MaxResponseBytes = 1024
+
+	_, err := executePlaybook(nil)
+	if err == nil || !strings.Contains(err.Error(), "response body exceeds --max-response-bytes") {
+		t.Errorf("expected the oversized response to be rejected, got %v", err)
+	}
+
+	config.MaxResponseBytes = 0
+	if _, err := executePlaybook(nil); err != nil {
+		t.Errorf("expected no limit with --max-response-bytes 0, got %s", err)
+	}
+}
+
+func TestResponseErrorMaxResponseBytes(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	sensuAPI.on("POST", "/api/core/v2/namespaces/default/checks", http.StatusInternalServerError, map[string]interface{}{
+		"message": strings.Repeat("oops", 1024),
+	})
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "linux"
+	config.MaxResponseBytes = 1024
+
+	_, err := executePlaybook(nil)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected a 500 API error, got %v", err)
+	}
+	if !errors.Is(err, errResponseTooLarge) || !strings.Contains(err.Error(), "response body exceeds --max-response-bytes") {
+		t.Errorf("expected the oversized error response to be reported, got %v", err)
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "linux"
+
+	testCases := []struct {
+		userAgent string
+		expected  string
+	}{
+		{"", "sensu-runbook/" + version},
+		{"runbook-bot/1.2", "runbook-bot/1.2"},
+	}
+	for _, tc := range testCases {
+		config.UserAgent = tc.userAgent
+		if _, err := executePlaybook(nil); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		sensuAPI.mu.Lock()
+		requests := sensuAPI.requests
+		sensuAPI.requests = nil
+		sensuAPI.mu.Unlock()
+		if len(requests) == 0 {
+			t.Fatal("expected requests")
+		}
+		for _, r := range requests {
+			if got := r.Header.Get("User-Agent"); got != tc.expected {
+				t.Errorf("expected %s %s User-Agent %q, got %q", r.Method, r.Path, tc.expected, got)
+			}
+		}
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "linux"
+	config.SensuAccessToken = "secret-token"
+	config.Headers = "X-Tenant-Id: ops\nx-trace: a\n\n X-Trace:b \r\n"
+
+	if _, err := checkArgs(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, path := range []string{"/api/core/v2/namespaces/default/checks", "/api/core/v2/namespaces/default/checks/test-job/execute"} {
+		requests := sensuAPI.requestsTo("POST", path)
+		if len(requests) != 1 {
+			t.Fatalf("expected 1 POST %s request, got %d", path, len(requests))
+		}
+		header := requests[0].Header
+		if got := header.Get("X-Tenant-Id"); got != "ops" {
+			t.Errorf("expected POST %s X-Tenant-Id \"ops\", got %q", path, got)
+		}
+		if got := header["X-Trace"]; !reflect.DeepEqual(got, []string{"a", "b"}) {
+			t.Errorf("expected POST %s X-Trace [a b], got %v", path, got)
+		}
+		if got := header.Get("Authorization"); got != "Bearer secret-token" {
+			t.Errorf("expected POST %s Authorization to be kept, got %q", path, got)
+		}
+		if got := header.Get("Content-Type"); got != "application/json" {
+			t.Errorf("expected POST %s Content-Type to be kept, got %q", path, got)
+		}
+	}
+
+	for _, header := range []string{"X-Tenant-Id", "X Tenant: ops", "X-Tenant-Id: ops\rX-Evil: 1", "authorization: Bearer other", "Content-Type: text/plain"} {
+		config.Headers = header
+		if status, err := checkArgs(nil); status != sensu.CheckStateWarning || err == nil {
+			t.Errorf("expected warning for --header %q, got %d (%v)", header, status, err)
+		}
+	}
+}
+
+func TestHeadersParsing(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	tests := []struct {
+		name string
+		env  []string
+		args []string
+	}{
+		{"flag", nil, []string{"--header", "Accept: application/json, text/plain\nX-Tenant-Id: ops"}},
+		{"env", []string{"SENSU_RUNBOOK_HEADERS=Accept: application/json, text/plain\nX-Tenant-Id: ops"}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sensuAPI := newFakeSensu(t)
+			defer sensuAPI.Close()
+			args := append([]string{"--sensu-api-url", sensuAPI.URL, "--namespace", "default", "--id", "test-job", "--command", "hostname", "--subscriptions", "linux"}, test.args...)
+			if out, status := runMain(t, test.env, args...); status != sensu.CheckStateOK {
+				t.Fatalf("expected exit status %d, got %d: %s", sensu.CheckStateOK, status, out)
+			}
+			requests := sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks")
+			if len(requests) != 1 {
+				t.Fatalf("expected 1 check request, got %d", len(requests))
+			}
+			if got := requests[0].Header["Accept"]; !reflect.DeepEqual(got, []string{"application/json, text/plain"}) {
+				t.Errorf("expected Accept [application/json, text/plain], got %q", got)
+			}
+			if got := requests[0].Header["X-Tenant-Id"]; !reflect.DeepEqual(got, []string{"ops"}) {
+				t.Errorf("expected X-Tenant-Id [ops], got %q", got)
+			}
+		})
+	}
+}
+
+func TestExecutePlaybookRollbackOnFailure(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	sensuAPI.on("DELETE", "/api/core/v2/namespaces/default/checks/test-job", http.StatusNoContent, nil)
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "web"
+	config.RollbackOnFailure = true
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := len(sensuAPI.requestsTo("DELETE", "/api/core/v2/namespaces/default/checks/test-job")); n != 0 {
+		t.Errorf("expected no delete requests after a successful execution, got %d", n)
+	}
+
+	sensuAPI.on("POST", "/api/core/v2/namespaces/default/checks/test-job/execute", http.StatusInternalServerError, nil)
+	if _, err := executePlaybook(nil); err == nil || !strings.Contains(err.Error(), "failed to execute runbook job") {
+		t.Errorf("expected execute error, got %v", err)
+	}
+	if n := len(sensuAPI.requestsTo("DELETE", "/api/core/v2/namespaces/default/checks/test-job")); n != 1 {
+		t.Errorf("expected the registered runbook job to be deleted, got %d delete requests", n)
+	}
+
+	// a pre-existing check is not rolled back
+	sensuAPI.on("POST", "/api/core/v2/namespaces/default/checks", http.StatusConflict, nil)
+	if _, err := executePlaybook(nil); err == nil {
+		t.Error("expected execute error")
+	}
+	if n := len(sensuAPI.requestsTo("DELETE", "/api/core/v2/namespaces/default/checks/test-job")); n != 1 {
+		t.Errorf("expected the pre-existing runbook job to be kept, got %d delete requests", n)
+	}
+}
+
+func TestCreateJobReturnsRegisteredCheck(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	job, err := generateCheckConfig("default")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	registered := job
+	registered.ObjectMeta.CreatedBy = "admin"
+	registered.ObjectMeta.Labels = map[string]string{"sensu.io/managed_by": "sensu-runbook"}
+	sensuAPI.on("POST", "/api/core/v2/namespaces/default/checks", http.StatusCreated, registered)
+
+	created, _, err := createJob(context.Background(), sensuAPI.Client(), &job)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if created.CreatedBy != "admin" || created.Labels["sensu.io/managed_by"] != "sensu-runbook" {
+		t.Errorf("expected the registered check metadata, got %+v", created.ObjectMeta)
+	}
+
+	// the Sensu API may not include the registered check in the response
+	sensuAPI.on("POST", "/api/core/v2/namespaces/default/checks", http.StatusCreated, nil)
+	created, _, err = createJob(context.Background(), sensuAPI.Client(), &job)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if created != &job {
+		t.Errorf("expected the given check when the response has no body, got %+v", created)
+	}
+}
+
+func TestCheckArgsCommandStdin(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	defer func() { stdin = os.Stdin }()
+	config.SensuAPIUrl = "http://127.0.0.1:8080"
+	config.Namespace = "default"
+	config.Subscriptions = "linux"
+
+	script := "systemctl restart nginx\nsystemctl status nginx\n"
+	stdin = strings.NewReader(script)
+	config.Command = "-"
+	if _, err := checkArgs(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if config.Command != script {
+		t.Errorf("expected command %q, got %q", script, config.Command)
+	}
+
+	stdin = strings.NewReader(" \n")
+	config.Command = "-"
+	status, err := checkArgs(nil)
+	if status != sensu.CheckStateWarning || err == nil {
+		t.Errorf("expected warning for an empty command on stdin, got %d (%v)", status, err)
+	}
+}
+
+func TestExecutePlaybookExecuteSubscriptions(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "linux,web"
+	config.ExecuteSubscriptions = "web-canary"
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	createRequests := sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks")
+	executeRequests := sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks/test-job/execute")
+	if len(createRequests) != 1 || len(executeRequests) != 1 {
+		t.Fatalf("expected 1 create and 1 execute request, got %d and %d", len(createRequests), len(executeRequests))
+	}
+	var job v2.CheckConfig
+	createRequests[0].decode(t, &job)
+	if expected := []string{"linux", "web"}; !reflect.DeepEqual(job.Subscriptions, expected) {
+		t.Errorf("expected check subscriptions %v, got %v", expected, job.Subscriptions)
+	}
+	var jobRequest JobRequest
+	executeRequests[0].decode(t, &jobRequest)
+	if expected := []string{"web-canary"}; !reflect.DeepEqual(jobRequest.Subscriptions, expected) {
+		t.Errorf("expected execute subscriptions %v, got %v", expected, jobRequest.Subscriptions)
+	}
+}
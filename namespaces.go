@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+// labelRequirement is a single "key=value" or "key!=value" term of a
+// --namespace-selector.
+type labelRequirement struct {
+	Key    string
+	Value  string
+	Negate bool
+}
+
+// matches reports whether the labels satisfy the requirement; a missing label
+// never equals the value.
+func (r labelRequirement) matches(labels map[string]string) bool {
+	value, ok := labels[r.Key]
+	return (ok && value == r.Value) != r.Negate
+}
+
+// parseLabelSelector parses a comma-separated label selector (e.g.
+// "env=prod,tier!=db"); every requirement must be satisfied for a namespace
+// to be selected.
+func parseLabelSelector(selector string) ([]labelRequirement, error) {
+	var requirements []labelRequirement
+	for _, term := range strings.Split(selector, ",") {
+		term = strings.TrimSpace(term)
+		if len(term) == 0 {
+			continue
+		}
+		var r labelRequirement
+		var kv []string
+		if kv = strings.SplitN(term, "!=", 2); len(kv) == 2 {
+			r.Negate = true
+		} else if kv = strings.SplitN(strings.Replace(term, "==", "=", 1), "=", 2); len(kv) != 2 {
+			return nil, fmt.Errorf("invalid --namespace-selector term \"%s\" (must be key=value or key!=value)", term)
+		}
+		r.Key, r.Value = strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if len(r.Key) == 0 || strings.ContainsAny(r.Key, " =!") {
+			return nil, fmt.Errorf("invalid --namespace-selector label \"%s\"", r.Key)
+		}
+		requirements = append(requirements, r)
+	}
+	if len(requirements) == 0 {
+		return nil, fmt.Errorf("invalid --namespace-selector \"%s\": no labels", selector)
+	}
+	return requirements, nil
+}
+
+// namespaceResource is a namespace as returned by the namespaces API. Sensu
+// versions with namespace metadata return the name and labels in "metadata",
+// older versions only the (unlabeled) name.
+type namespaceResource struct {
+	Name     string        `json:"name"`
+	Metadata v2.ObjectMeta `json:"metadata"`
+}
+
+func (n namespaceResource) name() string {
+	if len(n.Metadata.Name) > 0 {
+		return n.Metadata.Name
+	}
+	return n.Name
+}
+
+// selectNamespaces returns the (sorted) names of the namespaces whose labels
+// match the selector.
+func selectNamespaces(ctx context.Context, httpClient *http.Client, selector string) ([]string, error) {
+	requirements, err := parseLabelSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	var namespaces []namespaceResource
+	if err := getAllPaginated(ctx, httpClient, apiPath("/namespaces"), &namespaces); err != nil {
+		return nil, err
+	}
+	var selected []string
+	for _, namespace := range namespaces {
+		matches := true
+		for _, r := range requirements {
+			if !r.matches(namespace.Metadata.Labels) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			selected = append(selected, namespace.name())
+		}
+	}
+	sort.Strings(selected)
+	return selected, nil
+}
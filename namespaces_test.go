@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+func TestParseLabelSelector(t *testing.T) {
+	requirements, err := parseLabelSelector("env=prod, tier!=db,region==us-east")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []labelRequirement{
+		{Key: "env", Value: "prod"},
+		{Key: "tier", Value: "db", Negate: true},
+		{Key: "region", Value: "us-east"},
+	}
+	if !reflect.DeepEqual(requirements, expected) {
+		t.Errorf("expected requirements %+v, got %+v", expected, requirements)
+	}
+	for _, selector := range []string{"", ",", "env", "=prod", "my env=prod"} {
+		if _, err := parseLabelSelector(selector); err == nil {
+			t.Errorf("expected error for selector %q", selector)
+		}
+	}
+}
+
+func TestExecutePlaybookNamespaceSelector(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	sensuAPI.on("GET", "/api/core/v2/namespaces", http.StatusOK, []map[string]interface{}{
+		{"metadata": map[string]interface{}{"name": "prod-west", "labels": map[string]string{"env": "prod", "region": "west"}}},
+		{"metadata": map[string]interface{}{"name": "staging", "labels": map[string]string{"env": "staging"}}},
+		{"metadata": map[string]interface{}{"name": "prod-east", "labels": map[string]string{"env": "prod", "region": "east"}}},
+		{"metadata": map[string]interface{}{"name": "prod-db", "labels": map[string]string{"env": "prod", "tier": "db"}}},
+		{"name": "default"},
+	})
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "systemctl restart nginx"
+	config.Subscriptions = "web"
+	config.NamespaceSelector = "env=prod,tier!=db"
+
+	if _, err := checkArgs(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, namespace := range []string{"prod-east", "prod-west"} {
+		if n := len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/"+namespace+"/checks/test-job/execute")); n != 1 {
+			t.Errorf("expected 1 execute request in namespace %s, got %d", namespace, n)
+		}
+	}
+	for _, namespace := range []string{"staging", "prod-db", "default"} {
+		if n := len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/"+namespace+"/checks")); n != 0 {
+			t.Errorf("expected no create requests in unselected namespace %s, got %d", namespace, n)
+		}
+	}
+	if requests := sensuAPI.requestsTo("GET", "/api/core/v2/namespaces"); len(requests) != 1 || requests[0].Query.Get("limit") == "" {
+		t.Errorf("expected 1 paginated namespaces request, got %+v", requests)
+	}
+	if len(config.Namespaces) != 0 {
+		t.Errorf("expected --namespaces to be restored, got %q", config.Namespaces)
+	}
+
+	config.NamespaceSelector = "env=dev"
+	status, err := executePlaybook(nil)
+	if status != sensu.CheckStateWarning || err == nil || !strings.Contains(err.Error(), "no namespaces match") {
+		t.Errorf("expected warning when no namespaces match, got %d (%v)", status, err)
+	}
+
+	config.NamespaceSelector = "env=prod"
+	config.Namespaces = "default"
+	if status, err := checkArgs(nil); status != sensu.CheckStateWarning || err == nil {
+		t.Errorf("expected warning with both --namespaces and --namespace-selector, got %d (%v)", status, err)
+	}
+}
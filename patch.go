@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+// mergePatchContentType is the content type of JSON merge patches (RFC 7386).
+const mergePatchContentType = "application/merge-patch+json"
+
+// mergePatch returns the JSON merge patch that updates the fields of existing
+// to the values in desired. Objects are compared field by field, and any other
+// changed (or added) value is replaced as a whole. Fields that are only present
+// in existing are left as-is, rather than removed.
+func mergePatch(existing map[string]interface{}, desired map[string]interface{}) map[string]interface{} {
+	patch := make(map[string]interface{})
+	for k, desiredValue := range desired {
+		existingValue, ok := existing[k]
+		existingObject, existingIsObject := existingValue.(map[string]interface{})
+		desiredObject, desiredIsObject := desiredValue.(map[string]interface{})
+		if ok && existingIsObject && desiredIsObject {
+			if sub := mergePatch(existingObject, desiredObject); len(sub) > 0 {
+				patch[k] = sub
+			}
+		} else if !ok || !reflect.DeepEqual(existingValue, desiredValue) {
+			patch[k] = desiredValue
+		}
+	}
+	return patch
+}
+
+// toJSONObject converts v to a generic JSON object.
+func toJSONObject(v interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(b, &object); err != nil {
+		return nil, err
+	}
+	return object, nil
+}
+
+// patchJob updates only the fields of the existing runbook job check that
+// differ from the given check config.
+func patchJob(ctx context.Context, httpClient *http.Client, existing *v2.CheckConfig, job *v2.CheckConfig) error {
+	existingObject, err := toJSONObject(existing)
+	if err != nil {
+		return fmt.Errorf("ERROR: %w", err)
+	}
+	desiredObject, err := toJSONObject(job)
+	if err != nil {
+		return fmt.Errorf("ERROR: %w", err)
+	}
+	patchBody, err := json.Marshal(mergePatch(existingObject, desiredObject))
+	if err != nil {
+		return fmt.Errorf("ERROR: %w", err)
+	}
+	req, err := newAPIRequest(
+		ctx,
+		"PATCH",
+		apiPath("/namespaces/%s/checks/%s", job.Namespace, job.Name),
+		bytes.NewReader(patchBody),
+	)
+	if err != nil {
+		return fmt.Errorf("ERROR: %w", err)
+	}
+	req.Header.Set("Content-Type", mergePatchContentType)
+	resp, err := doWithRetry(httpClient, req)
+	if err != nil {
+		return fmt.Errorf("ERROR: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return responseError(req, resp)
+	}
+	logger.Infof("patched runbook Job \"%s\"\n", job.Name)
+	return nil
+}
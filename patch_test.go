@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+	existing := map[string]interface{}{
+		"command":  "systemctl restart nginx",
+		"timeout":  float64(10),
+		"handlers": []interface{}{"slack"},
+		"metadata": map[string]interface{}{
+			"name":       "test-job",
+			"created_by": "admin",
+			"labels":     map[string]interface{}{"team": "web"},
+		},
+	}
+	desired := map[string]interface{}{
+		"command":  "systemctl reload nginx",
+		"timeout":  float64(10),
+		"handlers": []interface{}{"slack", "pagerduty"},
+		"metadata": map[string]interface{}{
+			"name":   "test-job",
+			"labels": map[string]interface{}{"team": "web", "tier": "frontend"},
+		},
+	}
+	expected := map[string]interface{}{
+		"command":  "systemctl reload nginx",
+		"handlers": []interface{}{"slack", "pagerduty"},
+		"metadata": map[string]interface{}{
+			"labels": map[string]interface{}{"tier": "frontend"},
+		},
+	}
+	if got := mergePatch(existing, desired); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected merge patch %v, got %v", expected, got)
+	}
+	if got := mergePatch(existing, existing); len(got) != 0 {
+		t.Errorf("expected an empty merge patch for identical objects, got %v", got)
+	}
+}
+
+func TestExecutePlaybookPatch(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "systemctl reload nginx"
+	config.Timeout = "30"
+	config.Subscriptions = "web"
+	config.Patch = true
+	job, err := generateCheckConfig("default")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	existing := job
+	existing.Command = "systemctl restart nginx"
+	existing.Timeout = 10
+	existing.ObjectMeta.CreatedBy = "admin"
+	sensuAPI.on("POST", "/api/core/v2/namespaces/default/checks", http.StatusConflict, nil)
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/checks/test-job", http.StatusOK, existing)
+	sensuAPI.on("PATCH", "/api/core/v2/namespaces/default/checks/test-job", http.StatusOK, nil)
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	requests := sensuAPI.requestsTo("PATCH", "/api/core/v2/namespaces/default/checks/test-job")
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 patch request, got %d", len(requests))
+	}
+	if got := requests[0].Header.Get("Content-Type"); got != mergePatchContentType {
+		t.Errorf("expected Content-Type %q, got %q", mergePatchContentType, got)
+	}
+	var patch map[string]interface{}
+	requests[0].decode(t, &patch)
+	expected := map[string]interface{}{
+		"command": "systemctl reload nginx",
+		"timeout": float64(30),
+	}
+	if !reflect.DeepEqual(patch, expected) {
+		t.Errorf("expected merge patch %v, got %v", expected, patch)
+	}
+	if requests := sensuAPI.requestsTo("PUT", "/api/core/v2/namespaces/default/checks/test-job"); len(requests) != 0 {
+		t.Errorf("expected no update requests with --patch, got %d", len(requests))
+	}
+}
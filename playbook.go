@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Playbook is a sequence of runbook job steps, read from a --playbook file:
+//
+//	{
+//	  "steps": [
+//	    {"name": "diagnose", "command": "df -h", "namespace": "infra"},
+//	    {"name": "cleanup", "command": "rm -rf /var/cache/nginx/*"}
+//	  ]
+//	}
+type Playbook struct {
+	Steps []PlaybookStep `json:"steps"`
+}
+
+// PlaybookStep is a single runbook job of a Playbook. Steps without a
+// namespace are run in the --namespace.
+type PlaybookStep struct {
+	Name      string `json:"name"`
+	Command   string `json:"command"`
+	Namespace string `json:"namespace"`
+}
+
+// playbook is the parsed --playbook file, if any.
+var playbook *Playbook
+
+// parsePlaybook parses and validates a playbook. Unnamed steps are named after
+// their position in the playbook (i.e. "step-1").
+func parsePlaybook(b []byte) (*Playbook, error) {
+	var p Playbook
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("invalid --playbook: %w", err)
+	}
+	if len(p.Steps) == 0 {
+		return nil, errors.New("invalid --playbook: no steps")
+	}
+	var names = make(map[string]bool)
+	for i := range p.Steps {
+		step := &p.Steps[i]
+		step.Name = strings.TrimSpace(step.Name)
+		step.Namespace = strings.TrimSpace(step.Namespace)
+		if len(step.Name) == 0 {
+			step.Name = fmt.Sprintf("step-%d", i+1)
+		}
+		if !jobIDRegex.MatchString(step.Name) {
+			return nil, fmt.Errorf("invalid --playbook step name \"%s\" (may only contain letters, numbers, \"_\", \".\", and \"-\")", step.Name)
+		}
+		if names[step.Name] {
+			return nil, fmt.Errorf("invalid --playbook: duplicate step name \"%s\"", step.Name)
+		}
+		names[step.Name] = true
+		if len(strings.TrimSpace(step.Command)) == 0 {
+			return nil, fmt.Errorf("invalid --playbook step \"%s\": no command", step.Name)
+		}
+	}
+	return &p, nil
+}
+
+// jobRun is a single runbook job to register and execute.
+type jobRun struct {
+	Namespace string
+	JobID     string
+	Command   string
+}
+
+// jobRuns returns the runbook jobs to run: one per --playbook step, or
+// otherwise one per target namespace.
+func jobRuns() []jobRun {
+	var runs []jobRun
+	if playbook == nil {
+		for _, namespace := range targetNamespaces() {
+			runs = append(runs, jobRun{Namespace: namespace, JobID: config.JobID, Command: config.Command})
+		}
+		return runs
+	}
+	for _, step := range playbook.Steps {
+		namespace := step.Namespace
+		if len(namespace) == 0 {
+			namespace = config.Namespace
+		}
+		runs = append(runs, jobRun{
+			Namespace: namespace,
+			JobID:     fmt.Sprintf("%s-%s", config.JobID, step.Name),
+			Command:   step.Command,
+		})
+	}
+	return runs
+}
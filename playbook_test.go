@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+func TestParsePlaybook(t *testing.T) {
+	p, err := parsePlaybook([]byte(`{"steps": [{"name": "diagnose", "command": "df -h", "namespace": "infra"}, {"command": "hostname"}]}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(p.Steps) != 2 || p.Steps[0].Name != "diagnose" || p.Steps[0].Namespace != "infra" || p.Steps[1].Name != "step-2" || p.Steps[1].Namespace != "" {
+		t.Errorf("unexpected playbook: %+v", p)
+	}
+
+	testCases := map[string]string{
+		"invalid json":   `{"steps": [`,
+		"no steps":       `{"steps": []}`,
+		"no command":     `{"steps": [{"name": "diagnose"}]}`,
+		"invalid name":   `{"steps": [{"name": "disk usage", "command": "df -h"}]}`,
+		"duplicate name": `{"steps": [{"name": "a", "command": "df -h"}, {"name": "a", "command": "hostname"}]}`,
+	}
+	for name, playbook := range testCases {
+		if _, err := parsePlaybook([]byte(playbook)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestExecutePlaybookPlaybookNamespaces(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	f, err := ioutil.TempFile("", "sensu-runbook-playbook")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(`{"steps": [
+  {"name": "diagnose", "command": "df -h", "namespace": "infra"},
+  {"name": "restart", "command": "systemctl restart nginx"}
+]}`); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	f.Close()
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Subscriptions = "linux"
+	config.Playbook = f.Name()
+
+	if _, err := checkArgs(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	steps := []struct {
+		namespace string
+		name      string
+		command   string
+	}{
+		{"infra", "test-job-diagnose", "df -h"},
+		{"default", "test-job-restart", "systemctl restart nginx"},
+	}
+	for _, step := range steps {
+		requests := sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/"+step.namespace+"/checks")
+		if len(requests) != 1 {
+			t.Fatalf("expected 1 create request in namespace %s, got %d", step.namespace, len(requests))
+		}
+		var job v2.CheckConfig
+		requests[0].decode(t, &job)
+		if job.Name != step.name || job.Namespace != step.namespace || job.Command != step.command {
+			t.Errorf("expected check %s/%s with command %q, got %s/%s with command %q", step.namespace, step.name, step.command, job.Namespace, job.Name, job.Command)
+		}
+		if n := len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/"+step.namespace+"/checks/"+step.name+"/execute")); n != 1 {
+			t.Errorf("expected 1 execute request for %s/%s, got %d", step.namespace, step.name, n)
+		}
+	}
+	if config.JobID != "test-job" || config.Command != "" {
+		t.Errorf("expected the job id and command to be restored, got %q and %q", config.JobID, config.Command)
+	}
+
+	config.Command = "hostname"
+	if status, err := checkArgs(nil); status != sensu.CheckStateWarning || err == nil || !strings.Contains(err.Error(), "--playbook") {
+		t.Errorf("expected warning when both --command and --playbook are set, got %d (%v)", status, err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// sleep waits for the given duration, or until the context is done.
+var sleep = func(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// executeRepeatedly requests the execution of the runbook job --repeat times,
+// --repeat-delay apart, waiting for and reporting the results of every
+// execution with --wait. With --until-success it stops at the first execution
+// that succeeds on every entity. The result records the latest execution. The
+// silences are deleted once no more results are expected. With
+// result.deferWait, the results are not waited for here, but recorded in
+// result.wait for the caller to wait for.
+func executeRepeatedly(ctx context.Context, httpClient *http.Client, job *v2.CheckConfig, targets []string, silences []*v2.Silenced, result *RunResult) (int, error) {
+	delay, err := time.ParseDuration(config.RepeatDelay)
+	if err != nil {
+		deleteSilences(httpClient, silences)
+		return sensu.CheckStateWarning, fmt.Errorf("ERROR: invalid --repeat-delay \"%s\": %w", config.RepeatDelay, err)
+	}
+	var state = sensu.CheckStateOK
+	var failed int
+	var lastErr error
+	for repeat := 1; repeat <= config.Repeat; repeat++ {
+		if repeat > 1 {
+			logger.Infof("repeating runbook job %s/%s (%d of %d) in %s\n", job.Namespace, job.Name, repeat, config.Repeat, delay)
+			if err := sleep(ctx, delay); err != nil {
+				deleteSilences(httpClient, silences)
+				return sensu.CheckStateCritical, fmt.Errorf("ERROR: stopped repeating after %d of %d executions: %w", repeat-1, config.Repeat, err)
+			}
+		}
+		started := time.Now()
+		executed, executions, err := executeJobs(ctx, httpClient, job, result.conflicted)
+		result.addTiming(stageExecute, time.Since(started))
+		result.ExecutionIDs = executionIDs(executions)
+		if err != nil {
+			if executed == 0 && !result.Executed {
+				// nothing will run, so there is nothing to silence
+				deleteSilences(httpClient, silences)
+			}
+			return sensu.CheckStateCritical, &stageError{Stage: stageExecute, Err: err}
+		}
+		result.Executed = true
+		if !config.Wait {
+			continue
+		} else if result.deferWait {
+			result.wait = newJobWait(job, targets, started, issuedAt(executions))
+			continue
+		}
+		result.Entities = []EntityResult{}
+		result.MissingEntities = []string{}
+		result.RawEvents = nil
+		waitStarted := time.Now()
+		status, err := waitAndReport(ctx, httpClient, job, targets, started, issuedAt(executions), result)
+		result.addTiming(stageWait, time.Since(waitStarted))
+		if err == nil && config.UntilSuccess {
+			deleteSilences(httpClient, silences)
+			return sensu.CheckStateOK, nil
+		} else if err != nil {
+			failed++
+			lastErr = err
+		}
+		if status > state {
+			state = status
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if config.Wait {
+		deleteSilences(httpClient, silences)
+	}
+	if failed == 0 || config.Repeat == 1 {
+		return state, lastErr
+	}
+	if config.UntilSuccess {
+		return state, fmt.Errorf("ERROR: runbook job did not succeed in %d executions: %w", config.Repeat, unprefixed(lastErr))
+	}
+	return state, fmt.Errorf("ERROR: runbook job failed in %d of %d executions: %w", failed, config.Repeat, unprefixed(lastErr))
+}
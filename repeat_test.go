@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// fakeSleep replaces sleep with a fake clock that records the requested
+// delays without sleeping; the returned function restores it.
+func fakeSleep(delays *[]time.Duration) func() {
+	realSleep := sleep
+	sleep = func(ctx context.Context, d time.Duration) error {
+		*delays = append(*delays, d)
+		return ctx.Err()
+	}
+	return func() {
+		sleep = realSleep
+	}
+}
+
+func TestExecutePlaybookRepeat(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	var delays []time.Duration
+	defer fakeSleep(&delays)()
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "systemctl is-active nginx"
+	config.Subscriptions = "web"
+	config.Repeat = 3
+	config.RepeatDelay = "10s"
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks/test-job/execute")); n != 3 {
+		t.Errorf("expected 3 execute requests, got %d", n)
+	}
+	if n := len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks")); n != 1 {
+		t.Errorf("expected the runbook job to be registered once, got %d create requests", n)
+	}
+	if expected := []time.Duration{10 * time.Second, 10 * time.Second}; !reflect.DeepEqual(delays, expected) {
+		t.Errorf("expected delays %v, got %v", expected, delays)
+	}
+}
+
+func TestExecutePlaybookRepeatUntilSuccess(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	var delays []time.Duration
+	defer fakeSleep(&delays)()
+	config.PollInterval = "1ms"
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "web-1"}, Subscriptions: []string{"web"}},
+	})
+	// the service is down for the first two executions
+	sensuAPI.handle("GET", "/api/core/v2/namespaces/default/events", func(w http.ResponseWriter, r *http.Request) {
+		var status uint32 = 2
+		if len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks/test-job/execute")) > 2 {
+			status = 0
+		}
+		writeJSON(t, w, []v2.Event{jobEvent("web-1", "test-job", status, "")})
+	})
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "systemctl is-active nginx"
+	config.Subscriptions = "web"
+	config.Wait = true
+	config.Repeat = 5
+	config.RepeatDelay = "1m"
+	config.UntilSuccess = true
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks/test-job/execute")); n != 3 {
+		t.Errorf("expected to stop after the first successful execution (3), got %d", n)
+	}
+	if expected := []time.Duration{time.Minute, time.Minute}; !reflect.DeepEqual(delays, expected) {
+		t.Errorf("expected delays %v, got %v", expected, delays)
+	}
+
+	config.Repeat = 2
+	unhealthy := newFakeSensu(t)
+	defer unhealthy.Close()
+	unhealthy.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "web-1"}, Subscriptions: []string{"web"}},
+	})
+	unhealthy.on("GET", "/api/core/v2/namespaces/default/events", http.StatusOK, []v2.Event{jobEvent("web-1", "test-job", 2, "")})
+	status, err := executePlaybook(nil)
+	if status != sensu.CheckStateCritical {
+		t.Errorf("expected status %d, got %d", sensu.CheckStateCritical, status)
+	}
+	if err == nil || !strings.HasPrefix(err.Error(), "ERROR: runbook job did not succeed in 2 executions: ") {
+		t.Errorf("expected did not succeed error, got %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+	"gopkg.in/yaml.v3"
+)
+
+// RunResult is the result of the runbook job in a single namespace, as
+// printed by --output json.
+type RunResult struct {
+	JobID         string   `json:"job_id" yaml:"job_id"`
+	Namespace     string   `json:"namespace" yaml:"namespace"`
+	Command       string   `json:"command" yaml:"command"`
+	Subscriptions []string `json:"subscriptions" yaml:"subscriptions"`
+	Created       bool     `json:"created" yaml:"created"`
+	Executed      bool     `json:"executed" yaml:"executed"`
+	// Reason is the --reason the runbook job was run for, if any
+	Reason string `json:"reason,omitempty" yaml:"reason,omitempty"`
+	// Backend is the --sensu-api-url backend that served the requests, when
+	// several backends are configured
+	Backend string `json:"backend,omitempty" yaml:"backend,omitempty"`
+	// ExecutionIDs correlate the latest execution requests with their events
+	// (i.e. the check.issued time), when returned by the Sensu API
+	ExecutionIDs []string       `json:"execution_ids,omitempty" yaml:"execution_ids,omitempty"`
+	Entities     []EntityResult `json:"entities" yaml:"entities"`
+	// MissingEntities are the entities that did not report a result before
+	// --wait timed out
+	MissingEntities []string `json:"missing_entities" yaml:"missing_entities"`
+	// RawEvents are the unmodified events reported by the entities, with
+	// --raw-events (which requires --output json)
+	RawEvents []json.RawMessage `json:"raw_events,omitempty" yaml:"-"`
+	Error     string            `json:"error" yaml:"error"`
+	// Timings are the durations of the create, execute, and wait stages of
+	// the runbook job, in milliseconds (summed over --repeat executions)
+	Timings map[string]float64 `json:"timings,omitempty" yaml:"timings,omitempty"`
+	// Warnings are non-fatal problems, e.g. failing to write the --result-file
+	Warnings []string `json:"warnings,omitempty" yaml:"warnings,omitempty"`
+
+	// state is the check state of the runbook job
+	state int
+	// deferWait is true if the results are waited for along with those of
+	// the other namespaces (see concurrentWait), in which case wait is set
+	// once the runbook job is executed
+	deferWait bool
+	wait      *jobWait
+	// conflicted is true if the runbook job already existed when it was
+	// registered (409 Conflict), e.g. by a concurrent invocation
+	conflicted bool
+}
+
+// EntityResult is the runbook job result reported by a single entity. Entity
+// results are only collected with --wait.
+type EntityResult struct {
+	Name   string `json:"name" yaml:"name"`
+	Status uint32 `json:"status" yaml:"status"`
+	Output string `json:"output" yaml:"output"`
+}
+
+// newRunResult returns the result of the runbook job in the given namespace,
+// before it is registered or executed.
+func newRunResult(namespace string) *RunResult {
+	return &RunResult{
+		JobID:           config.JobID,
+		Namespace:       namespace,
+		Command:         config.Command,
+		Subscriptions:   executionSubscriptions(),
+		Reason:          config.Reason,
+		Entities:        []EntityResult{},
+		MissingEntities: []string{},
+	}
+}
+
+// recordBackend records the backend serving the requests of the runbook job,
+// if there are several to fail over to.
+func (r *RunResult) recordBackend() {
+	if len(sensuAPIUrls()) > 1 {
+		r.Backend = currentBackend()
+	}
+}
+
+// addTiming records the duration of a stage of the runbook job.
+func (r *RunResult) addTiming(stage string, d time.Duration) {
+	if r.Timings == nil {
+		r.Timings = make(map[string]float64)
+	}
+	r.Timings[stage] += float64(d) / float64(time.Millisecond)
+}
+
+// setError records the error of the runbook job, if any.
+func (r *RunResult) setError(err error) {
+	if err != nil {
+		r.Error = strings.TrimPrefix(err.Error(), "ERROR: ")
+	}
+}
+
+// writeResults prints the results as a JSON array, with one RunResult per
+// namespace.
+func writeResults(w io.Writer, results []*RunResult) error {
+	if results == nil {
+		results = []*RunResult{}
+	}
+	b, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// writeYAMLResults prints the results as a YAML sequence, with the same fields
+// as the JSON results.
+func writeYAMLResults(w io.Writer, results []*RunResult) error {
+	if results == nil {
+		results = []*RunResult{}
+	}
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(results); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// writeResultFile writes the results as JSON to the given path, creating its
+// parent directories.
+func writeResultFile(path string, results []*RunResult) error {
+	var b bytes.Buffer
+	if err := writeResults(&b, results); err != nil {
+		return fmt.Errorf("failed to write --result-file: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to write --result-file: %w", err)
+	}
+	if err := ioutil.WriteFile(path, b.Bytes(), 0600); err != nil {
+		return fmt.Errorf("failed to write --result-file: %w", err)
+	}
+	return nil
+}
+
+// stateNames are the names of the check states, as printed in the summary.
+var stateNames = map[int]string{
+	sensu.CheckStateOK:       "OK",
+	sensu.CheckStateWarning:  "WARNING",
+	sensu.CheckStateCritical: "CRITICAL",
+	sensu.CheckStateUnknown:  "UNKNOWN",
+}
+
+// writeSummary prints a machine-parseable summary line for every result, e.g.:
+//
+//	RESULT job_id=restart-nginx namespace=default status=OK created=true executed=true entities_ok=3 entities_failed=0
+func writeSummary(w io.Writer, results []*RunResult) {
+	for _, r := range results {
+		var ok, failed int
+		for _, entity := range r.Entities {
+			if entity.Status == 0 {
+				ok++
+			} else {
+				failed++
+			}
+		}
+		state, found := stateNames[r.state]
+		if !found {
+			state = stateNames[sensu.CheckStateUnknown]
+		}
+		fmt.Fprintf(w, "RESULT job_id=%s namespace=%s status=%s created=%t executed=%t entities_ok=%d entities_failed=%d\n",
+			r.JobID, r.Namespace, state, r.Created, r.Executed, ok, failed)
+	}
+}
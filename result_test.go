@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+	"gopkg.in/yaml.v3"
+)
+
+func TestExecutePlaybookJSONOutputUnexpectedStatus(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	var out, logs bytes.Buffer
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	logger.SetOutput(&logs)
+	defer logger.SetOutput(os.Stderr)
+	// nothing may be printed to the process stdout other than the results
+	processStdout, err := ioutil.TempFile("", "stdout")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.Remove(processStdout.Name())
+	defer func(f *os.File) { os.Stdout = f }(os.Stdout)
+	os.Stdout = processStdout
+	// 2xx responses other than the expected 201 Created and 202 Accepted
+	sensuAPI.on("POST", "/api/core/v2/namespaces/default/checks", http.StatusOK, "registered")
+	sensuAPI.on("POST", "/api/core/v2/namespaces/default/checks/test-job/execute", http.StatusOK, "executed")
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "linux"
+	config.Output = outputJSON
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var results []RunResult
+	if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+		t.Errorf("failed to decode output %q: %s", out.String(), err)
+	}
+	if b, _ := ioutil.ReadFile(processStdout.Name()); len(b) > 0 {
+		t.Errorf("expected nothing else on stdout, got %q", b)
+	}
+	for _, body := range []string{"registered", "executed"} {
+		if !strings.Contains(logs.String(), body) {
+			t.Errorf("expected the %q response body to be logged, got %q", body, logs.String())
+		}
+	}
+}
+
+func TestExecutePlaybookJSONOutput(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	config.PollInterval = "1ms"
+	var out bytes.Buffer
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "web-1"}, Subscriptions: []string{"web"}},
+	})
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/events", http.StatusOK, []v2.Event{
+		jobEvent("web-1", "test-job", 0, "restarted\n"),
+	})
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "systemctl restart nginx"
+	config.Subscriptions = "web"
+	config.Output = outputJSON
+	config.Wait = true
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var fields []map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &fields); err != nil {
+		t.Fatalf("failed to decode output %q: %s", out.String(), err)
+	}
+	if len(fields) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(fields))
+	}
+	for _, field := range []string{"job_id", "namespace", "command", "subscriptions", "created", "executed", "entities", "missing_entities", "error", "timings"} {
+		if _, ok := fields[0][field]; !ok {
+			t.Errorf("expected result field %q, got %v", field, fields[0])
+		}
+	}
+	var results []RunResult
+	if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+		t.Fatalf("failed to decode output %q: %s", out.String(), err)
+	}
+	expected := RunResult{
+		JobID:           "test-job",
+		Namespace:       "default",
+		Command:         "systemctl restart nginx",
+		Subscriptions:   []string{"web"},
+		Created:         true,
+		Executed:        true,
+		Entities:        []EntityResult{{Name: "web-1", Status: 0, Output: "restarted\n"}},
+		MissingEntities: []string{},
+	}
+	// the timings vary (see TestExecutePlaybookTimings)
+	results[0].Timings = nil
+	if !reflect.DeepEqual(results[0], expected) {
+		t.Errorf("expected result %+v, got %+v", expected, results[0])
+	}
+
+	out.Reset()
+	sensuAPI.on("POST", "/api/core/v2/namespaces/default/checks/test-job/execute", http.StatusInternalServerError, nil)
+	if _, err := executePlaybook(nil); err == nil {
+		t.Fatal("expected error")
+	}
+	results = nil
+	if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+		t.Fatalf("failed to decode output %q: %s", out.String(), err)
+	}
+	if len(results) != 1 || !results[0].Created || results[0].Executed || len(results[0].Error) == 0 || len(results[0].Entities) != 0 {
+		t.Errorf("expected a created but not executed result with an error, got %+v", results)
+	}
+}
+
+func TestExecutePlaybookYAMLOutput(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	config.PollInterval = "1ms"
+	var out bytes.Buffer
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "web-1"}, Subscriptions: []string{"web"}},
+		{ObjectMeta: v2.ObjectMeta{Name: "web-2"}, Subscriptions: []string{"web"}},
+	})
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/events", http.StatusOK, []v2.Event{
+		jobEvent("web-1", "test-job", 0, "restarted\nnginx: ok\n"),
+		jobEvent("web-2", "test-job", 2, "failed: \"nginx\" not found"),
+	})
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "systemctl restart nginx"
+	config.Subscriptions = "web"
+	config.Output = outputYAML
+	config.Wait = true
+
+	if _, err := executePlaybook(nil); err == nil {
+		t.Fatal("expected the failure on web-2")
+	}
+	var fields []map[string]interface{}
+	if err := yaml.Unmarshal(out.Bytes(), &fields); err != nil {
+		t.Fatalf("failed to decode output %q: %s", out.String(), err)
+	}
+	if len(fields) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(fields))
+	}
+	for _, field := range []string{"job_id", "namespace", "command", "subscriptions", "created", "executed", "entities", "missing_entities", "error", "timings"} {
+		if _, ok := fields[0][field]; !ok {
+			t.Errorf("expected result field %q, got %v", field, fields[0])
+		}
+	}
+	var results []RunResult
+	if err := yaml.Unmarshal(out.Bytes(), &results); err != nil {
+		t.Fatalf("failed to decode output %q: %s", out.String(), err)
+	}
+	expected := RunResult{
+		JobID:         "test-job",
+		Namespace:     "default",
+		Command:       "systemctl restart nginx",
+		Subscriptions: []string{"web"},
+		Created:       true,
+		Executed:      true,
+		Entities: []EntityResult{
+			{Name: "web-1", Status: 0, Output: "restarted\nnginx: ok\n"},
+			{Name: "web-2", Status: 2, Output: "failed: \"nginx\" not found"},
+		},
+		MissingEntities: []string{},
+		Error:           "runbook job failed on 1 of 2 entities: web-2",
+	}
+	// the timings vary (see TestExecutePlaybookTimings)
+	results[0].Timings = nil
+	if !reflect.DeepEqual(results[0], expected) {
+		t.Errorf("expected result %+v, got %+v", expected, results[0])
+	}
+}
+
+func TestExecutePlaybookTimings(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	config.PollInterval = "1ms"
+	var out bytes.Buffer
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "web-1"}, Subscriptions: []string{"web"}},
+	})
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/events", http.StatusOK, []v2.Event{
+		jobEvent("web-1", "test-job", 0, ""),
+	})
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "systemctl restart nginx"
+	config.Subscriptions = "web"
+	config.Output = outputJSON
+	config.Wait = true
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var results []RunResult
+	if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+		t.Fatalf("failed to decode output %q: %s", out.String(), err)
+	}
+	for _, stage := range []string{stageCreate, stageExecute, stageWait} {
+		if d, ok := results[0].Timings[stage]; !ok || d <= 0 {
+			t.Errorf("expected a positive %s timing, got %v", stage, results[0].Timings)
+		}
+	}
+
+	out.Reset()
+	config.Output = outputMetrics
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, stage := range []string{stageCreate, stageExecute, stageWait} {
+		if prefix := "runbook_stage_duration_milliseconds{stage=\"" + stage + "\"} "; !strings.Contains(out.String(), prefix) {
+			t.Errorf("expected metric %q in output:\n%s", prefix, out.String())
+		}
+	}
+}
+
+func TestExecutePlaybookRawEvents(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	config.PollInterval = "1ms"
+	var out bytes.Buffer
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "web-1"}, Subscriptions: []string{"web"}},
+	})
+	// the event includes a field unknown to the v2.Event type, and an output
+	// longer than --max-output-bytes
+	events := fmt.Sprintf(`[{"entity": {"metadata": {"name": "web-1"}}, "check": {"metadata": {"name": "test-job"}, "status": 0, "output": "restarted nginx\n", "executed": %d}, "sequence": 7, "extra": {"a": 1}}]`, time.Now().Unix())
+	sensuAPI.handle("GET", "/api/core/v2/namespaces/default/events", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, events)
+	})
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "systemctl restart nginx"
+	config.Subscriptions = "web"
+	config.Output = outputJSON
+	config.Wait = true
+	config.MaxOutputBytes = 9
+	config.RawEvents = true
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var results []struct {
+		Entities  []EntityResult `json:"entities"`
+		RawEvents []interface{}  `json:"raw_events"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+		t.Fatalf("failed to decode output %q: %s", out.String(), err)
+	}
+	var expected []interface{}
+	if err := json.Unmarshal([]byte(events), &expected); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(results) != 1 || !reflect.DeepEqual(results[0].RawEvents, expected) {
+		t.Fatalf("expected raw events %v, got %+v", expected, results)
+	}
+	if output := results[0].Entities[0].Output; output != "restarted...[truncated 7 bytes]" {
+		t.Errorf("expected the entity output to be truncated, got %q", output)
+	}
+
+	out.Reset()
+	config.RawEvents = false
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if strings.Contains(out.String(), "raw_events") {
+		t.Errorf("expected no raw events without --raw-events, got %s", out.String())
+	}
+}
+
+func TestExecutePlaybookExecutionIDs(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	var out bytes.Buffer
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "systemctl restart nginx"
+	config.Subscriptions = "web"
+	config.Output = outputJSON
+
+	testCases := []struct {
+		body     interface{}
+		expected []string
+	}{
+		{map[string]interface{}{"id": "exec-123", "issued": 1700000000}, []string{"exec-123"}},
+		{map[string]interface{}{"issued": 1700000000}, []string{"1700000000"}},
+		{nil, nil},
+	}
+	for _, tc := range testCases {
+		out.Reset()
+		sensuAPI.on("POST", "/api/core/v2/namespaces/default/checks/test-job/execute", http.StatusAccepted, tc.body)
+		if _, err := executePlaybook(nil); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		var results []RunResult
+		if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+			t.Fatalf("failed to decode output %q: %s", out.String(), err)
+		}
+		if len(results) != 1 || !reflect.DeepEqual(results[0].ExecutionIDs, tc.expected) {
+			t.Errorf("expected execution ids %v for response %v, got %+v", tc.expected, tc.body, results)
+		}
+	}
+}
+
+func TestExecutePlaybookResultFile(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	var out bytes.Buffer
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	dir, err := ioutil.TempDir("", "sensu-runbook-results")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "systemctl restart nginx"
+	config.Subscriptions = "web"
+	config.Output = outputJSON
+	config.ResultFile = filepath.Join(dir, "audit", "2026", "result.json")
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	b, err := ioutil.ReadFile(config.ResultFile)
+	if err != nil {
+		t.Fatalf("expected the result file to be written: %s", err)
+	}
+	var written, printed []RunResult
+	if err := json.Unmarshal(b, &written); err != nil {
+		t.Fatalf("failed to decode result file %q: %s", b, err)
+	}
+	if err := json.Unmarshal(out.Bytes(), &printed); err != nil {
+		t.Fatalf("failed to decode output %q: %s", out.String(), err)
+	}
+	if len(written) != 1 || !written[0].Created || !written[0].Executed || !reflect.DeepEqual(written, printed) {
+		t.Errorf("expected the result file to match the printed results %+v, got %+v", printed, written)
+	}
+
+	// the parent "directory" is a file
+	out.Reset()
+	config.ResultFile = filepath.Join(config.ResultFile, "result.json")
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("expected a result file write failure not to fail the runbook job, got %s", err)
+	}
+	printed = nil
+	if err := json.Unmarshal(out.Bytes(), &printed); err != nil {
+		t.Fatalf("failed to decode output %q: %s", out.String(), err)
+	}
+	if len(printed) != 1 || len(printed[0].Warnings) != 1 || !strings.Contains(printed[0].Warnings[0], "failed to write --result-file") {
+		t.Errorf("expected a result file warning, got %+v", printed)
+	}
+}
+
+func TestExecutePlaybookSummary(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	config.PollInterval = "1ms"
+	var out bytes.Buffer
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "web-1"}, Subscriptions: []string{"web"}},
+		{ObjectMeta: v2.ObjectMeta{Name: "web-2"}, Subscriptions: []string{"web"}},
+		{ObjectMeta: v2.ObjectMeta{Name: "web-3"}, Subscriptions: []string{"web"}},
+	})
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/events", http.StatusOK, []v2.Event{
+		jobEvent("web-1", "test-job", 0, "ok"),
+		jobEvent("web-2", "test-job", 0, "ok"),
+		jobEvent("web-3", "test-job", 0, "ok"),
+	})
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "systemctl restart nginx"
+	config.Subscriptions = "web"
+	config.Wait = true
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	expected := "RESULT job_id=test-job namespace=default status=OK created=true executed=true entities_ok=3 entities_failed=0"
+	if got := lines[len(lines)-1]; got != expected {
+		t.Errorf("expected summary line %q, got %q", expected, got)
+	}
+}
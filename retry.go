@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// retryBaseDelay is the backoff before the first retry of a request,
+	// doubling with every further retry up to retryMaxDelay.
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+
+	// conflictRetries is the number of times an execute request is retried
+	// when it fails with 404 Not Found for a runbook job that was registered
+	// concurrently (see executeJob), conflictRetryDelay apart.
+	conflictRetries    = 3
+	conflictRetryDelay = 250 * time.Millisecond
+)
+
+// retryRand is the source of the retry backoff jitter. It is seeded from the
+// clock, so that concurrent sensu-runbook invocations don't retry in lockstep;
+// tests seed it with a fixed value for deterministic delays.
+var retryRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+var retryRandMu sync.Mutex
+
+// retryDelay returns the backoff before the given retry (starting at 1), with
+// full jitter: a random duration between 0 and the exponential backoff.
+func retryDelay(retry int) time.Duration {
+	backoff := retryMaxDelay
+	if retry <= 6 {
+		backoff = retryBaseDelay << uint(retry-1)
+	}
+	if backoff > retryMaxDelay {
+		backoff = retryMaxDelay
+	}
+	retryRandMu.Lock()
+	defer retryRandMu.Unlock()
+	return time.Duration(retryRand.Int63n(int64(backoff) + 1))
+}
+
+// retryable reports whether a request failed transiently, i.e. with a network
+// error or a response indicating that the backend is (temporarily)
+// unavailable or overloaded.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryAfter returns the delay requested by the Retry-After header of the
+// response (in seconds, or as an HTTP-date), e.g. by a rate limiting gateway
+// responding with 429 Too Many Requests. The delay is capped at retryMaxDelay,
+// so that a misbehaving server cannot stall the runbook job indefinitely.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	header := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if len(header) == 0 {
+		return 0, false
+	}
+	var delay time.Duration
+	if seconds, err := strconv.ParseInt(header, 10, 64); err == nil || errors.Is(err, strconv.ErrRange) {
+		if seconds < 0 {
+			return 0, false
+		} else if err != nil || seconds > int64(retryMaxDelay/time.Second) {
+			return retryMaxDelay, true
+		}
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		delay = time.Until(date)
+	} else {
+		return 0, false
+	}
+	if delay < 0 {
+		delay = 0
+	} else if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay, true
+}
+
+// doWithRetry sends the request, retrying transient failures up to --retries
+// times with a jittered exponential backoff. A request that cannot connect to
+// its --sensu-api-url backend is first sent to the next backend (if any),
+// without counting as a retry, and a Retry-After header of the response takes
+// precedence over the backoff. The request body is replayed for every
+// attempt, reading the response body fails once it exceeds
+// --max-response-bytes, and every attempt is logged with --verbose.
+func doWithRetry(httpClient *http.Client, req *http.Request) (*http.Response, error) {
+	for attempt, retry := 0, 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+		if config.Verbose {
+			logRequest(req)
+		}
+		resp, err := httpClient.Do(req)
+		if err == nil && config.MaxResponseBytes > 0 {
+			resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: int64(config.MaxResponseBytes)}
+		}
+		if config.Verbose {
+			if err != nil {
+				logger.Debugf("< %s %s: %s\n", req.Method, req.URL.Path, err)
+			} else {
+				logResponse(req, resp)
+			}
+		}
+		if err != nil && connectFailed(err) && req.Context().Err() == nil {
+			if from := backendOf(req.URL); len(from) > 0 {
+				if to, ok := failover(from); ok {
+					if err := rebase(req, from, to); err != nil {
+						return nil, err
+					}
+					logger.Warnf("cannot connect to the Sensu API at %s: %s; failing over to %s\n", from, err, to)
+					continue
+				}
+			}
+		}
+		if retry >= config.Retries || !retryable(resp, err) || req.Context().Err() != nil {
+			return resp, err
+		}
+		var reason string
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		retry++
+		delay := retryDelay(retry)
+		if err == nil {
+			if after, ok := retryAfter(resp); ok {
+				delay = after
+				reason += " (Retry-After)"
+			}
+		}
+		logger.Warnf("%s %s: %s; retrying in %s (%d of %d)\n", req.Method, req.URL.Path, reason, delay, retry, config.Retries)
+		if err := sleep(req.Context(), delay); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	defer func(r *rand.Rand) { retryRand = r }(retryRand)
+	bounds := []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second}
+
+	retryRand = rand.New(rand.NewSource(1))
+	var delays []time.Duration
+	for i, bound := range bounds {
+		delay := retryDelay(i + 1)
+		if delay < 0 || delay > bound {
+			t.Errorf("expected retry %d delay between 0 and %s, got %s", i+1, bound, delay)
+		}
+		delays = append(delays, delay)
+	}
+	// the same seed produces the same delays
+	retryRand = rand.New(rand.NewSource(1))
+	for i, delay := range delays {
+		if got := retryDelay(i + 1); got != delay {
+			t.Errorf("expected retry %d delay %s with the same seed, got %s", i+1, delay, got)
+		}
+	}
+	jittered := false
+	for i, delay := range delays {
+		jittered = jittered || delay != bounds[i]
+	}
+	if !jittered {
+		t.Errorf("expected jittered delays, got %v", delays)
+	}
+}
+
+func TestExecutePlaybookRetries(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	var delays []time.Duration
+	defer fakeSleep(&delays)()
+	defer func(r *rand.Rand) { retryRand = r }(retryRand)
+	retryRand = rand.New(rand.NewSource(1))
+	// the backend is unavailable for the first two attempts
+	sensuAPI.handle("POST", "/api/core/v2/namespaces/default/checks", func(w http.ResponseWriter, r *http.Request) {
+		if len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks")) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "linux"
+	config.Retries = 3
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	requests := sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks")
+	if len(requests) != 3 {
+		t.Fatalf("expected 3 create requests, got %d", len(requests))
+	}
+	if string(requests[2].Body) != string(requests[0].Body) || len(requests[2].Body) == 0 {
+		t.Errorf("expected the request body to be replayed, got %q", requests[2].Body)
+	}
+	if len(delays) != 2 || delays[0] > 500*time.Millisecond || delays[1] > time.Second {
+		t.Errorf("expected 2 jittered delays within the backoff, got %v", delays)
+	}
+
+	config.Retries = 1
+	sensuAPI.on("POST", "/api/core/v2/namespaces/default/checks", http.StatusServiceUnavailable, nil)
+	if _, err := executePlaybook(nil); err == nil {
+		t.Error("expected error once the retries are exhausted")
+	}
+	if n := len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks")); n != 5 {
+		t.Errorf("expected 1 retry (5 create requests in total), got %d", n)
+	}
+}
+
+func TestExecutePlaybookConflictRetry(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	var delays []time.Duration
+	defer fakeSleep(&delays)()
+	// another invocation registered the runbook job, but it is not
+	// persisted by the time of the first execute request
+	sensuAPI.on("POST", "/api/core/v2/namespaces/default/checks", http.StatusConflict, nil)
+	sensuAPI.handle("POST", "/api/core/v2/namespaces/default/checks/test-job/execute", func(w http.ResponseWriter, r *http.Request) {
+		if len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks/test-job/execute")) <= 1 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "linux"
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks/test-job/execute")); n != 2 {
+		t.Errorf("expected 2 execute requests, got %d", n)
+	}
+	if len(delays) != 1 || delays[0] != conflictRetryDelay {
+		t.Errorf("expected 1 delay of %s, got %v", conflictRetryDelay, delays)
+	}
+
+	// the retries are bounded
+	delays = nil
+	sensuAPI.on("POST", "/api/core/v2/namespaces/default/checks/test-job/execute", http.StatusNotFound, nil)
+	if _, err := executePlaybook(nil); err == nil {
+		t.Error("expected error once the retries are exhausted")
+	}
+	if n := len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks/test-job/execute")); n != 2+conflictRetries+1 {
+		t.Errorf("expected %d retries (%d execute requests in total), got %d", conflictRetries, 2+conflictRetries+1, n)
+	}
+
+	// a 404 is not retried for a runbook job registered by this invocation
+	delays = nil
+	sensuAPI.on("POST", "/api/core/v2/namespaces/default/checks", http.StatusCreated, nil)
+	if _, err := executePlaybook(nil); err == nil {
+		t.Error("expected error")
+	}
+	if len(delays) != 0 {
+		t.Errorf("expected no retries, got delays %v", delays)
+	}
+}
+
+func TestExecutePlaybookRetryAfter(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	var delays []time.Duration
+	defer fakeSleep(&delays)()
+	// the gateway rate limits the first attempt
+	sensuAPI.handle("POST", "/api/core/v2/namespaces/default/checks", func(w http.ResponseWriter, r *http.Request) {
+		if len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks")) <= 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "linux"
+	config.Retries = 3
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := len(sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks")); n != 2 {
+		t.Errorf("expected 2 create requests, got %d", n)
+	}
+	if expected := []time.Duration{time.Second}; !reflect.DeepEqual(delays, expected) {
+		t.Errorf("expected the Retry-After delay %v, got %v", expected, delays)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	date := time.Now().Add(20 * time.Second).UTC().Format(http.TimeFormat)
+	tests := []struct {
+		header string
+		min    time.Duration
+		max    time.Duration
+		ok     bool
+	}{
+		{"", 0, 0, false},
+		{"5", 5 * time.Second, 5 * time.Second, true},
+		{"-1", 0, 0, false},
+		{date, 18 * time.Second, 20 * time.Second, true},
+		{"Mon, 02 Jan 2006 15:04:05 GMT", 0, 0, true},
+		// oversized delays are capped
+		{"86400", retryMaxDelay, retryMaxDelay, true},
+		{"99999999999999999999", retryMaxDelay, retryMaxDelay, true},
+		{time.Now().Add(24 * time.Hour).UTC().Format(http.TimeFormat), retryMaxDelay, retryMaxDelay, true},
+		{"soon", 0, 0, false},
+	}
+	for _, test := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if len(test.header) > 0 {
+			resp.Header.Set("Retry-After", test.header)
+		}
+		delay, ok := retryAfter(resp)
+		if ok != test.ok || delay < test.min || delay > test.max {
+			t.Errorf("expected Retry-After %q to be between %s and %s (%t), got %s (%t)", test.header, test.min, test.max, test.ok, delay, ok)
+		}
+	}
+}
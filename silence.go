@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+// generateSilences builds the silencing entries for the runbook job: one entry
+// per targeted subscription, silencing --silence-check (or every check when
+// empty) until --silence-expire elapses.
+func generateSilences(job *v2.CheckConfig) ([]*v2.Silenced, error) {
+	expire, err := time.ParseDuration(config.SilenceExpire)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --silence-expire \"%s\": %w", config.SilenceExpire, err)
+	}
+	var silences []*v2.Silenced
+	for _, subscription := range executionSubscriptions() {
+		name, err := v2.SilencedName(subscription, config.SilenceCheck)
+		if err != nil {
+			return nil, err
+		}
+		silences = append(silences, &v2.Silenced{
+			ObjectMeta: v2.ObjectMeta{
+				Name:      name,
+				Namespace: job.Namespace,
+			},
+			Subscription: subscription,
+			Check:        config.SilenceCheck,
+			Expire:       int64(expire.Seconds()),
+			Creator:      config.Name,
+			Reason:       fmt.Sprintf("runbook job %s/%s", job.Namespace, job.Name),
+		})
+	}
+	return silences, nil
+}
+
+func createSilence(ctx context.Context, httpClient *http.Client, silence *v2.Silenced) error {
+	postBody, err := json.Marshal(silence)
+	if err != nil {
+		return fmt.Errorf("ERROR: %w", err)
+	}
+	req, err := newAPIRequest(
+		ctx,
+		"POST",
+		apiPath("/namespaces/%s/silenced", silence.Namespace),
+		bytes.NewReader(postBody),
+	)
+	if err != nil {
+		return fmt.Errorf("ERROR: %w", err)
+	}
+	resp, err := doWithRetry(httpClient, req)
+	if err != nil {
+		return fmt.Errorf("ERROR: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return responseError(req, resp)
+	}
+	logger.Infof("created silencing entry \"%s\" (expires in %ds)\n", silence.Name, silence.Expire)
+	return nil
+}
+
+func deleteSilence(ctx context.Context, httpClient *http.Client, silence *v2.Silenced) error {
+	req, err := newAPIRequest(
+		ctx,
+		"DELETE",
+		apiPath("/namespaces/%s/silenced/%s", silence.Namespace, url.PathEscape(silence.Name)),
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("ERROR: %w", err)
+	}
+	resp, err := doWithRetry(httpClient, req)
+	if err != nil {
+		return fmt.Errorf("ERROR: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode != 404 {
+		return responseError(req, resp)
+	}
+	logger.Infof("deleted silencing entry \"%s\"\n", silence.Name)
+	return nil
+}
+
+// deleteSilences deletes the given silencing entries, logging any failures.
+// The entries are deleted even when the operation context is done (e.g. the
+// --deadline was exceeded), as they would otherwise outlive the runbook job.
+func deleteSilences(httpClient *http.Client, silences []*v2.Silenced) {
+	for _, silence := range silences {
+		if err := deleteSilence(context.Background(), httpClient, silence); err != nil {
+			logger.Errorf("failed to delete silencing entry \"%s\": %s\n", silence.Name, err)
+		}
+	}
+}
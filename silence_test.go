@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+func TestExecutePlaybookSilence(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	sensuAPI.on("POST", "/api/core/v2/namespaces/default/silenced", http.StatusCreated, nil)
+	sensuAPI.on("DELETE", "/api/core/v2/namespaces/default/silenced/linux:nginx", http.StatusNoContent, nil)
+	sensuAPI.on("DELETE", "/api/core/v2/namespaces/default/silenced/entity:server-1:nginx", http.StatusNoContent, nil)
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "systemctl restart nginx"
+	config.Subscriptions = "linux"
+	config.Entities = "server-1"
+	config.Silence = true
+	config.SilenceExpire = "5m"
+	config.SilenceCheck = "nginx"
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "server-1"}},
+	})
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	requests := sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/silenced")
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 silencing entries, got %d", len(requests))
+	}
+	for i, subscription := range []string{"linux", "entity:server-1"} {
+		var silence v2.Silenced
+		requests[i].decode(t, &silence)
+		if silence.Subscription != subscription || silence.Check != "nginx" {
+			t.Errorf("expected silencing entry for %s:nginx, got %s:%s", subscription, silence.Subscription, silence.Check)
+		}
+		if silence.Expire != 300 {
+			t.Errorf("expected silencing entry to expire in 300s, got %d", silence.Expire)
+		}
+		if silence.Name != subscription+":nginx" || silence.Namespace != "default" {
+			t.Errorf("unexpected silencing entry metadata: %s/%s", silence.Namespace, silence.Name)
+		}
+	}
+	if n := len(sensuAPI.requestsTo("DELETE", "/api/core/v2/namespaces/default/silenced/linux:nginx")); n != 0 {
+		t.Errorf("expected silencing entries to be kept after a successful execution, got %d deletes", n)
+	}
+
+	// silencing entries are cleaned up when the execution request fails
+	sensuAPI.on("POST", "/api/core/v2/namespaces/default/checks/test-job/execute", http.StatusInternalServerError, nil)
+	if _, err := executePlaybook(nil); err == nil {
+		t.Fatal("expected error")
+	}
+	for _, name := range []string{"linux:nginx", "entity:server-1:nginx"} {
+		if n := len(sensuAPI.requestsTo("DELETE", "/api/core/v2/namespaces/default/silenced/"+name)); n != 1 {
+			t.Errorf("expected silencing entry %s to be deleted once, got %d deletes", name, n)
+		}
+	}
+}
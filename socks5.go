@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// parseSOCKS5 parses the --dial-socks5 proxy, given as host:port or as a
+// socks5://[user:password@]host:port URL, into its address and credentials.
+func parseSOCKS5(s string) (string, *proxy.Auth, error) {
+	if !strings.Contains(s, "://") {
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			return "", nil, fmt.Errorf("invalid --dial-socks5 \"%s\": %w", s, err)
+		}
+		return s, nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid --dial-socks5 \"%s\": %w", s, err)
+	} else if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return "", nil, fmt.Errorf("invalid --dial-socks5 \"%s\" (the scheme must be socks5)", s)
+	} else if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return "", nil, fmt.Errorf("invalid --dial-socks5 \"%s\": %w", s, err)
+	}
+	var auth *proxy.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = &proxy.Auth{User: u.User.Username(), Password: password}
+	}
+	return u.Host, auth, nil
+}
+
+// socks5Dial returns the dial function of the HTTP transport that connects
+// to the Sensu API through the --dial-socks5 proxy (e.g. an SSH tunnel to a
+// bastion host, as opened by ssh -D). The proxy resolves the API host names.
+func socks5Dial(s string) (func(ctx context.Context, network string, addr string) (net.Conn, error), error) {
+	address, auth, err := parseSOCKS5(s)
+	if err != nil {
+		return nil, err
+	}
+	dialer, err := proxy.SOCKS5("tcp", address, auth, proxy.Direct)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --dial-socks5 \"%s\": %w", s, err)
+	}
+	if contextDialer, ok := dialer.(proxy.ContextDialer); ok {
+		return contextDialer.DialContext, nil
+	}
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		return dialer.Dial(network, addr)
+	}, nil
+}
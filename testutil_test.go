@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRequest is a request received by a fakeSensu API.
+type fakeRequest struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   []byte
+}
+
+// decode unmarshals the JSON request body into v.
+func (r fakeRequest) decode(t *testing.T, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(r.Body, v); err != nil {
+		t.Fatalf("failed to decode %s %s request body: %s", r.Method, r.Path, err)
+	}
+}
+
+// fakeSensu is an in-process fake of the Sensu API for use in tests. By
+// default it accepts check creation (201) and execution (202) requests,
+// returns any requested namespace, and returns empty entity and event lists;
+// any route can be overridden with on() or handle(). Every request is recorded
+// so tests can assert the exact request bodies and headers.
+type fakeSensu struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []fakeRequest
+	handlers map[string]http.HandlerFunc
+}
+
+// newFakeSensu starts a fake Sensu API and points the plugin config at it.
+// Callers must Close() it when done.
+func newFakeSensu(t *testing.T) *fakeSensu {
+	f := &fakeSensu{
+		handlers: make(map[string]http.HandlerFunc),
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("failed to read request body: %s", err)
+		}
+		f.mu.Lock()
+		f.requests = append(f.requests, fakeRequest{
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Query:  r.URL.Query(),
+			Header: r.Header,
+			Body:   body,
+		})
+		handler, ok := f.handlers[r.Method+" "+r.URL.Path]
+		f.mu.Unlock()
+		if !ok {
+			handler = defaultFakeHandler
+		}
+		r.Body = ioutil.NopCloser(strings.NewReader(string(body)))
+		handler(w, r)
+	}))
+	config.SensuAPIUrl = f.URL
+	return f
+}
+
+// defaultFakeHandler implements the default fakeSensu responses.
+func defaultFakeHandler(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/checks"):
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/execute"):
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/api/core/v2/namespaces/") && strings.Count(r.URL.Path, "/") == 5:
+		_, _ = w.Write([]byte("{}"))
+	case r.Method == "GET" && (strings.HasSuffix(r.URL.Path, "/entities") || strings.HasSuffix(r.URL.Path, "/events")):
+		_, _ = w.Write([]byte("[]"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// handle overrides the handler for the given method and path.
+func (f *fakeSensu) handle(method string, path string, handler http.HandlerFunc) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.handlers[method+" "+path] = handler
+}
+
+// on overrides the response for the given method and path with a canned
+// status and body; a non-nil body is encoded as JSON.
+func (f *fakeSensu) on(method string, path string, status int, body interface{}) {
+	f.handle(method, path, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if body != nil {
+			_ = json.NewEncoder(w).Encode(body)
+		}
+	})
+}
+
+// writeJSON writes v as a JSON response body.
+func writeJSON(t *testing.T, w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		t.Errorf("failed to encode response body: %s", err)
+	}
+}
+
+// requestsTo returns the recorded requests for the given method and path.
+func (f *fakeSensu) requestsTo(method string, path string) []fakeRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var requests []fakeRequest
+	for _, r := range f.requests {
+		if r.Method == method && r.Path == path {
+			requests = append(requests, r)
+		}
+	}
+	return requests
+}
+
+// runMainEnv is set in the environment of the child processes started by
+// runMain.
+const runMainEnv = "SENSU_RUNBOOK_TEST_MAIN"
+
+// TestRunMain is not a test: it runs main() with the arguments following "--"
+// when started by runMain, and does nothing otherwise.
+func TestRunMain(t *testing.T) {
+	if os.Getenv(runMainEnv) != "1" {
+		return
+	}
+	args := os.Args
+	for i, arg := range args {
+		if arg == "--" {
+			args = args[i+1:]
+			break
+		}
+	}
+	os.Args = append([]string{"sensu-runbook"}, args...)
+	main()
+}
+
+// runMain runs main() in a child process with the given additional
+// environment and arguments, so the options go through the same flag and
+// environment variable parsing as the plugin. It returns the combined output
+// and the exit status.
+func runMain(t *testing.T, env []string, args ...string) (string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=^TestRunMain$", "--"}, args...)...)
+	cmd.Env = append(append(os.Environ(), runMainEnv+"=1"), env...)
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return string(out), exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatalf("failed to run main: %s", err)
+	}
+	return string(out), 0
+}
+
+// resetConfig restores the plugin configuration to its option defaults, and
+// forgets the triggering event and playbook.
+func resetConfig() {
+	for _, opt := range options {
+		reflect.ValueOf(opt.Value).Elem().Set(reflect.ValueOf(opt.Default))
+	}
+	triggeringEvent = nil
+	playbook = nil
+}
+
+// trackingTransport is an http.RoundTripper that records whether every
+// response body it returns gets closed.
+type trackingTransport struct {
+	mu     sync.Mutex
+	bodies []*trackingBody
+}
+
+type trackingBody struct {
+	io.ReadCloser
+	url    string
+	closed bool
+}
+
+func (b *trackingBody) Close() error {
+	b.closed = true
+	return b.ReadCloser.Close()
+}
+
+func (t *trackingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body := &trackingBody{ReadCloser: resp.Body, url: req.URL.String()}
+	t.mu.Lock()
+	t.bodies = append(t.bodies, body)
+	t.mu.Unlock()
+	resp.Body = body
+	return resp, nil
+}
+
+// unclosed returns the URLs of the responses whose bodies were not closed.
+func (t *trackingTransport) unclosed() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var urls []string
+	for _, body := range t.bodies {
+		if !body.closed {
+			urls = append(urls, body.url)
+		}
+	}
+	return urls
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// serverValidateJob validates the runbook job against the Sensu API without
+// writing anything. The core/v2 API has no dry run for check creation (a POST
+// always registers the check), so the check itself is only validated locally;
+// the API is asked for what can be verified read-only: that the namespace is
+// accessible with the access token (see preflight), and whether the runbook
+// job check already exists. The --entities and assets have been validated by
+// runJob. The runbook job is never registered or executed.
+func serverValidateJob(ctx context.Context, httpClient *http.Client, job *v2.CheckConfig) (int, error) {
+	if !config.Preflight {
+		if err := preflight(ctx, httpClient, job.Namespace); err != nil {
+			return sensu.CheckStateCritical, err
+		}
+	}
+	_, err := getJob(ctx, httpClient, job.Namespace, job.Name)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		logger.Infof("runbook job %s/%s does not exist yet and would be registered\n", job.Namespace, job.Name)
+	} else if err != nil {
+		return sensu.CheckStateCritical, fmt.Errorf("ERROR: failed to get the existing runbook job: %w", unprefixed(err))
+	} else {
+		logger.Infof("runbook job %s/%s already exists and would be updated\n", job.Namespace, job.Name)
+	}
+	logger.Warnf("server-side validation of the check is not supported by the Sensu API (it cannot validate a check without registering it); the runbook job check was only validated locally\n")
+	if config.Output == outputText {
+		fmt.Fprintf(stdout, "runbook job %s/%s is valid\n", job.Namespace, job.Name)
+	} else {
+		logger.Infof("runbook job %s/%s is valid\n", job.Namespace, job.Name)
+	}
+	return sensu.CheckStateOK, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+func TestExecutePlaybookServerValidate(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	var out, logs bytes.Buffer
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	logger.SetOutput(&logs)
+	defer logger.SetOutput(os.Stderr)
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "systemctl restart nginx"
+	config.Subscriptions = "web"
+	config.ServerValidate = true
+
+	for _, existing := range []bool{false, true} {
+		out.Reset()
+		logs.Reset()
+		if existing {
+			sensuAPI.on("GET", "/api/core/v2/namespaces/default/checks/test-job", http.StatusOK, v2.CheckConfig{ObjectMeta: v2.ObjectMeta{Name: "test-job", Namespace: "default"}})
+		}
+		if _, err := executePlaybook(nil); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !strings.HasPrefix(out.String(), "runbook job default/test-job is valid\n") {
+			t.Errorf("expected the runbook job to be reported valid, got %q", out.String())
+		}
+		if !strings.Contains(logs.String(), "server-side validation of the check is not supported") {
+			t.Errorf("expected a warning that the check is only validated locally, got %q", logs.String())
+		}
+		if expected := map[bool]string{false: "would be registered", true: "would be updated"}[existing]; !strings.Contains(logs.String(), expected) {
+			t.Errorf("expected the runbook job to be reported as one that %s, got %q", expected, logs.String())
+		}
+	}
+	sensuAPI.mu.Lock()
+	defer sensuAPI.mu.Unlock()
+	for _, request := range sensuAPI.requests {
+		if request.Method != "GET" {
+			t.Errorf("expected --server-validate to write nothing, got %s %s", request.Method, request.Path)
+		}
+	}
+}
+
+func TestExecutePlaybookServerValidateFailure(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	var out bytes.Buffer
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "systemctl restart nginx"
+	config.Subscriptions = "web"
+	config.ServerValidate = true
+	config.Preflight = false
+
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default", http.StatusForbidden, map[string]string{"message": "forbidden"})
+	status, err := executePlaybook(nil)
+	if status != sensu.CheckStateCritical {
+		t.Errorf("expected status %d, got %d", sensu.CheckStateCritical, status)
+	}
+	if err == nil || !strings.Contains(err.Error(), "namespace \"default\" not found or not accessible") {
+		t.Errorf("expected the inaccessible namespace to be reported even with --preflight=false, got %v", err)
+	}
+
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default", http.StatusOK, map[string]string{})
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/checks/test-job", http.StatusInternalServerError, map[string]string{"message": "internal error"})
+	status, err = executePlaybook(nil)
+	if status != sensu.CheckStateCritical {
+		t.Errorf("expected status %d, got %d", sensu.CheckStateCritical, status)
+	}
+	if err == nil || !strings.Contains(err.Error(), "failed to get the existing runbook job") {
+		t.Errorf("expected the failure to get the existing check to be reported, got %v", err)
+	}
+	if strings.Contains(out.String(), "is valid") {
+		t.Errorf("expected the runbook job not to be reported valid, got %q", out.String())
+	}
+}
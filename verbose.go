@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// redactedHeaders are the request headers whose values are never logged by
+// --verbose.
+var redactedHeaders = []string{"Authorization"}
+
+// logRequest logs the method, URL, headers, and body of an API request with
+// --verbose. The request body is read from a copy (see GetBody), leaving the
+// request itself untouched.
+func logRequest(req *http.Request) {
+	logger.Debugf("> %s %s\n", req.Method, req.URL)
+	var names []string
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := strings.Join(req.Header[name], ", ")
+		if stringSliceContains(redactedHeaders, name) {
+			value = "<redacted>"
+		}
+		logger.Debugf("> %s: %s\n", name, value)
+	}
+	if req.GetBody == nil {
+		return
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return
+	}
+	defer body.Close()
+	if b, err := ioutil.ReadAll(body); err == nil && len(b) > 0 {
+		logger.Debugf("> %s\n", b)
+	}
+}
+
+// logResponse logs the status and body of an API response with --verbose.
+// The body is buffered and replayed to the caller, including any error
+// reading it (e.g. exceeding --max-response-bytes).
+func logResponse(req *http.Request, resp *http.Response) {
+	logger.Debugf("< %s %s: %s\n", req.Method, req.URL.Path, resp.Status)
+	b, err := ioutil.ReadAll(resp.Body)
+	if len(b) > 0 {
+		logger.Debugf("< %s\n", bytes.TrimSpace(b))
+	}
+	resp.Body = &replayedBody{
+		Reader: io.MultiReader(bytes.NewReader(b), errReader{err}),
+		Closer: resp.Body,
+	}
+}
+
+// replayedBody is a response body that was already read by logResponse.
+type replayedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// errReader is a reader that fails with the given error, or reports EOF if
+// there is none.
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	return 0, io.EOF
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+func TestExecutePlaybookVerbose(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "web-1"}, Subscriptions: []string{"web"}},
+	})
+	var logs, out bytes.Buffer
+	logger.SetOutput(&logs)
+	defer logger.SetOutput(os.Stderr)
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "web"
+	config.SensuAccessToken = "s3cr3t"
+	config.PreviewTargets = true
+	config.Output = outputJSON
+	config.Verbose = true
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, expected := range []string{
+		"DEBUG: > POST " + sensuAPI.URL + "/api/core/v2/namespaces/default/checks\n",
+		"DEBUG: > Authorization: <redacted>\n",
+		"DEBUG: > Content-Type: application/json\n",
+		`"command":"hostname"`,
+		"DEBUG: < POST /api/core/v2/namespaces/default/checks: 201 Created\n",
+		"DEBUG: < GET /api/core/v2/namespaces/default/entities: 200 OK\n",
+		`"subscriptions":["web"],"last_seen":0`,
+		"DEBUG: < POST /api/core/v2/namespaces/default/checks/test-job/execute: 202 Accepted\n",
+	} {
+		if !strings.Contains(logs.String(), expected) {
+			t.Errorf("expected logs to contain %q, got:\n%s", expected, logs.String())
+		}
+	}
+	if strings.Contains(logs.String(), "s3cr3t") {
+		t.Errorf("expected the access token to be redacted, got:\n%s", logs.String())
+	}
+	// the logs don't mix with the results, and the logged response bodies
+	// are still read by the requests
+	var results []RunResult
+	if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+		t.Fatalf("expected JSON results on stdout, got %q: %s", out.String(), err)
+	}
+	if len(results) != 1 || !results[0].Executed {
+		t.Errorf("expected 1 executed result, got %+v", results)
+	}
+
+	logs.Reset()
+	config.Verbose = false
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if strings.Contains(logs.String(), "DEBUG:") {
+		t.Errorf("expected no debug logs without --verbose, got:\n%s", logs.String())
+	}
+}
+
+func TestExecutePlaybookVerboseMaxResponseBytes(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "web-1"}, Subscriptions: []string{"web"}},
+	})
+	var logs bytes.Buffer
+	logger.SetOutput(&logs)
+	defer logger.SetOutput(os.Stderr)
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "web"
+	config.PreviewTargets = true
+	config.DryRun = true
+	config.MaxResponseBytes = 16
+	config.Verbose = true
+
+	_, err := executePlaybook(nil)
+	if err == nil || !strings.Contains(err.Error(), "response body exceeds --max-response-bytes") {
+		t.Errorf("expected the oversized response to be rejected with --verbose, got %v", err)
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// minPollInterval is the shortest allowed --poll-interval, so that waiting
+// for results doesn't overload the events API.
+const minPollInterval = 500 * time.Millisecond
+
+// stale reports whether the event is older than the execution (e.g. from a
+// previous run). When the Sensu backend returned the time it issued the check
+// request, the check.issued of the event (also set by the backend) is
+// compared with it, as check.executed is set by the agent, whose clock may be
+// behind the local one.
+func (w *jobWait) stale(event rawEvent) bool {
+	if w.issued > 0 {
+		return event.Check.Issued < w.issued
+	}
+	return event.Check.Executed < w.since.Unix()
+}
+
+// waitGrace is added to the runbook job timeout for the default
+// --wait-timeout, leaving time for the agents to receive the execution request
+// and for their results to be processed (overridable in tests).
+var waitGrace = time.Minute
+
+// rawEvent is an event along with the unmodified JSON object returned by the
+// events API.
+type rawEvent struct {
+	v2.Event
+	Raw json.RawMessage
+}
+
+// listJobEvents returns the events produced by the checks with the given
+// names in the namespace. The events API is asked to only return the events
+// of these checks, but they are also filtered here, as older Sensu versions
+// ignore the field selector.
+func listJobEvents(ctx context.Context, httpClient *http.Client, namespace string, names []string) ([]rawEvent, error) {
+	query := url.Values{"fieldSelector": []string{fmt.Sprintf("event.check.name in [%s]", strings.Join(names, ","))}}
+	var events []json.RawMessage
+	err := getAllPaginated(ctx, httpClient, apiPath("/namespaces/%s/events?%s", namespace, query.Encode()), &events)
+	if err != nil {
+		return nil, err
+	}
+	var jobEvents []rawEvent
+	for _, raw := range events {
+		event := rawEvent{Raw: raw}
+		if err := json.Unmarshal(raw, &event.Event); err != nil {
+			return nil, fmt.Errorf("failed to decode event: %w", err)
+		}
+		if event.Check != nil && event.Entity != nil && stringSliceContains(names, event.Check.Name) {
+			jobEvents = append(jobEvents, event)
+		}
+	}
+	return jobEvents, nil
+}
+
+// errWaitStopped is returned by waitForJobs when the wait times out or the
+// context is done before every result was reported.
+var errWaitStopped = errors.New("stopped waiting for runbook job results")
+
+// waitTimeoutError is returned by waitForResults when the context is done
+// before every target entity has reported a runbook job result.
+type waitTimeoutError struct {
+	Missing []string
+	Total   int
+	// Interrupted is true if the wait was interrupted (i.e. the context was
+	// canceled) rather than timed out.
+	Interrupted bool
+}
+
+func (e *waitTimeoutError) Error() string {
+	if e.Interrupted {
+		return fmt.Sprintf("interrupted while waiting for %d of %d entities: %s", len(e.Missing), e.Total, strings.Join(e.Missing, ","))
+	}
+	return fmt.Sprintf("timed out waiting for %d of %d entities: %s", len(e.Missing), e.Total, strings.Join(e.Missing, ","))
+}
+
+// jobWait is the wait for the results of a runbook job executed at a given
+// time from its target entities. The execution time is the time the Sensu
+// backend issued the check request (see issuedAt), or, if unknown, the local
+// time of the execution request.
+type jobWait struct {
+	job     *v2.CheckConfig
+	targets []string
+	since   time.Time
+	issued  int64
+	wanted  map[string]bool
+	results map[string]rawEvent
+}
+
+func newJobWait(job *v2.CheckConfig, targets []string, since time.Time, issued int64) *jobWait {
+	w := &jobWait{
+		job:     job,
+		targets: targets,
+		since:   since,
+		issued:  issued,
+		wanted:  make(map[string]bool),
+		results: make(map[string]rawEvent),
+	}
+	for _, target := range targets {
+		w.wanted[target] = true
+	}
+	return w
+}
+
+// record records the event as the result of its entity, unless it is not
+// targeted, older than the execution (e.g. from a previous run), or the
+// entity already reported a result. With --follow or --output jsonl, the
+// result is printed.
+func (w *jobWait) record(event rawEvent) {
+	if event.Check.Name != w.job.Name || !w.wanted[event.Entity.Name] || w.stale(event) {
+		return
+	}
+	if _, seen := w.results[event.Entity.Name]; seen {
+		return
+	}
+	event.Check.Output = truncateOutput(event.Check.Output, config.MaxOutputBytes)
+	w.results[event.Entity.Name] = event
+	if config.Follow && config.Output == outputText {
+		writeEntityResult(event.Event)
+	} else if config.Output == outputJSONL {
+		if err := writeEntityLine(stdout, w.job, event.Event); err != nil {
+			logger.Errorf("ERROR: failed to write the result of entity \"%s\": %s\n", event.Entity.Name, err)
+		}
+	}
+}
+
+// waitTimeout returns how long to wait for the results of the jobs: the
+// --wait-timeout, or the longest job timeout plus waitGrace.
+func waitTimeout(waits []*jobWait) (time.Duration, error) {
+	if len(config.WaitTimeout) > 0 {
+		timeout, err := time.ParseDuration(config.WaitTimeout)
+		if err != nil {
+			return 0, fmt.Errorf("invalid --wait-timeout \"%s\": %w", config.WaitTimeout, err)
+		}
+		return timeout, nil
+	}
+	var timeout time.Duration
+	for _, w := range waits {
+		if t := time.Duration(w.job.Timeout) * time.Second; t > timeout {
+			timeout = t
+		}
+	}
+	return timeout + waitGrace, nil
+}
+
+// waitForJobs polls the events API until every target entity of every job
+// has reported a result (see jobWait.record), the wait times out (see
+// waitTimeout), or the context is done; it returns errWaitStopped if it
+// stopped waiting. Every poll makes a single events request per namespace for
+// all of the jobs in it.
+func waitForJobs(ctx context.Context, httpClient *http.Client, waits []*jobWait) error {
+	interval, err := time.ParseDuration(config.PollInterval)
+	if err != nil {
+		return fmt.Errorf("invalid --poll-interval \"%s\": %w", config.PollInterval, err)
+	}
+	timeout, err := waitTimeout(waits)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var namespaces []string
+	var byNamespace = make(map[string][]*jobWait)
+	for _, w := range waits {
+		if _, ok := byNamespace[w.job.Namespace]; !ok {
+			namespaces = append(namespaces, w.job.Namespace)
+		}
+		byNamespace[w.job.Namespace] = append(byNamespace[w.job.Namespace], w)
+	}
+	for {
+		var pending, total int
+		for _, namespace := range namespaces {
+			var names []string
+			for _, w := range byNamespace[namespace] {
+				if len(w.results) < len(w.targets) && !stringSliceContains(names, w.job.Name) {
+					names = append(names, w.job.Name)
+				}
+			}
+			if len(names) == 0 {
+				continue
+			}
+			events, err := listJobEvents(ctx, httpClient, namespace, names)
+			if err != nil && ctx.Err() != nil {
+				return errWaitStopped
+			} else if err != nil {
+				return err
+			}
+			for _, event := range events {
+				for _, w := range byNamespace[namespace] {
+					w.record(event)
+				}
+			}
+		}
+		for _, w := range waits {
+			pending += len(w.targets) - len(w.results)
+			total += len(w.targets)
+		}
+		if pending == 0 {
+			return nil
+		}
+		logger.Infof("waiting for runbook job results from %d of %d entities\n", pending, total)
+		if err := sleep(ctx, interval); err != nil {
+			return errWaitStopped
+		}
+	}
+}
+
+// waitForResults polls the events API until every target entity has reported
+// a result of the runbook job executed at the given time, the wait times out,
+// or the context is done; older events (e.g. from a previous run, see
+// jobWait.stale) are treated as not reported yet. With --follow, every result is printed as soon
+// as it is reported. The results are returned in the order of the targets; on
+// a *waitTimeoutError the results reported so far are returned along with it.
+func waitForResults(ctx context.Context, httpClient *http.Client, job *v2.CheckConfig, targets []string, since time.Time, issued int64) ([]rawEvent, error) {
+	w := newJobWait(job, targets, since, issued)
+	return w.outcome(ctx, waitForJobs(ctx, httpClient, []*jobWait{w}))
+}
+
+// outcome returns the results reported so far, in the order of the targets,
+// along with the error of waitForJobs: a *waitTimeoutError for the missing
+// targets if it stopped waiting.
+func (w *jobWait) outcome(ctx context.Context, err error) ([]rawEvent, error) {
+	if err != nil && err != errWaitStopped {
+		return nil, err
+	}
+	var events []rawEvent
+	for _, target := range w.targets {
+		if event, ok := w.results[target]; ok {
+			events = append(events, event)
+		}
+	}
+	if err != nil {
+		return events, w.missing(ctx)
+	}
+	return events, nil
+}
+
+// missing returns a *waitTimeoutError for the targets that have not reported
+// a result.
+func (w *jobWait) missing(ctx context.Context) *waitTimeoutError {
+	var err = &waitTimeoutError{Total: len(w.targets), Interrupted: ctx.Err() == context.Canceled}
+	for _, target := range w.targets {
+		if _, ok := w.results[target]; !ok {
+			err.Missing = append(err.Missing, target)
+		}
+	}
+	return err
+}
+
+// waitAndReport waits for the results of the runbook job executed at the given
+// time (and issued by the Sensu backend at the given time, if known) from the
+// target entities, and reports them (recording them in result).
+func waitAndReport(ctx context.Context, httpClient *http.Client, job *v2.CheckConfig, targets []string, executed time.Time, issued int64, result *RunResult) (int, error) {
+	events, err := waitForResults(ctx, httpClient, job, targets, executed, issued)
+	return recordResults(events, err, result)
+}
+
+// recordResults reports the results of a wait (recording them in result).
+// Timing out before every entity has reported is a WARNING, and the results
+// reported so far are kept.
+func recordResults(events []rawEvent, err error, result *RunResult) (int, error) {
+	timeout, timedOut := err.(*waitTimeoutError)
+	if err != nil && !timedOut {
+		return sensu.CheckStateCritical, fmt.Errorf("ERROR: failed waiting for runbook job results: %w", err)
+	}
+	for _, event := range events {
+		result.Entities = append(result.Entities, EntityResult{
+			Name:   event.Entity.Name,
+			Status: event.Check.Status,
+			Output: event.Check.Output,
+		})
+		if config.RawEvents {
+			result.RawEvents = append(result.RawEvents, event.Raw)
+		}
+	}
+	if timedOut {
+		result.MissingEntities = timeout.Missing
+		reportResults(events)
+		return sensu.CheckStateWarning, fmt.Errorf("ERROR: %w", timeout)
+	}
+	return reportResults(events)
+}
+
+// truncateOutput truncates the output to at most max bytes (without splitting
+// a UTF-8 character), marking how many bytes were removed. A max of 0 means no
+// limit.
+func truncateOutput(output string, max int) string {
+	if max <= 0 || len(output) <= max {
+		return output
+	}
+	n := max
+	for n > 0 && !utf8.RuneStart(output[n]) {
+		n--
+	}
+	return fmt.Sprintf("%s...[truncated %d bytes]", output[:n], len(output)-n)
+}
+
+// writeEntityResult prints the runbook job result reported by an entity.
+func writeEntityResult(event v2.Event) {
+	fmt.Fprintf(stdout, "%s (status %d):\n%s\n", event.Entity.Name, event.Check.Status, strings.TrimRight(event.Check.Output, "\n"))
+}
+
+// entityLine is the runbook job result reported by an entity, as printed on
+// its own line with --output jsonl.
+type entityLine struct {
+	JobID     string `json:"job_id"`
+	Namespace string `json:"namespace"`
+	Entity    string `json:"entity"`
+	Status    uint32 `json:"status"`
+	Output    string `json:"output"`
+}
+
+// writeEntityLine prints the result of the runbook job reported by an entity
+// as a single line of JSON.
+func writeEntityLine(w io.Writer, job *v2.CheckConfig, event v2.Event) error {
+	b, err := json.Marshal(entityLine{
+		JobID:     job.Name,
+		Namespace: job.Namespace,
+		Entity:    event.Entity.Name,
+		Status:    event.Check.Status,
+		Output:    event.Check.Output,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+// reportResults prints the runbook job results (in text output mode, unless
+// they were already printed with --follow) and returns the worst state among
+// them.
+func reportResults(events []rawEvent) (int, error) {
+	var state = sensu.CheckStateOK
+	var failed []string
+	for _, event := range events {
+		if config.Output == outputText && !config.Follow {
+			writeEntityResult(event.Event)
+		}
+		if event.Check.Status == 0 {
+			continue
+		}
+		failed = append(failed, event.Entity.Name)
+		if event.Check.Status == 1 && state < sensu.CheckStateWarning {
+			state = sensu.CheckStateWarning
+		} else if event.Check.Status > 1 {
+			state = sensu.CheckStateCritical
+		}
+	}
+	if len(failed) > 0 {
+		return state, fmt.Errorf("ERROR: runbook job failed on %d of %d entities: %s", len(failed), len(events), strings.Join(failed, ","))
+	}
+	return sensu.CheckStateOK, nil
+}
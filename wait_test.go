@@ -0,0 +1,603 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	v2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-plugin-sdk/sensu"
+)
+
+// jobEvent returns an event for a check executed just now.
+func jobEvent(entity string, check string, status uint32, output string) v2.Event {
+	return v2.Event{
+		Entity: &v2.Entity{ObjectMeta: v2.ObjectMeta{Name: entity}},
+		Check: &v2.Check{
+			ObjectMeta: v2.ObjectMeta{Name: check},
+			Status:     status,
+			Output:     output,
+			Executed:   time.Now().Unix(),
+		},
+	}
+}
+
+func TestExecutePlaybookWait(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	config.PollInterval = "1ms"
+	var out bytes.Buffer
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "web-1"}, Subscriptions: []string{"web"}},
+		{ObjectMeta: v2.ObjectMeta{Name: "web-2"}, Subscriptions: []string{"web"}},
+	})
+	var polls int
+	sensuAPI.handle("GET", "/api/core/v2/namespaces/default/events", func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		events := []v2.Event{
+			jobEvent("web-1", "test-job", 0, "ok\n"),
+			jobEvent("web-2", "other-check", 2, "unrelated"),
+		}
+		if polls > 1 {
+			events = append(events, jobEvent("web-2", "test-job", 2, "failed\n"))
+		}
+		writeJSON(t, w, events)
+	})
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "web"
+	config.Wait = true
+
+	status, err := executePlaybook(nil)
+	if status != sensu.CheckStateCritical {
+		t.Errorf("expected status %d, got %d", sensu.CheckStateCritical, status)
+	}
+	expected := "ERROR: runbook job failed on 1 of 2 entities: web-2"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+	if polls != 2 {
+		t.Errorf("expected 2 event polls, got %d", polls)
+	}
+	expectedOutput := "web-1 (status 0):\nok\nweb-2 (status 2):\nfailed\n" +
+		"RESULT job_id=test-job namespace=default status=CRITICAL created=true executed=true entities_ok=1 entities_failed=1\n"
+	if out.String() != expectedOutput {
+		t.Errorf("expected output %q, got %q", expectedOutput, out.String())
+	}
+}
+
+func TestExecutePlaybookDeadline(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	config.PollInterval = "10ms"
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "web-1"}, Subscriptions: []string{"web"}},
+	})
+	// the entity never reports, and the events API is slow to respond
+	sensuAPI.handle("GET", "/api/core/v2/namespaces/default/events", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		writeJSON(t, w, []v2.Event{})
+	})
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "web"
+	config.Wait = true
+	config.Deadline = "100ms"
+
+	start := time.Now()
+	status, err := executePlaybook(nil)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the deadline to abort the wait, took %s", elapsed)
+	}
+	if status != sensu.CheckStateWarning {
+		t.Errorf("expected status %d, got %d", sensu.CheckStateWarning, status)
+	}
+	if err == nil || !strings.HasPrefix(err.Error(), "ERROR: deadline exceeded") {
+		t.Errorf("expected deadline exceeded error, got %v", err)
+	}
+	if requests := sensuAPI.requestsTo("POST", "/api/core/v2/namespaces/default/checks/test-job/execute"); len(requests) != 1 {
+		t.Errorf("expected 1 execute request, got %d", len(requests))
+	}
+}
+
+func TestExecutePlaybookWaitTimeout(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	config.PollInterval = "10ms"
+	var out bytes.Buffer
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "web-1"}, Subscriptions: []string{"web"}},
+		{ObjectMeta: v2.ObjectMeta{Name: "web-2"}, Subscriptions: []string{"web"}},
+		{ObjectMeta: v2.ObjectMeta{Name: "web-3"}, Subscriptions: []string{"web"}},
+	})
+	// web-2 never reports
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/events", http.StatusOK, []v2.Event{
+		jobEvent("web-1", "test-job", 0, "ok"),
+		jobEvent("web-3", "test-job", 0, "ok"),
+	})
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "web"
+	config.Wait = true
+	config.Deadline = "100ms"
+	config.Output = outputJSON
+
+	status, err := executePlaybook(nil)
+	if status != sensu.CheckStateWarning {
+		t.Errorf("expected status %d, got %d", sensu.CheckStateWarning, status)
+	}
+	if err == nil || !strings.HasSuffix(err.Error(), "timed out waiting for 1 of 3 entities: web-2") {
+		t.Errorf("expected wait timeout error, got %v", err)
+	}
+	var results []RunResult
+	if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+		t.Fatalf("failed to decode output %q: %s", out.String(), err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(results))
+	}
+	if expected := []string{"web-2"}; !reflect.DeepEqual(results[0].MissingEntities, expected) {
+		t.Errorf("expected missing entities %v, got %v", expected, results[0].MissingEntities)
+	}
+	if len(results[0].Entities) != 2 {
+		t.Errorf("expected the 2 reported entity results, got %+v", results[0].Entities)
+	}
+}
+
+func TestExecutePlaybookWaitDefaultTimeout(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	defer func(grace time.Duration) { waitGrace = grace }(waitGrace)
+	waitGrace = 100 * time.Millisecond
+	config.PollInterval = "10ms"
+	var out bytes.Buffer
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "web-1"}, Subscriptions: []string{"web"}},
+		{ObjectMeta: v2.ObjectMeta{Name: "web-2"}, Subscriptions: []string{"web"}},
+	})
+	// web-2 never reports, and there is no --deadline
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/events", http.StatusOK, []v2.Event{
+		jobEvent("web-1", "test-job", 0, "ok"),
+	})
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "web"
+	config.Wait = true
+	config.Output = outputJSON
+
+	for _, test := range []struct {
+		timeout     string
+		waitTimeout string
+	}{
+		// the job timeout plus the grace period
+		{"0", ""},
+		{"10", "100ms"},
+	} {
+		out.Reset()
+		config.Timeout = test.timeout
+		config.WaitTimeout = test.waitTimeout
+		start := time.Now()
+		status, err := executePlaybook(nil)
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("--timeout %s --wait-timeout %q: expected the wait to time out, took %s", test.timeout, test.waitTimeout, elapsed)
+		}
+		if status != sensu.CheckStateWarning {
+			t.Errorf("--timeout %s --wait-timeout %q: expected status %d, got %d", test.timeout, test.waitTimeout, sensu.CheckStateWarning, status)
+		}
+		if err == nil || err.Error() != "ERROR: timed out waiting for 1 of 2 entities: web-2" {
+			t.Errorf("--timeout %s --wait-timeout %q: expected wait timeout error, got %v", test.timeout, test.waitTimeout, err)
+		}
+		var results []RunResult
+		if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+			t.Fatalf("failed to decode output %q: %s", out.String(), err)
+		}
+		if len(results) != 1 || !reflect.DeepEqual(results[0].MissingEntities, []string{"web-2"}) {
+			t.Errorf("--timeout %s --wait-timeout %q: expected web-2 to be missing, got %+v", test.timeout, test.waitTimeout, results)
+		}
+	}
+}
+
+func TestExecutePlaybookPollInterval(t *testing.T) {
+	// a fake clock: every poll sleep advances the simulated time, until the
+	// simulated wait of 10s has elapsed
+	realSleep := sleep
+	defer func() { sleep = realSleep }()
+	var elapsed time.Duration
+	sleep = func(ctx context.Context, d time.Duration) error {
+		if elapsed += d; elapsed >= 10*time.Second {
+			return context.DeadlineExceeded
+		}
+		return nil
+	}
+	testCases := []struct {
+		interval string
+		polls    int
+	}{
+		{"2s", 5},
+		{"500ms", 20},
+	}
+	for _, tc := range testCases {
+		resetConfig()
+		sensuAPI := newFakeSensu(t)
+		sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+			{ObjectMeta: v2.ObjectMeta{Name: "web-1"}, Subscriptions: []string{"web"}},
+		})
+		elapsed = 0
+		config.Namespace = "default"
+		config.JobID = "test-job"
+		config.Command = "hostname"
+		config.Subscriptions = "web"
+		config.Wait = true
+		config.Output = outputJSON
+		config.PollInterval = tc.interval
+
+		if status, _ := executePlaybook(nil); status != sensu.CheckStateWarning {
+			t.Errorf("%s: expected status %d, got %d", tc.interval, sensu.CheckStateWarning, status)
+		}
+		if n := len(sensuAPI.requestsTo("GET", "/api/core/v2/namespaces/default/events")); n != tc.polls {
+			t.Errorf("%s: expected %d polls over 10s, got %d", tc.interval, tc.polls, n)
+		}
+		sensuAPI.Close()
+	}
+	resetConfig()
+}
+
+func TestTruncateOutput(t *testing.T) {
+	testCases := []struct {
+		output   string
+		max      int
+		expected string
+	}{
+		{"short", 10, "short"},
+		{"0123456789abcdef", 10, "0123456789...[truncated 6 bytes]"},
+		{"0123456789abcdef", 0, "0123456789abcdef"},
+		// "é" is 2 bytes, and is not split
+		{"aaaaaaaaaéé", 10, "aaaaaaaaa...[truncated 4 bytes]"},
+	}
+	for _, tc := range testCases {
+		if got := truncateOutput(tc.output, tc.max); got != tc.expected {
+			t.Errorf("truncateOutput(%q, %d): expected %q, got %q", tc.output, tc.max, tc.expected, got)
+		}
+	}
+}
+
+func TestExecutePlaybookWaitMaxOutputBytes(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	config.PollInterval = "1ms"
+	var out bytes.Buffer
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "web-1"}, Subscriptions: []string{"web"}},
+	})
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/events", http.StatusOK, []v2.Event{
+		jobEvent("web-1", "test-job", 0, strings.Repeat("x", 10000)),
+	})
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "journalctl -u nginx"
+	config.Subscriptions = "web"
+	config.Wait = true
+	config.MaxOutputBytes = 100
+	expected := strings.Repeat("x", 100) + "...[truncated 9900 bytes]"
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.HasPrefix(out.String(), "web-1 (status 0):\n"+expected+"\n") {
+		t.Errorf("expected truncated text output, got %q", out.String())
+	}
+
+	out.Reset()
+	config.Output = outputJSON
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var results []RunResult
+	if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+		t.Fatalf("failed to decode output %q: %s", out.String(), err)
+	}
+	if len(results) != 1 || len(results[0].Entities) != 1 || results[0].Entities[0].Output != expected {
+		t.Errorf("expected truncated JSON output, got %+v", results)
+	}
+}
+
+func TestExecutePlaybookWaitIgnoresStaleEvents(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	config.PollInterval = "1ms"
+	var out bytes.Buffer
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "web-1"}, Subscriptions: []string{"web"}},
+	})
+	// the first polls only return the result of a previous run
+	stale := jobEvent("web-1", "test-job", 2, "stale\n")
+	stale.Check.Executed = time.Now().Add(-time.Hour).Unix()
+	var polls int
+	sensuAPI.handle("GET", "/api/core/v2/namespaces/default/events", func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		if polls < 3 {
+			writeJSON(t, w, []v2.Event{stale})
+			return
+		}
+		writeJSON(t, w, []v2.Event{jobEvent("web-1", "test-job", 0, "fresh\n")})
+	})
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "web"
+	config.Wait = true
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if polls != 3 {
+		t.Errorf("expected the stale event to be ignored until the fresh one is reported (3 polls), got %d", polls)
+	}
+	if !strings.HasPrefix(out.String(), "web-1 (status 0):\nfresh\n") {
+		t.Errorf("expected only the fresh result to be reported, got %q", out.String())
+	}
+}
+
+func TestExecutePlaybookWaitAgentClockSkew(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	config.PollInterval = "1ms"
+	var out bytes.Buffer
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "web-1"}, Subscriptions: []string{"web"}},
+	})
+	// the backend issues the check request now, but the clock of the agent
+	// that executes it is 10 minutes behind
+	issued := time.Now().Unix()
+	sensuAPI.on("POST", "/api/core/v2/namespaces/default/checks/test-job/execute", http.StatusAccepted, map[string]int64{"issued": issued})
+	stale := jobEvent("web-1", "test-job", 2, "stale\n")
+	stale.Check.Issued = issued - 3600
+	stale.Check.Executed = issued - 3600
+	fresh := jobEvent("web-1", "test-job", 0, "fresh\n")
+	fresh.Check.Issued = issued
+	fresh.Check.Executed = issued - 600
+	var polls int
+	sensuAPI.handle("GET", "/api/core/v2/namespaces/default/events", func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		if polls < 3 {
+			writeJSON(t, w, []v2.Event{stale})
+			return
+		}
+		writeJSON(t, w, []v2.Event{fresh})
+	})
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "web"
+	config.Wait = true
+	config.WaitTimeout = "5s"
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if polls != 3 {
+		t.Errorf("expected the stale event to be ignored until the fresh one is reported (3 polls), got %d", polls)
+	}
+	if !strings.HasPrefix(out.String(), "web-1 (status 0):\nfresh\n") {
+		t.Errorf("expected the fresh result executed by the agent behind to be reported, got %q", out.String())
+	}
+}
+
+func TestExecutePlaybookFollow(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	config.PollInterval = "1ms"
+	var out bytes.Buffer
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "web-1"}, Subscriptions: []string{"web"}},
+		{ObjectMeta: v2.ObjectMeta{Name: "web-2"}, Subscriptions: []string{"web"}},
+	})
+	var polls int
+	sensuAPI.handle("GET", "/api/core/v2/namespaces/default/events", func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		events := []v2.Event{jobEvent("web-1", "test-job", 0, "first\n")}
+		if polls > 1 {
+			// web-1 reports again, along with the new web-2 result
+			events = append(events, jobEvent("web-2", "test-job", 0, "second\n"))
+		}
+		writeJSON(t, w, events)
+	})
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "web"
+	config.Follow = true
+	config.Wait = true
+
+	if _, err := executePlaybook(nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if polls != 2 {
+		t.Errorf("expected 2 event polls, got %d", polls)
+	}
+	expected := "web-1 (status 0):\nfirst\nweb-2 (status 0):\nsecond\n" +
+		"RESULT job_id=test-job namespace=default status=OK created=true executed=true entities_ok=2 entities_failed=0\n"
+	if out.String() != expected {
+		t.Errorf("expected every result to be printed once, got %q", out.String())
+	}
+}
+
+func TestExecutePlaybookJSONLOutput(t *testing.T) {
+	resetConfig()
+	defer resetConfig()
+	sensuAPI := newFakeSensu(t)
+	defer sensuAPI.Close()
+	config.PollInterval = "1ms"
+	var out bytes.Buffer
+	stdout = &out
+	defer func() { stdout = os.Stdout }()
+	sensuAPI.on("GET", "/api/core/v2/namespaces/default/entities", http.StatusOK, []v2.Entity{
+		{ObjectMeta: v2.ObjectMeta{Name: "web-1"}, Subscriptions: []string{"web"}},
+		{ObjectMeta: v2.ObjectMeta{Name: "web-2"}, Subscriptions: []string{"web"}},
+	})
+	var polls int
+	var lines []int
+	sensuAPI.handle("GET", "/api/core/v2/namespaces/default/events", func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		lines = append(lines, strings.Count(out.String(), "\n"))
+		events := []v2.Event{jobEvent("web-1", "test-job", 0, "first result\n")}
+		if polls > 1 {
+			events = append(events, jobEvent("web-2", "test-job", 2, "second result\n"))
+		}
+		writeJSON(t, w, events)
+	})
+	config.Namespace = "default"
+	config.JobID = "test-job"
+	config.Command = "hostname"
+	config.Subscriptions = "web"
+	config.Output = outputJSONL
+	config.Wait = true
+	config.MaxOutputBytes = 5
+
+	if _, err := executePlaybook(nil); err == nil {
+		t.Errorf("expected the failed entity to be reported")
+	}
+	// web-1 was printed as soon as it reported, before the second poll
+	if expected := []int{0, 1}; !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected the lines printed before each poll to be %v, got %v", expected, lines)
+	}
+	var results []entityLine
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		var result entityLine
+		if err := json.Unmarshal([]byte(line), &result); err != nil {
+			t.Fatalf("expected a JSON object per line, got %q: %s", line, err)
+		}
+		results = append(results, result)
+	}
+	expected := []entityLine{
+		{JobID: "test-job", Namespace: "default", Entity: "web-1", Status: 0, Output: "first...[truncated 8 bytes]"},
+		{JobID: "test-job", Namespace: "default", Entity: "web-2", Status: 2, Output: "secon...[truncated 9 bytes]"},
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("expected lines %+v, got %+v", expected, results)
+	}
+
+	config.Wait = false
+	if status, err := checkArgs(nil); status != sensu.CheckStateWarning || err == nil {
+		t.Errorf("expected warning for --output jsonl without --wait, got %d (%v)", status, err)
+	}
+}
+
+func TestExecutePlaybookConcurrentWait(t *testing.T) {
+	testCases := []struct {
+		status   uint32
+		expected int
+	}{
+		{2, sensu.CheckStateCritical},
+		{1, sensu.CheckStateWarning},
+	}
+	for _, tc := range testCases {
+		resetConfig()
+		sensuAPI := newFakeSensu(t)
+		var delays []time.Duration
+		restoreSleep := fakeSleep(&delays)
+		for _, namespace := range []string{"prod-1", "prod-2"} {
+			sensuAPI.on("GET", "/api/core/v2/namespaces/"+namespace+"/entities", http.StatusOK, []v2.Entity{
+				{ObjectMeta: v2.ObjectMeta{Name: "web-1"}, Subscriptions: []string{"web"}},
+			})
+		}
+		sensuAPI.on("GET", "/api/core/v2/namespaces/prod-1/events", http.StatusOK, []v2.Event{jobEvent("web-1", "test-job", 0, "ok")})
+		// the failing result is only reported by the second poll
+		sensuAPI.handle("GET", "/api/core/v2/namespaces/prod-2/events", func(w http.ResponseWriter, r *http.Request) {
+			var events []v2.Event
+			if len(sensuAPI.requestsTo("GET", "/api/core/v2/namespaces/prod-2/events")) > 1 {
+				events = append(events, jobEvent("web-1", "test-job", tc.status, "failed"))
+			}
+			writeJSON(t, w, events)
+		})
+		config.Namespaces = "prod-1,prod-2"
+		config.JobID = "test-job"
+		config.Command = "systemctl restart nginx"
+		config.Subscriptions = "web"
+		config.Wait = true
+		config.Output = outputJSON
+		var out bytes.Buffer
+		stdout = &out
+
+		status, err := executePlaybook(nil)
+		if status != tc.expected {
+			t.Errorf("status %d: expected aggregated status %d, got %d", tc.status, tc.expected, status)
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), "ERROR: runbook job failed in 1 of 2 namespaces: prod-2 (") {
+			t.Errorf("status %d: expected the failure of prod-2, got %v", tc.status, err)
+		}
+		// both runbook jobs are executed before waiting for their results
+		var paths []string
+		for _, req := range sensuAPI.requests {
+			if strings.HasSuffix(req.Path, "/execute") || strings.HasSuffix(req.Path, "/events") {
+				paths = append(paths, req.Method+" "+req.Path)
+			}
+		}
+		expected := []string{
+			"POST /api/core/v2/namespaces/prod-1/checks/test-job/execute",
+			"POST /api/core/v2/namespaces/prod-2/checks/test-job/execute",
+			"GET /api/core/v2/namespaces/prod-1/events",
+			"GET /api/core/v2/namespaces/prod-2/events",
+			"GET /api/core/v2/namespaces/prod-2/events",
+		}
+		if !reflect.DeepEqual(paths, expected) {
+			t.Errorf("status %d: expected requests %v, got %v", tc.status, expected, paths)
+		}
+		for _, req := range sensuAPI.requestsTo("GET", "/api/core/v2/namespaces/prod-2/events") {
+			if selector := req.Query.Get("fieldSelector"); selector != "event.check.name in [test-job]" {
+				t.Errorf("status %d: expected the events to be filtered to the runbook job, got %q", tc.status, selector)
+			}
+		}
+		var results []RunResult
+		if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(results) != 2 || len(results[0].Entities) != 1 || len(results[1].Entities) != 1 || results[1].Entities[0].Status != tc.status {
+			t.Errorf("status %d: expected the results of both namespaces, got %+v", tc.status, results)
+		}
+		stdout = os.Stdout
+		restoreSleep()
+		sensuAPI.Close()
+	}
+	resetConfig()
+}